@@ -0,0 +1,1430 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LCLS/GPUManager/api"
+)
+
+// Route is an endpoint of the JSON API with the least role allowed to use it
+type Route struct {
+	Pattern string
+	Role    string
+	Handler http.HandlerFunc
+}
+
+// Routes is the permission table of the JSON API. Patterns are relative to
+// api.Version. Users may only change the models, templates and jobs they
+// own, and only read the logs and results of their own jobs, which their
+// handlers check.
+func (m *Manager) Routes() []Route {
+	return []Route{
+		{"GET /servers", api.RoleViewer, m.apiServers},
+		{"POST /servers", api.RoleAdmin, m.apiServerCreate},
+		{"GET /servers/{id}", api.RoleViewer, m.apiServer},
+		{"PATCH /servers/{id}", api.RoleAdmin, m.apiServerUpdate},
+		{"DELETE /servers/{id}", api.RoleAdmin, m.apiServerDelete},
+		{"GET /servers/{id}/resources", api.RoleViewer, m.apiServerResources},
+		{"POST /servers/{id}/rescan", api.RoleAdmin, m.apiServerRescan},
+		{"POST /servers/{id}/probe", api.RoleAdmin, m.apiServerProbe},
+
+		{"GET /maintenance", api.RoleViewer, m.apiMaintenance},
+		{"POST /maintenance", api.RoleAdmin, m.apiMaintenanceCreate},
+		{"GET /maintenance/{id}", api.RoleViewer, m.apiMaintenanceWindow},
+		{"DELETE /maintenance/{id}", api.RoleAdmin, m.apiMaintenanceDelete},
+
+		{"GET /resources", api.RoleViewer, m.apiResources},
+		{"GET /resources/{uuid}", api.RoleViewer, m.apiResource},
+		{"PATCH /resources/{uuid}", api.RoleAdmin, m.apiResourceUpdate},
+		{"GET /resources/{uuid}/telemetry", api.RoleViewer, m.apiResourceTelemetry},
+
+		{"GET /models", api.RoleViewer, m.apiModels},
+		{"POST /models", api.RoleUser, m.apiModelCreate},
+		{"GET /models/{id}", api.RoleViewer, m.apiModel},
+		{"DELETE /models/{id}", api.RoleUser, m.apiModelDelete},
+
+		{"GET /templates", api.RoleViewer, m.apiTemplates},
+		{"POST /templates", api.RoleUser, m.apiTemplateCreate},
+		{"GET /templates/{id}", api.RoleViewer, m.apiTemplate},
+		{"DELETE /templates/{id}", api.RoleUser, m.apiTemplateDelete},
+
+		{"GET /jobs", api.RoleViewer, m.apiJobs},
+		{"POST /jobs", api.RoleUser, m.apiJobCreate},
+		{"POST /jobs/spec", api.RoleUser, m.apiJobCreateFromSpec},
+		{"GET /jobs/{id}", api.RoleViewer, m.apiJob},
+		{"DELETE /jobs/{id}", api.RoleUser, m.apiJobDelete},
+		{"GET /jobs/{id}/instances", api.RoleViewer, m.apiJobInstances},
+		{"POST /jobs/{id}/cancel", api.RoleUser, m.apiJobCancel},
+		{"GET /jobs/{id}/spec", api.RoleUser, m.apiJobSpec},
+		{"GET /jobs/{id}/script", api.RoleUser, m.apiJobScript},
+
+		{"GET /instances/{id}", api.RoleViewer, m.apiInstance},
+		{"GET /instances/{id}/log", api.RoleUser, m.apiInstanceLog},
+		{"GET /instances/{id}/results", api.RoleUser, m.apiInstanceResults},
+
+		{"GET /archives", api.RoleViewer, m.apiArchives},
+		{"POST /archives", api.RoleAdmin, m.apiArchiveCreate},
+		{"GET /archives/{id}", api.RoleViewer, m.apiArchive},
+		{"PATCH /archives/{id}", api.RoleAdmin, m.apiArchiveUpdate},
+		{"DELETE /archives/{id}", api.RoleAdmin, m.apiArchiveDelete},
+
+		{"GET /events", api.RoleViewer, m.apiEvents},
+
+		{"GET /audit", api.RoleAdmin, m.apiAudit},
+		{"GET /audit/export", api.RoleAdmin, m.apiAuditExport},
+
+		{"GET /projects", api.RoleViewer, m.apiProjects},
+		{"POST /projects", api.RoleAdmin, m.apiProjectCreate},
+		{"GET /projects/{id}", api.RoleViewer, m.apiProject},
+		{"PATCH /projects/{id}", api.RoleAdmin, m.apiProjectUpdate},
+		{"DELETE /projects/{id}", api.RoleAdmin, m.apiProjectDelete},
+
+		{"POST /login", "", m.apiLogin},
+		{"POST /logout", api.RoleViewer, m.apiLogout},
+		{"GET /me", api.RoleViewer, m.apiMe},
+
+		{"GET /users", api.RoleAdmin, m.apiUsers},
+		{"POST /users", api.RoleAdmin, m.apiUserCreate},
+		{"PATCH /users/{id}", api.RoleViewer, m.apiUserUpdate},
+		{"DELETE /users/{id}", api.RoleAdmin, m.apiUserDelete},
+
+		{"GET /tokens", api.RoleViewer, m.apiTokens},
+		{"POST /tokens", api.RoleViewer, m.apiTokenCreate},
+		{"DELETE /tokens/{id}", api.RoleViewer, m.apiTokenDelete},
+
+		{"GET /openapi.json", api.RoleViewer, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(api.OpenAPI)
+		}},
+		{"GET /jobspec.schema.json", api.RoleViewer, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/schema+json")
+			w.Write(api.JobSpecSchema)
+		}},
+	}
+}
+
+// RegisterAPI adds the routes of the JSON API to mux. Every request that
+// may change something is recorded in the audit log.
+func (m *Manager) RegisterAPI(mux *http.ServeMux) {
+	for _, route := range m.Routes() {
+		method, path, _ := strings.Cut(route.Pattern, " ")
+		handler := Require(route.Role, route.Handler)
+		if method != http.MethodGet {
+			handler = audited(route.Pattern, handler)
+		}
+		mux.HandleFunc(method+" "+api.Version+path, handler)
+	}
+
+	mux.HandleFunc(api.Version+"/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, ErrNotFound)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("[API] Error:", err)
+	}
+}
+
+// writeError reports err with the status of a RequestError, or as an
+// internal error otherwise
+func writeError(w http.ResponseWriter, err error) {
+	var pe *ProbeError
+	if errors.As(err, &pe) {
+		writeJSON(w, http.StatusUnprocessableEntity, api.ProbeFailure{Error: pe.Error(), Probe: pe.Probe})
+		return
+	}
+
+	var re *RequestError
+	if errors.As(err, &re) {
+		writeJSON(w, re.Status, api.Error{Error: re.Message})
+		return
+	}
+
+	log.Println("[API] Error:", err)
+	writeJSON(w, http.StatusInternalServerError, api.Error{Error: err.Error()})
+}
+
+func writeCreated(w http.ResponseWriter, location string, v interface{}) {
+	w.Header().Set("Location", location)
+	writeJSON(w, http.StatusCreated, v)
+}
+
+func readJSON(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return &RequestError{http.StatusBadRequest, "Invalid JSON: " + err.Error()}
+	}
+	return nil
+}
+
+func pathID(r *http.Request) (int, error) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		return 0, &RequestError{http.StatusBadRequest, "Invalid ID"}
+	}
+	return id, nil
+}
+
+// queryID parses an optional numeric query parameter
+func queryID(r *http.Request, name string) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return 0, nil
+	}
+
+	id, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, &RequestError{http.StatusBadRequest, "Invalid " + name}
+	}
+	return id, nil
+}
+
+// queryTime parses an optional RFC 3339 query parameter
+func queryTime(r *http.Request, name string, fallback time.Time) (time.Time, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return fallback, &RequestError{http.StatusBadRequest, "Invalid " + name + ", expected RFC 3339 time"}
+	}
+	return t, nil
+}
+
+// queryBool parses an optional boolean query parameter
+func queryBool(r *http.Request, name string) (bool, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return false, nil
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, &RequestError{http.StatusBadRequest, "Invalid " + name}
+	}
+	return b, nil
+}
+
+// Servers
+
+func (m *Manager) apiServers(w http.ResponseWriter, r *http.Request) {
+	m.mu.RLock()
+	servers := []api.Server{}
+	for _, server := range m.servers {
+		servers = append(servers, server.API())
+	}
+	m.mu.RUnlock()
+
+	writeJSON(w, http.StatusOK, servers)
+}
+
+func (m *Manager) apiServerCreate(w http.ResponseWriter, r *http.Request) {
+	var request api.ServerRequest
+	if err := readJSON(r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	server, _, err := m.CreateServer(request)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	m.mu.RLock()
+	response := server.API()
+	m.mu.RUnlock()
+
+	writeCreated(w, fmt.Sprintf("%s/servers/%d", api.Version, server.ID), response)
+}
+
+// server returns the API representation of a server
+func (m *Manager) server(id int) (api.Server, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	server := FindServer(id, m.servers)
+	if server == nil {
+		return api.Server{}, ErrNotFound
+	}
+	return server.API(), nil
+}
+
+func (m *Manager) apiServer(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	server, err := m.server(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, server)
+}
+
+func (m *Manager) apiServerUpdate(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var update api.ServerUpdate
+	if err := readJSON(r, &update); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := checkServerUpdate(update); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := m.UpdateServer(id, update); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	server, err := m.server(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, server)
+}
+
+func (m *Manager) apiServerDelete(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	force, err := queryBool(r, "force")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := m.DeleteServer(id, force); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (m *Manager) apiServerResources(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	server, err := m.server(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, server.Resources)
+}
+
+func (m *Manager) apiServerRescan(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	rescan, err := m.RescanServer(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, rescan)
+}
+
+func (m *Manager) apiServerProbe(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	probe, err := m.ProbeServer(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, probe)
+}
+
+// Maintenance
+
+func (m *Manager) apiMaintenance(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, m.MaintenanceWindows())
+}
+
+func (m *Manager) apiMaintenanceCreate(w http.ResponseWriter, r *http.Request) {
+	var request api.MaintenanceRequest
+	if err := readJSON(r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	window, err := m.AddMaintenance(request)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeCreated(w, fmt.Sprintf("%s/maintenance/%d", api.Version, window.ID), window)
+}
+
+func (m *Manager) apiMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	for _, window := range m.MaintenanceWindows() {
+		if window.ID == id {
+			writeJSON(w, http.StatusOK, window)
+			return
+		}
+	}
+	writeError(w, ErrNotFound)
+}
+
+func (m *Manager) apiMaintenanceDelete(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := m.RemoveMaintenance(id); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Resources
+
+func (m *Manager) apiResources(w http.ResponseWriter, r *http.Request) {
+	m.mu.RLock()
+	resources := []api.Resource{}
+	for _, server := range m.servers {
+		for _, resource := range server.Resources {
+			resources = append(resources, resource.API())
+		}
+	}
+	m.mu.RUnlock()
+
+	writeJSON(w, http.StatusOK, resources)
+}
+
+func (m *Manager) apiResource(w http.ResponseWriter, r *http.Request) {
+	m.mu.RLock()
+	resource := FindServerResource(r.PathValue("uuid"), m.servers)
+	var response api.Resource
+	if resource != nil {
+		response = resource.API()
+	}
+	m.mu.RUnlock()
+
+	if resource == nil {
+		writeError(w, ErrNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (m *Manager) apiResourceUpdate(w http.ResponseWriter, r *http.Request) {
+	uuid := r.PathValue("uuid")
+
+	var update api.ResourceUpdate
+	if err := readJSON(r, &update); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if update.Enabled != nil {
+		if err := m.SetResourceEnabled(uuid, *update.Enabled); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	m.mu.RLock()
+	resource := FindServerResource(uuid, m.servers)
+	var response api.Resource
+	if resource != nil {
+		response = resource.API()
+	}
+	m.mu.RUnlock()
+
+	if resource == nil {
+		writeError(w, ErrNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// apiResourceTelemetry returns the time series of a GPU, by default for the
+// last day
+func (m *Manager) apiResourceTelemetry(w http.ResponseWriter, r *http.Request) {
+	uuid := r.PathValue("uuid")
+
+	m.mu.RLock()
+	resource := FindServerResource(uuid, m.servers)
+	m.mu.RUnlock()
+
+	if resource == nil {
+		writeError(w, ErrNotFound)
+		return
+	}
+
+	now := time.Now()
+	since, err := queryTime(r, "since", now.Add(-24*time.Hour))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	until, err := queryTime(r, "until", now)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	samples, err := TelemetrySeries(uuid, since, until)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, samples)
+}
+
+// Models
+
+func (m *Manager) apiModels(w http.ResponseWriter, r *http.Request) {
+	models := []api.Model{}
+	for _, model := range m.Models() {
+		models = append(models, model.API())
+	}
+	writeJSON(w, http.StatusOK, models)
+}
+
+// apiModelCreate takes a multipart form with the name of the model and any
+// number of files
+func (m *Manager) apiModelCreate(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(1 * 1024 * 1024); err != nil {
+		writeError(w, &RequestError{http.StatusBadRequest, "Unable to parse form"})
+		return
+	}
+
+	model, err := m.CreateModel(r.FormValue("name"), r.FormValue("project"), CurrentUser(r), r.MultipartForm.File)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeCreated(w, fmt.Sprintf("%s/models/%d", api.Version, model.ID), model.API())
+}
+
+func (m *Manager) apiModel(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	model, ok := m.FindModel(id)
+	if !ok {
+		writeError(w, ErrNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, model.API())
+}
+
+func (m *Manager) apiModelDelete(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	model, ok := m.FindModel(id)
+	if !ok {
+		writeError(w, ErrNotFound)
+		return
+	}
+	if !CurrentUser(r).Owns(model.Owner) {
+		writeError(w, ErrForbidden)
+		return
+	}
+
+	if err := m.DeleteModel(id); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Templates
+
+func (m *Manager) apiTemplates(w http.ResponseWriter, r *http.Request) {
+	templates := []api.Template{}
+	for _, template := range m.Templates() {
+		templates = append(templates, template.API())
+	}
+	writeJSON(w, http.StatusOK, templates)
+}
+
+// apiTemplateCreate takes a multipart form with the name of the template and
+// the template file
+func (m *Manager) apiTemplateCreate(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(1 * 1024 * 1024); err != nil {
+		writeError(w, &RequestError{http.StatusBadRequest, "Unable to parse form"})
+		return
+	}
+
+	template, err := m.CreateTemplate(r.FormValue("name"), r.FormValue("project"), r.FormValue("container"), CurrentUser(r), r.MultipartForm.File)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeCreated(w, fmt.Sprintf("%s/templates/%d", api.Version, template.ID), template.API())
+}
+
+func (m *Manager) apiTemplate(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	template, ok := m.FindTemplate(id)
+	if !ok {
+		writeError(w, ErrNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, template.API())
+}
+
+func (m *Manager) apiTemplateDelete(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	template, ok := m.FindTemplate(id)
+	if !ok {
+		writeError(w, ErrNotFound)
+		return
+	}
+	if !CurrentUser(r).Owns(template.Owner) {
+		writeError(w, ErrForbidden)
+		return
+	}
+
+	if err := m.DeleteTemplate(id); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Jobs
+
+func (m *Manager) apiJobs(w http.ResponseWriter, r *http.Request) {
+	jobs := []api.Job{}
+	for _, job := range m.Jobs() {
+		jobs = append(jobs, job.API())
+	}
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+func (m *Manager) apiJobCreate(w http.ResponseWriter, r *http.Request) {
+	var request api.JobRequest
+	if err := readJSON(r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	job, err := m.CreateJob(request, CurrentUser(r))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	m.mu.RLock()
+	response := job.API()
+	m.mu.RUnlock()
+
+	writeCreated(w, fmt.Sprintf("%s/jobs/%d", api.Version, job.ID), response)
+}
+
+// apiJobCreateFromSpec takes a YAML or JSON job specification as the body
+func (m *Manager) apiJobCreateFromSpec(w http.ResponseWriter, r *http.Request) {
+	spec, err := io.ReadAll(io.LimitReader(r.Body, 1*1024*1024))
+	if err != nil {
+		writeError(w, &RequestError{http.StatusBadRequest, "Unable to read spec"})
+		return
+	}
+
+	job, err := m.CreateJobFromSpec(spec, CurrentUser(r))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	m.mu.RLock()
+	response := job.API()
+	m.mu.RUnlock()
+
+	writeCreated(w, fmt.Sprintf("%s/jobs/%d", api.Version, job.ID), response)
+}
+
+// job returns a copy of a job
+func (m *Manager) job(id int) (Job, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	job := FindJob(id, m.jobs)
+	if job == nil {
+		return Job{}, ErrNotFound
+	}
+	return job.Copy(), nil
+}
+
+// checkJobOwner refuses users changing jobs they do not own
+func (m *Manager) checkJobOwner(r *http.Request, id int) error {
+	job, err := m.job(id)
+	if err != nil {
+		return err
+	}
+	if !CurrentUser(r).Owns(job.Owner) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// checkInstanceOwner refuses users reading the files of instances of jobs
+// they do not own
+func (m *Manager) checkInstanceOwner(r *http.Request, id int) error {
+	m.mu.RLock()
+	instance := FindInstance(id, m.jobs)
+	var owner string
+	if instance != nil {
+		owner = instance.Parent.Owner
+	}
+	m.mu.RUnlock()
+
+	if instance == nil {
+		return ErrNotFound
+	}
+	if !CurrentUser(r).Owns(owner) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+func (m *Manager) apiJob(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	job, err := m.job(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, job.API())
+}
+
+func (m *Manager) apiJobDelete(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := m.checkJobOwner(r, id); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := m.DeleteJob(id); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (m *Manager) apiJobInstances(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	job, err := m.job(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	instances := []api.Instance{}
+	for _, instance := range job.Instances {
+		instances = append(instances, instance.API())
+	}
+	writeJSON(w, http.StatusOK, instances)
+}
+
+func (m *Manager) apiJobCancel(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := m.checkJobOwner(r, id); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := m.CancelJob(id); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	job, err := m.job(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, job.API())
+}
+
+func (m *Manager) apiJobSpec(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	job, err := m.job(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	spec, contentType, err := job.ExportSpec()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	extension := "yaml"
+	if contentType == "application/json" {
+		extension = "json"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"job-%d.%s\"", id, extension))
+	w.Write(spec)
+}
+
+// apiJobScript renders the script instances of the job are run with on a
+// server
+func (m *Manager) apiJobScript(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	serverID, err := queryID(r, "server")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	m.mu.RLock()
+	job := FindJob(id, m.jobs)
+	server := FindServer(serverID, m.servers)
+	var script string
+	if job != nil && server != nil {
+		// Shown for the first GPU of the server
+		var resource *Resource
+		if len(server.Resources) > 0 {
+			resource = server.Resources[0]
+		}
+		script = runScript(server, job, resource)
+	}
+	m.mu.RUnlock()
+
+	if job == nil || server == nil {
+		writeError(w, ErrNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/x-shellscript; charset=utf-8")
+	w.Write([]byte(script))
+}
+
+// Instances
+
+func (m *Manager) apiInstance(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	m.mu.RLock()
+	instance := FindInstance(id, m.jobs)
+	var response api.Instance
+	if instance != nil {
+		response = instance.API()
+	}
+	m.mu.RUnlock()
+
+	if instance == nil {
+		writeError(w, ErrNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// apiInstanceLog sends the log of an instance, or its last lines, and can
+// follow it while the instance runs
+func (m *Manager) apiInstanceLog(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := m.checkInstanceOwner(r, id); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	lines, err := queryID(r, "lines")
+	if err == nil && lines < 0 {
+		err = &RequestError{http.StatusBadRequest, "Invalid lines"}
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	follow, err := queryBool(r, "follow")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	flusher := http.NewResponseController(w)
+	started := false
+	err = m.InstanceLog(r.Context(), id, lines, follow, func() {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		started = true
+	}, func(data []byte) error {
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		return flusher.Flush()
+	})
+
+	if err != nil {
+		if !started {
+			writeError(w, err)
+			return
+		}
+		log.Println("[API] Log of instance", id, "error:", err)
+	}
+}
+
+// apiInstanceResults sends the files of an instance as a gzipped tar archive
+func (m *Manager) apiInstanceResults(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := m.checkInstanceOwner(r, id); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	started := false
+	err = m.WriteResults(id, w, func() {
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"instance-%d.tar.gz\"", id))
+		started = true
+	})
+	if err != nil {
+		if !started {
+			writeError(w, err)
+			return
+		}
+		log.Println("[API] Results of instance", id, "error:", err)
+	}
+}
+
+// Archives
+
+func (m *Manager) apiArchives(w http.ResponseWriter, r *http.Request) {
+	m.mu.RLock()
+	archives := []api.Archive{}
+	for _, archive := range m.archives {
+		archives = append(archives, archive.API())
+	}
+	m.mu.RUnlock()
+
+	writeJSON(w, http.StatusOK, archives)
+}
+
+func (m *Manager) apiArchiveCreate(w http.ResponseWriter, r *http.Request) {
+	var request api.ArchiveRequest
+	if err := readJSON(r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	archive, err := m.CreateArchive(request)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	m.mu.RLock()
+	response := archive.API()
+	m.mu.RUnlock()
+
+	writeCreated(w, fmt.Sprintf("%s/archives/%d", api.Version, archive.ID), response)
+}
+
+// archive returns the API representation of an archive
+func (m *Manager) archive(id int) (api.Archive, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	archive := FindArchive(id, m.archives)
+	if archive == nil {
+		return api.Archive{}, ErrNotFound
+	}
+	return archive.API(), nil
+}
+
+func (m *Manager) apiArchive(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	archive, err := m.archive(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, archive)
+}
+
+func (m *Manager) apiArchiveUpdate(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var update api.ArchiveUpdate
+	if err := readJSON(r, &update); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := m.UpdateArchive(id, update); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if update.Enabled != nil {
+		if err := m.SetArchiveEnabled(id, *update.Enabled); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	archive, err := m.archive(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, archive)
+}
+
+func (m *Manager) apiArchiveDelete(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if _, err := m.archive(id); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := m.DeleteArchive(id); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Audit
+
+// auditFilter reads the filter of the audit log from the query string
+func auditFilter(r *http.Request, limit int) (api.AuditFilter, error) {
+	query := r.URL.Query()
+	filter := api.AuditFilter{Actor: query.Get("actor"), Action: query.Get("action"), Target: query.Get("target"), Limit: limit}
+
+	var err error
+	if filter.Since, err = queryTime(r, "since", time.Time{}); err != nil {
+		return filter, err
+	}
+	if filter.Until, err = queryTime(r, "until", time.Time{}); err != nil {
+		return filter, err
+	}
+
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return filter, &RequestError{http.StatusBadRequest, "Invalid limit"}
+		}
+		filter.Limit = n
+	}
+	return filter, nil
+}
+
+// apiAudit lists the newest entries of the audit log, 500 unless a limit is
+// given
+func (m *Manager) apiAudit(w http.ResponseWriter, r *http.Request) {
+	filter, err := auditFilter(r, 500)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	entries, err := AuditEntries(filter)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// apiAuditExport downloads every matching entry of the audit log
+func (m *Manager) apiAuditExport(w http.ResponseWriter, r *http.Request) {
+	filter, err := auditFilter(r, 0)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	entries, err := AuditEntries(filter)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"audit-%s.json\"", time.Now().Format("20060102-150405")))
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// Projects
+
+func (m *Manager) apiProjects(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, m.Projects())
+}
+
+func (m *Manager) apiProjectCreate(w http.ResponseWriter, r *http.Request) {
+	var request api.ProjectRequest
+	if err := readJSON(r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	project, err := m.CreateProject(request)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response, err := m.project(project.ID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeCreated(w, fmt.Sprintf("%s/projects/%d", api.Version, project.ID), response)
+}
+
+// project returns the API representation of a project
+func (m *Manager) project(id int) (api.Project, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	project := FindProjectByID(id, m.projects)
+	if project == nil {
+		return api.Project{}, ErrNotFound
+	}
+	return project.API(), nil
+}
+
+func (m *Manager) apiProject(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	project, err := m.project(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, project)
+}
+
+func (m *Manager) apiProjectUpdate(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var update api.ProjectUpdate
+	if err := readJSON(r, &update); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := m.UpdateProject(id, update); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	project, err := m.project(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, project)
+}
+
+func (m *Manager) apiProjectDelete(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := m.DeleteProject(id); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Users
+
+// apiLogin starts a session for the web pages and sets its cookie
+func (m *Manager) apiLogin(w http.ResponseWriter, r *http.Request) {
+	var request api.LoginRequest
+	if err := readJSON(r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	user, token, expires, err := Login(request.Username, request.Password)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: token, Path: "/", Expires: expires, HttpOnly: true, Secure: r.TLS != nil, SameSite: http.SameSiteLaxMode})
+	writeJSON(w, http.StatusOK, user.API())
+}
+
+func (m *Manager) apiLogout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		if err := Logout(cookie.Value); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (m *Manager) apiMe(w http.ResponseWriter, r *http.Request) {
+	user := CurrentUser(r)
+	writeJSON(w, http.StatusOK, user.API())
+}
+
+func (m *Manager) apiUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := LoadUsers()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := []api.User{}
+	for _, user := range users {
+		response = append(response, user.API())
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (m *Manager) apiUserCreate(w http.ResponseWriter, r *http.Request) {
+	var request api.UserRequest
+	if err := readJSON(r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	user, err := CreateUser(request.Name, request.Password, request.Role)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeCreated(w, fmt.Sprintf("%s/users/%d", api.Version, user.ID), user.API())
+}
+
+func (m *Manager) apiUserUpdate(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var update api.UserUpdate
+	if err := readJSON(r, &update); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// Users may change their own password, only admins anything else
+	current := CurrentUser(r)
+	if !current.Can(api.RoleAdmin) && (id != current.ID || update.Role != nil) {
+		writeError(w, ErrForbidden)
+		return
+	}
+
+	if update.Role != nil {
+		if err := SetRole(id, *update.Role); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	if update.Password != nil {
+		if err := SetPassword(id, *update.Password); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	user, err := FindUser(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, user.API())
+}
+
+func (m *Manager) apiUserDelete(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if id == CurrentUser(r).ID {
+		writeError(w, &RequestError{http.StatusBadRequest, "Unable to remove yourself"})
+		return
+	}
+
+	if err := DeleteUser(id); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Tokens
+
+func (m *Manager) apiTokens(w http.ResponseWriter, r *http.Request) {
+	tokens, err := Tokens(CurrentUser(r))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, tokens)
+}
+
+// apiTokenCreate returns the new token with its secret, which is not shown
+// again
+func (m *Manager) apiTokenCreate(w http.ResponseWriter, r *http.Request) {
+	var request api.TokenRequest
+	if err := readJSON(r, &request); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	token, err := CreateToken(CurrentUser(r), request.Name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeCreated(w, fmt.Sprintf("%s/tokens/%d", api.Version, token.ID), token)
+}
+
+func (m *Manager) apiTokenDelete(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := DeleteToken(CurrentUser(r), id); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,440 @@
+// Package api holds the request and response types of the GPUManager JSON
+// API served under /api/v1. They are shared by the server and by clients.
+package api
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Version is the path prefix of this version of the API
+const Version = "/api/v1"
+
+// States of a job instance
+const (
+	StateQueued    = "queued"
+	StateRunning   = "running"
+	StateCompleted = "completed"
+	StateFailed    = "failed"
+	StateCancelled = "cancelled"
+)
+
+// Error is the body of every response with a 4xx or 5xx status
+type Error struct {
+	Error string `json:"error"`
+}
+
+// Server is a compute server and the GPUs found on it. Draining is set while
+// an admin is draining it, and Maintenance is its progress towards
+// maintenance, if it is draining or a maintenance window is near.
+type Server struct {
+	ID                 int                 `json:"id"`
+	URL                string              `json:"url"`
+	WorkingDirectory   string              `json:"wdir"`
+	Username           string              `json:"username"`
+	Setup              string              `json:"setup"`
+	Env                map[string]string   `json:"env,omitempty"`
+	Enabled            bool                `json:"enabled"`
+	Draining           bool                `json:"draining"`
+	Maintenance        string              `json:"maintenance,omitempty"`
+	MaintenanceWindows []MaintenanceWindow `json:"maintenance_windows"`
+	InUse              int                 `json:"inuse"`
+	Resources          []Resource          `json:"resources"`
+	Health             string              `json:"health"`
+	HealthError        string              `json:"health_error,omitempty"`
+	Probe              *Probe              `json:"probe,omitempty"`
+}
+
+// Probe reports whether a server has what instances need. A server is
+// probed when it is added, and again when an admin asks.
+type Probe struct {
+	Time   time.Time    `json:"time"`
+	Passed bool         `json:"passed"`
+	Checks []ProbeCheck `json:"checks"`
+}
+
+// ProbeCheck is the outcome of one check of a probe. Value is what was
+// found, such as a path or a version, and Error why the check failed. An
+// optional check that fails does not fail the probe.
+type ProbeCheck struct {
+	Name     string `json:"name"`
+	Passed   bool   `json:"passed"`
+	Optional bool   `json:"optional,omitempty"`
+	Value    string `json:"value,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Checks made by a probe
+const (
+	ProbeWorkingDirectory = "working_directory"
+	ProbeContainers       = "container_runtime"
+	ProbeProtoMol         = "protomol"
+	ProbePython           = "python"
+	ProbeCUDADriver       = "cuda_driver"
+	ProbeDiskSpace        = "disk_space"
+	ProbeProc             = "proc"
+)
+
+// ProbeFailure is returned when a server is refused because it failed its
+// probe
+type ProbeFailure struct {
+	Error string `json:"error"`
+	Probe Probe  `json:"probe"`
+}
+
+// Progress of a server towards maintenance. A draining server finishes its
+// running instances but starts no new ones, and is ready once none are left.
+const (
+	MaintenanceDraining = "draining"
+	MaintenanceReady    = "ready"
+)
+
+// MaintenanceWindow is a time a server is taken down for maintenance. The
+// server drains ahead of it.
+type MaintenanceWindow struct {
+	ID       int       `json:"id"`
+	ServerID int       `json:"server_id"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// MaintenanceRequest schedules a maintenance window
+type MaintenanceRequest struct {
+	ServerID int       `json:"server_id"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// Health of a server, as last checked over SSH
+const (
+	HealthUnknown     = "unknown"
+	HealthOK          = "ok"
+	HealthUnreachable = "unreachable"
+)
+
+// ServerRequest adds a server. Its GPUs are discovered with nvidia-smi.
+// Setup is run at the start of every instance, before Env is exported, and
+// defaults to sourcing ~/.bash_profile.
+type ServerRequest struct {
+	URL              string            `json:"url"`
+	WorkingDirectory string            `json:"wdir"`
+	Username         string            `json:"username"`
+	Password         string            `json:"password"`
+	Setup            *string           `json:"setup,omitempty"`
+	Env              map[string]string `json:"env,omitempty"`
+}
+
+// ServerUpdate changes the fields of a server that are set. New connection
+// settings are checked by connecting with them before they are saved.
+type ServerUpdate struct {
+	URL              *string `json:"url,omitempty"`
+	WorkingDirectory *string `json:"wdir,omitempty"`
+	Username         *string `json:"username,omitempty"`
+	Password         *string `json:"password,omitempty"`
+	Enabled          *bool   `json:"enabled,omitempty"`
+	Draining         *bool   `json:"draining,omitempty"`
+	Setup            *string `json:"setup,omitempty"`
+
+	// Env replaces the environment variables of the server unless it is
+	// null. An empty map clears them.
+	Env map[string]string `json:"env"`
+}
+
+// Resource is a single GPU. External says why it is occupied by someone
+// else, if it is, and Telemetry is its latest sample, if one has been
+// collected since the manager started. Retired is when a rescan found the
+// GPU gone from its server; retired GPUs are kept for the instances that ran
+// on them but are no longer listed.
+type Resource struct {
+	UUID      string     `json:"uuid"`
+	Name      string     `json:"name"`
+	DeviceID  int        `json:"device"`
+	ServerID  int        `json:"server_id"`
+	Enabled   bool       `json:"enabled"`
+	InUse     bool       `json:"inuse"`
+	External  string     `json:"external,omitempty"`
+	Retired   *time.Time `json:"retired,omitempty"`
+	Telemetry *Telemetry `json:"telemetry,omitempty"`
+}
+
+// ResourceUpdate changes the fields of a GPU that are set. A disabled GPU
+// finishes what it is running but is given no new instances.
+type ResourceUpdate struct {
+	Enabled *bool `json:"enabled,omitempty"`
+}
+
+// Rescan reports what changed when the GPUs of a server were discovered
+// again. Added includes GPUs that had been retired and are back.
+type Rescan struct {
+	Server     Server         `json:"server"`
+	Added      []Resource     `json:"added"`
+	Retired    []Resource     `json:"retired"`
+	Renumbered []DeviceChange `json:"renumbered"`
+	Output     string         `json:"output"`
+}
+
+// DeviceChange is a GPU whose nvidia-smi index has changed
+type DeviceChange struct {
+	UUID string `json:"uuid"`
+	Name string `json:"name"`
+	From int    `json:"from"`
+	To   int    `json:"to"`
+}
+
+// Telemetry is a sample of what nvidia-smi reports for a GPU. Values the GPU
+// does not report are -1.
+type Telemetry struct {
+	UUID        string    `json:"uuid"`
+	Time        time.Time `json:"time"`
+	Utilization int       `json:"utilization"`  // percent
+	MemoryUsed  int       `json:"memory_used"`  // MiB
+	MemoryTotal int       `json:"memory_total"` // MiB
+	Temperature int       `json:"temperature"`  // degrees Celsius
+	Power       float64   `json:"power"`        // watts
+	ECCErrors   int       `json:"ecc_errors"`   // uncorrected since the driver loaded
+}
+
+// Model is a set of input files for a simulation
+type Model struct {
+	ID       int      `json:"id"`
+	Name     string   `json:"name"`
+	Revision int      `json:"revision"`
+	Owner    string   `json:"owner"`
+	Project  string   `json:"project,omitempty"`
+	Files    []string `json:"files"`
+}
+
+// Template is the configuration a simulation is run with
+type Template struct {
+	ID         int    `json:"id"`
+	Name       string `json:"name"`
+	Revision   int    `json:"revision"`
+	Owner      string `json:"owner"`
+	Project    string `json:"project,omitempty"`
+	File       string `json:"file"`
+	Executable string `json:"executable"`
+	Container  string `json:"container,omitempty"`
+}
+
+// Job is a number of instances of a model run with a template
+type Job struct {
+	ID               int    `json:"id"`
+	Name             string `json:"name"`
+	Owner            string `json:"owner"`
+	Project          string `json:"project,omitempty"`
+	ModelID          int    `json:"model_id"`
+	Model            string `json:"model"`
+	ModelRevision    int    `json:"model_revision"`
+	TemplateID       int    `json:"template_id"`
+	Template         string `json:"template"`
+	TemplateRevision int    `json:"template_revision"`
+	Count            int    `json:"count"`
+	Queued           int    `json:"queued"`
+	Running          int    `json:"running"`
+	Completed        int    `json:"completed"`
+	Failed           int    `json:"failed"`
+	Cancelled        int    `json:"cancelled"`
+}
+
+// JobRequest creates a job and queues its instances. The project is
+// required once there are projects, but may be left out by users who belong
+// to only one.
+type JobRequest struct {
+	Name       string `json:"name"`
+	Project    string `json:"project,omitempty"`
+	ModelID    int    `json:"model_id"`
+	TemplateID int    `json:"template_id"`
+	Count      int    `json:"count"`
+}
+
+// Instance is a single run of a job
+type Instance struct {
+	ID       int    `json:"id"`
+	JobID    int    `json:"job_id"`
+	Number   int    `json:"number"`
+	State    string `json:"state"`
+	PID      int    `json:"pid"`
+	Resource string `json:"resource,omitempty"`
+	ServerID int    `json:"server_id,omitempty"`
+	Archived bool   `json:"archived"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error,omitempty"`
+
+	// ImageDigest identifies the container image the instance last ran in
+	ImageDigest string `json:"image_digest,omitempty"`
+}
+
+// Types of the events published on the event stream. The data of an event
+// is the new state of what it names, or what was removed for the
+// ".removed" and ".retired" types.
+const (
+	EventInstance        = "instance"
+	EventJob             = "job"
+	EventJobRemoved      = "job.removed"
+	EventResource        = "resource"
+	EventResourceRetired = "resource.retired"
+	EventServer          = "server"
+	EventServerRemoved   = "server.removed"
+	EventArchive         = "archive"
+)
+
+// Event is a change published on the event stream. JobID and ServerID are
+// what subscribers filter on, and are zero if the event concerns no job or
+// no server. Data is an Instance, Job, Resource, Server or ArchiveProgress
+// depending on the type.
+type Event struct {
+	ID       int64           `json:"id"`
+	Type     string          `json:"type"`
+	JobID    int             `json:"job_id,omitempty"`
+	ServerID int             `json:"server_id,omitempty"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// ArchiveProgress reports the copy of the results of an instance to an
+// archive, once per file
+type ArchiveProgress struct {
+	JobID      int    `json:"job_id"`
+	InstanceID int    `json:"instance_id"`
+	Archive    string `json:"archive"`
+	File       string `json:"file"`
+	Copied     int    `json:"copied"`
+	Files      int    `json:"files"`
+}
+
+// Archive is a server that results are copied to
+type Archive struct {
+	ID               int    `json:"id"`
+	URL              string `json:"url"`
+	WorkingDirectory string `json:"wdir"`
+	Username         string `json:"username"`
+	Enabled          bool   `json:"enabled"`
+	SpaceUsed        uint64 `json:"spaceused"`
+	SpaceTotal       uint64 `json:"spacetotal"`
+}
+
+// ArchiveRequest adds an archive. The working directory is created if it
+// does not exist.
+type ArchiveRequest struct {
+	URL              string `json:"url"`
+	WorkingDirectory string `json:"wdir"`
+	Username         string `json:"username"`
+	Password         string `json:"password"`
+}
+
+// ArchiveUpdate changes the fields of an archive that are set. New
+// connection settings are checked by connecting with them before they are
+// saved, and a new working directory is created if it does not exist.
+type ArchiveUpdate struct {
+	URL              *string `json:"url,omitempty"`
+	WorkingDirectory *string `json:"wdir,omitempty"`
+	Username         *string `json:"username,omitempty"`
+	Password         *string `json:"password,omitempty"`
+	Enabled          *bool   `json:"enabled,omitempty"`
+}
+
+// Project is a research group that owns jobs, models and templates, with
+// its limits and its usage. A limit of zero means no limit.
+type Project struct {
+	ID           int      `json:"id"`
+	Name         string   `json:"name"`
+	Members      []string `json:"members"`
+	MaxGPUs      int      `json:"max_gpus"`
+	MaxGPUHours  float64  `json:"max_gpu_hours"`
+	MaxInstances int      `json:"max_instances"`
+	GPUsInUse    int      `json:"gpus_in_use"`
+	GPUHoursUsed float64  `json:"gpu_hours_used"`
+}
+
+// ProjectRequest adds a project
+type ProjectRequest struct {
+	Name         string   `json:"name"`
+	Members      []string `json:"members,omitempty"`
+	MaxGPUs      int      `json:"max_gpus,omitempty"`
+	MaxGPUHours  float64  `json:"max_gpu_hours,omitempty"`
+	MaxInstances int      `json:"max_instances,omitempty"`
+}
+
+// ProjectUpdate changes the fields of a project that are set. Members
+// replaces the whole list.
+type ProjectUpdate struct {
+	Members      *[]string `json:"members,omitempty"`
+	MaxGPUs      *int      `json:"max_gpus,omitempty"`
+	MaxGPUHours  *float64  `json:"max_gpu_hours,omitempty"`
+	MaxInstances *int      `json:"max_instances,omitempty"`
+}
+
+// Roles of users, from most to least privileged
+const (
+	RoleAdmin  = "admin"
+	RoleUser   = "user"
+	RoleViewer = "viewer"
+)
+
+// User is a local account
+type User struct {
+	ID      int       `json:"id"`
+	Name    string    `json:"name"`
+	Role    string    `json:"role"`
+	Created time.Time `json:"created"`
+}
+
+// UserRequest adds a user. The role defaults to user.
+type UserRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	Role     string `json:"role,omitempty"`
+}
+
+// UserUpdate changes the fields of a user that are set. Only admins can
+// change roles.
+type UserUpdate struct {
+	Password *string `json:"password,omitempty"`
+	Role     *string `json:"role,omitempty"`
+}
+
+// LoginRequest starts a session for the web pages
+type LoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Token is a personal API token. Its secret is only shown when it is
+// created.
+type Token struct {
+	ID       int        `json:"id"`
+	Name     string     `json:"name"`
+	Created  time.Time  `json:"created"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+	Secret   string     `json:"secret,omitempty"`
+}
+
+// TokenRequest creates a personal API token for the current user
+type TokenRequest struct {
+	Name string `json:"name"`
+}
+
+// AuditEntry records who did what to which target, and how it turned out.
+// Entries made by the scheduler have the actor "scheduler" and no status.
+type AuditEntry struct {
+	ID         int             `json:"id"`
+	Time       time.Time       `json:"time"`
+	Actor      string          `json:"actor"`
+	Action     string          `json:"action"`
+	Target     string          `json:"target"`
+	Parameters json.RawMessage `json:"parameters,omitempty"`
+	Status     int             `json:"status,omitempty"`
+	Outcome    string          `json:"outcome"`
+}
+
+// AuditFilter selects audit entries. Action matches any part of the action
+// and Target the start of the target. Zero fields match everything.
+type AuditFilter struct {
+	Actor  string
+	Action string
+	Target string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
@@ -0,0 +1,136 @@
+package api
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"gopkg.in/yaml.v3"
+)
+
+// JobSpecSchema is the JSON Schema every job specification is validated
+// against
+//
+//go:embed jobspec.schema.json
+var JobSpecSchema []byte
+
+var jobSpecSchema = jsonschema.MustCompileString("jobspec.schema.json", string(JobSpecSchema))
+
+// JobSpec is the declarative description of a job. It is written as YAML
+// or JSON and stored verbatim with the job it creates.
+type JobSpec struct {
+	Name        string                 `json:"name" yaml:"name"`
+	Project     string                 `json:"project,omitempty" yaml:"project,omitempty"`
+	Model       Ref                    `json:"model" yaml:"model"`
+	Template    Ref                    `json:"template" yaml:"template"`
+	Count       int                    `json:"count" yaml:"count"`
+	Parameters  map[string]interface{} `json:"parameters,omitempty" yaml:"parameters,omitempty"`
+	Constraints Constraints            `json:"constraints,omitempty" yaml:"constraints,omitempty"`
+	Retry       Retry                  `json:"retry,omitempty" yaml:"retry,omitempty"`
+	Archives    []string               `json:"archives,omitempty" yaml:"archives,omitempty"`
+	Post        []string               `json:"post,omitempty" yaml:"post,omitempty"`
+	Setup       []string               `json:"setup,omitempty" yaml:"setup,omitempty"`
+	Env         map[string]string      `json:"env,omitempty" yaml:"env,omitempty"`
+	Container   string                 `json:"container,omitempty" yaml:"container,omitempty"`
+
+	// RemapDevices limits the instance to its GPU with CUDA_VISIBLE_DEVICES
+	// and gives templates its index as the instance sees it, 0. When false
+	// CUDA_VISIBLE_DEVICES lists every GPU of the server in the order of their
+	// indexes there, and templates are given the index of its GPU there. It is
+	// on unless set to false.
+	RemapDevices *bool `json:"remap_devices,omitempty" yaml:"remap_devices,omitempty"`
+}
+
+// Ref names a model or template. A zero Revision means the latest.
+type Ref struct {
+	Name     string `json:"name" yaml:"name"`
+	Revision int    `json:"revision,omitempty" yaml:"revision,omitempty"`
+}
+
+// UnmarshalJSON also accepts a plain name
+func (r *Ref) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*r = Ref{Name: name}
+		return nil
+	}
+
+	type ref Ref
+	return json.Unmarshal(data, (*ref)(r))
+}
+
+func (r Ref) String() string {
+	if r.Revision == 0 {
+		return r.Name
+	}
+	return fmt.Sprintf("%s revision %d", r.Name, r.Revision)
+}
+
+// Constraints limit the resources the instances of a job run on
+type Constraints struct {
+	GPU     string   `json:"gpu,omitempty" yaml:"gpu,omitempty"`
+	Servers []string `json:"servers,omitempty" yaml:"servers,omitempty"`
+}
+
+// Retry overrides how failed instances are retried
+type Retry struct {
+	Attempts int `json:"attempts,omitempty" yaml:"attempts,omitempty"`
+}
+
+// ParseJobSpec reads a YAML or JSON job specification and validates it
+// against JobSpecSchema
+func ParseJobSpec(data []byte) (JobSpec, error) {
+	var spec JobSpec
+
+	var document interface{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return spec, err
+	}
+
+	// Round trip through JSON so the validator sees JSON types
+	encoded, err := json.Marshal(document)
+	if err != nil {
+		return spec, err
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(encoded, &value); err != nil {
+		return spec, err
+	}
+
+	if err := jobSpecSchema.Validate(value); err != nil {
+		if ve, ok := err.(*jsonschema.ValidationError); ok {
+			return spec, errors.New(strings.Join(validationErrors(ve), "; "))
+		}
+		return spec, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&spec); err != nil {
+		return spec, err
+	}
+	return spec, nil
+}
+
+// validationErrors lists the individual failures that caused a validation
+// error, each prefixed by where in the document it is
+func validationErrors(ve *jsonschema.ValidationError) []string {
+	if len(ve.Causes) == 0 {
+		location := ve.InstanceLocation
+		if location == "" {
+			location = "/"
+		}
+		return []string{location + ": " + ve.Message}
+	}
+
+	var messages []string
+	for _, cause := range ve.Causes {
+		messages = append(messages, validationErrors(cause)...)
+	}
+	return messages
+}
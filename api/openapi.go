@@ -0,0 +1,10 @@
+package api
+
+import _ "embed"
+
+// OpenAPI is the OpenAPI 3 description of this version of the API. It must
+// be kept in step with the types in this package, and with the routes of
+// the server, which the server's tests check.
+//
+//go:embed openapi.json
+var OpenAPI []byte
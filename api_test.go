@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/LCLS/GPUManager/api"
+)
+
+// routeRoles restates the least role of each route in Routes, so that a
+// change to the permissions has to be made in both places
+var routeRoles = map[string]string{
+	"GET /servers":                    api.RoleViewer,
+	"POST /servers":                   api.RoleAdmin,
+	"GET /servers/{id}":               api.RoleViewer,
+	"PATCH /servers/{id}":             api.RoleAdmin,
+	"DELETE /servers/{id}":            api.RoleAdmin,
+	"GET /servers/{id}/resources":     api.RoleViewer,
+	"POST /servers/{id}/rescan":       api.RoleAdmin,
+	"POST /servers/{id}/probe":        api.RoleAdmin,
+	"GET /maintenance":                api.RoleViewer,
+	"POST /maintenance":               api.RoleAdmin,
+	"GET /maintenance/{id}":           api.RoleViewer,
+	"DELETE /maintenance/{id}":        api.RoleAdmin,
+	"GET /resources":                  api.RoleViewer,
+	"GET /resources/{uuid}":           api.RoleViewer,
+	"PATCH /resources/{uuid}":         api.RoleAdmin,
+	"GET /resources/{uuid}/telemetry": api.RoleViewer,
+	"GET /models":                     api.RoleViewer,
+	"POST /models":                    api.RoleUser,
+	"GET /models/{id}":                api.RoleViewer,
+	"DELETE /models/{id}":             api.RoleUser,
+	"GET /templates":                  api.RoleViewer,
+	"POST /templates":                 api.RoleUser,
+	"GET /templates/{id}":             api.RoleViewer,
+	"DELETE /templates/{id}":          api.RoleUser,
+	"GET /jobs":                       api.RoleViewer,
+	"POST /jobs":                      api.RoleUser,
+	"POST /jobs/spec":                 api.RoleUser,
+	"GET /jobs/{id}":                  api.RoleViewer,
+	"DELETE /jobs/{id}":               api.RoleUser,
+	"GET /jobs/{id}/instances":        api.RoleViewer,
+	"POST /jobs/{id}/cancel":          api.RoleUser,
+	"GET /jobs/{id}/spec":             api.RoleUser,
+	"GET /jobs/{id}/script":           api.RoleUser,
+	"GET /instances/{id}":             api.RoleViewer,
+	"GET /instances/{id}/log":         api.RoleUser,
+	"GET /instances/{id}/results":     api.RoleUser,
+	"GET /archives":                   api.RoleViewer,
+	"POST /archives":                  api.RoleAdmin,
+	"GET /archives/{id}":              api.RoleViewer,
+	"PATCH /archives/{id}":            api.RoleAdmin,
+	"DELETE /archives/{id}":           api.RoleAdmin,
+	"GET /events":                     api.RoleViewer,
+	"GET /audit":                      api.RoleAdmin,
+	"GET /audit/export":               api.RoleAdmin,
+	"GET /projects":                   api.RoleViewer,
+	"POST /projects":                  api.RoleAdmin,
+	"GET /projects/{id}":              api.RoleViewer,
+	"PATCH /projects/{id}":            api.RoleAdmin,
+	"DELETE /projects/{id}":           api.RoleAdmin,
+	"POST /login":                     "",
+	"POST /logout":                    api.RoleViewer,
+	"GET /me":                         api.RoleViewer,
+	"GET /users":                      api.RoleAdmin,
+	"POST /users":                     api.RoleAdmin,
+	"PATCH /users/{id}":               api.RoleViewer,
+	"DELETE /users/{id}":              api.RoleAdmin,
+	"GET /tokens":                     api.RoleViewer,
+	"POST /tokens":                    api.RoleViewer,
+	"DELETE /tokens/{id}":             api.RoleViewer,
+	"GET /openapi.json":               api.RoleViewer,
+	"GET /jobspec.schema.json":        api.RoleViewer,
+}
+
+// testUsers creates users by name with the given roles, and returns an API
+// token for each
+func testUsers(t *testing.T, roles map[string]string) (map[string]User, map[string]string) {
+	t.Helper()
+
+	users, tokens := map[string]User{}, map[string]string{}
+	for name, role := range roles {
+		user, err := CreateUser(name, "password", role)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := CreateToken(user, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		users[name], tokens[name] = user, token.Secret
+	}
+	return users, tokens
+}
+
+// apiCall makes a request of the API as the holder of token
+func apiCall(handler http.Handler, method, path, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, api.Version+path, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+// TestOpenAPIRoutes checks that the OpenAPI description has an operation for
+// every route and no others
+func TestOpenAPIRoutes(t *testing.T) {
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(api.OpenAPI, &spec); err != nil {
+		t.Fatal(err)
+	}
+
+	described := map[string]bool{}
+	for path, operations := range spec.Paths {
+		for method := range operations {
+			switch method {
+			case "get", "put", "post", "patch", "delete":
+				described[strings.ToUpper(method)+" "+path] = true
+			}
+		}
+	}
+
+	routes := map[string]bool{}
+	for _, route := range NewManager().Routes() {
+		routes[route.Pattern] = true
+		if !described[route.Pattern] {
+			t.Errorf("%s is not described", route.Pattern)
+		}
+	}
+	for operation := range described {
+		if !routes[operation] {
+			t.Errorf("%s is described but not routed", operation)
+		}
+	}
+}
+
+// TestRoutePermissions requests every route as a viewer, a user and an
+// admin. Allowed requests reach a stand-in for the handler, so that only
+// the permissions are tested, and refused ones the real API.
+func TestRoutePermissions(t *testing.T) {
+	newTestDB(t)
+	m := NewManager()
+	_, tokens := testUsers(t, map[string]string{api.RoleViewer: api.RoleViewer, api.RoleUser: api.RoleUser, api.RoleAdmin: api.RoleAdmin})
+
+	routes := m.Routes()
+	if len(routes) != len(routeRoles) {
+		t.Errorf("%d routes, but %d in the table", len(routes), len(routeRoles))
+	}
+
+	registered := http.NewServeMux()
+	m.RegisterAPI(registered)
+
+	stub := http.NewServeMux()
+	for _, route := range routes {
+		method, path, _ := strings.Cut(route.Pattern, " ")
+		stub.HandleFunc(method+" "+api.Version+path, Require(route.Role, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}))
+	}
+
+	paths := strings.NewReplacer("{id}", "1", "{uuid}", "GPU-1")
+	for _, route := range routes {
+		expected, ok := routeRoles[route.Pattern]
+		if !ok {
+			t.Errorf("%s is not in the table", route.Pattern)
+			continue
+		}
+		if route.Role != expected {
+			t.Errorf("%s needs role %s, expected %s", route.Pattern, route.Role, expected)
+		}
+
+		method, path, _ := strings.Cut(route.Pattern, " ")
+		path = paths.Replace(path)
+		for _, role := range []string{api.RoleViewer, api.RoleUser, api.RoleAdmin} {
+			allowed := roleRank[role] >= roleRank[expected]
+
+			handler, status := RequireLogin(registered), http.StatusForbidden
+			if allowed {
+				handler, status = RequireLogin(stub), http.StatusNoContent
+			}
+			if w := apiCall(handler, method, path, tokens[role], ""); w.Code != status {
+				t.Errorf("%s as %s: expected %d, got %d", route.Pattern, role, status, w.Code)
+			}
+		}
+	}
+}
+
+// TestOwnership checks that users may only change, and read the files of,
+// what they own, while admins may for anything
+func TestOwnership(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{name: "delete model", method: "DELETE", path: "/models/2", status: http.StatusNoContent},
+		{name: "delete template", method: "DELETE", path: "/templates/2", status: http.StatusNoContent},
+		{name: "cancel job", method: "POST", path: "/jobs/1/cancel", status: http.StatusOK},
+		{name: "delete job", method: "DELETE", path: "/jobs/1", status: http.StatusNoContent},
+		{name: "instance log", method: "GET", path: "/instances/1000/log", status: http.StatusOK},
+		{name: "instance results", method: "GET", path: "/instances/1000/results", status: http.StatusOK},
+		{name: "change password", method: "PATCH", path: "/users/{owner}", body: `{"password": "changed"}`, status: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		for _, as := range []string{"owner", "other", "viewer", "admin"} {
+			t.Run(test.name+" as "+as, func(t *testing.T) {
+				f := newTestFarm(t)
+				users, tokens := testUsers(t, map[string]string{"owner": api.RoleUser, "other": api.RoleUser, "viewer": api.RoleViewer, "admin": api.RoleAdmin})
+
+				if _, err := DB.Exec("insert into model(id, name, owner) values (2, 'unused', 'owner')"); err != nil {
+					t.Fatal(err)
+				}
+				f.m.AddModel(Model{ID: 2, Name: "unused", Revision: 1, Owner: "owner"})
+				if _, err := DB.Exec("insert into template(id, name, file, owner) values (2, 'unused', 'data/unused.py', 'owner')"); err != nil {
+					t.Fatal(err)
+				}
+				f.m.AddTemplate(Template{ID: 2, Name: "unused", Revision: 1, Owner: "owner", File: "data/unused.py"})
+
+				// The instance has run on the server, where its files are
+				job := f.addJob(t, "owned", "echo done", 1)
+				instance := job.Instances[0]
+				f.m.mu.Lock()
+				job.Owner = "owner"
+				instance.Resource = f.resource
+				f.m.mu.Unlock()
+				directory := filepath.Join(f.server.WorkingDirectory, "job", instance.Directory())
+				if err := os.MkdirAll(directory, 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(directory, "log.txt"), []byte("done\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+
+				mux := http.NewServeMux()
+				f.m.RegisterAPI(mux)
+
+				status := test.status
+				if as == "other" || as == "viewer" {
+					status = http.StatusForbidden
+				}
+				path := strings.Replace(test.path, "{owner}", strconv.Itoa(users["owner"].ID), 1)
+				if w := apiCall(RequireLogin(mux), test.method, path, tokens[as], test.body); w.Code != status {
+					t.Errorf("expected %d, got %d: %s", status, w.Code, w.Body)
+				}
+			})
+		}
+	}
+}
+
+// TestRolesMigration checks that upgrading keeps only the first account as
+// an admin
+func TestRolesMigration(t *testing.T) {
+	migrations := testMigrations(t)
+	split := len(migrations)
+	for i, migration := range migrations {
+		if strings.HasSuffix(migration, "_Roles.sql") {
+			split = i
+		}
+	}
+	if split == len(migrations) {
+		t.Fatal("no roles migration")
+	}
+
+	db := openTestDB(t)
+	migrate(t, db, migrations[:split])
+	for _, name := range []string{"admin", "alice", "bob"} {
+		if _, err := db.Exec("insert into user(name, password) values (?, 'hash')", name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	migrate(t, db, migrations[split:])
+
+	expected := map[string]string{"admin": api.RoleAdmin, "alice": api.RoleUser, "bob": api.RoleUser}
+	for name, role := range expected {
+		user, err := FindUserByName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Role != role {
+			t.Errorf("%s has role %s, expected %s", name, user.Role, role)
+		}
+	}
+}
+
+// TestServerUpdateInvalid checks that no part of an update to a server is
+// applied when any of it is invalid, or when the server cannot be reached
+// with its new settings
+func TestServerUpdateInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{name: "environment", body: `{"enabled": false, "draining": true, "setup": "module load cuda", "env": {"OMP THREADS": "4"}}`, status: http.StatusBadRequest},
+		{name: "credentials", body: `{"enabled": false, "draining": true, "setup": "module load cuda", "username": ""}`, status: http.StatusBadRequest},
+		{name: "connection", body: `{"enabled": false, "draining": true, "setup": "module load cuda", "username": "user", "password": "secret"}`, status: http.StatusBadGateway},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newTestFarm(t)
+			_, tokens := testUsers(t, map[string]string{"admin": api.RoleAdmin})
+			if _, err := DB.Exec("insert into server(id, url, wdir, username, password, enabled) values (1, '127.0.0.1', ?, 'user', 'password', 1)", f.server.WorkingDirectory); err != nil {
+				t.Fatal(err)
+			}
+
+			mux := http.NewServeMux()
+			f.m.RegisterAPI(mux)
+			if w := apiCall(RequireLogin(mux), "PATCH", "/servers/1", tokens["admin"], test.body); w.Code != test.status {
+				t.Fatalf("expected %d, got %d: %s", test.status, w.Code, w.Body)
+			}
+
+			f.m.mu.RLock()
+			defer f.m.mu.RUnlock()
+			if !f.server.Enabled || f.server.Draining || f.server.Setup != "" {
+				t.Errorf("server changed: enabled %t, draining %t, setup %q", f.server.Enabled, f.server.Draining, f.server.Setup)
+			}
+
+			var enabled, draining bool
+			var password string
+			if err := DB.QueryRow("SELECT enabled, draining, password FROM server WHERE id = 1").Scan(&enabled, &draining, &password); err != nil {
+				t.Fatal(err)
+			}
+			if !enabled || draining || password != "password" {
+				t.Errorf("server saved with enabled %t, draining %t, password %q", enabled, draining, password)
+			}
+		})
+	}
+}
+
+// TestServerUpdate checks that every part of an update to a server is saved
+func TestServerUpdate(t *testing.T) {
+	f := newTestFarm(t)
+	_, tokens := testUsers(t, map[string]string{"admin": api.RoleAdmin})
+	if _, err := DB.Exec("insert into server(id, url, wdir, username, password, enabled) values (1, '127.0.0.1', ?, 'user', 'password', 1)", f.server.WorkingDirectory); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	f.m.RegisterAPI(mux)
+	body := `{"enabled": false, "draining": true, "setup": "module load cuda", "env": {"OMP_NUM_THREADS": "4"}}`
+	if w := apiCall(RequireLogin(mux), "PATCH", "/servers/1", tokens["admin"], body); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+
+	f.m.mu.RLock()
+	if f.server.Enabled || !f.server.Draining || f.server.Setup != "module load cuda" || f.server.Env["OMP_NUM_THREADS"] != "4" {
+		t.Errorf("server not changed: enabled %t, draining %t, setup %q, env %v", f.server.Enabled, f.server.Draining, f.server.Setup, f.server.Env)
+	}
+	f.m.mu.RUnlock()
+
+	var enabled, draining bool
+	var setup, env string
+	if err := DB.QueryRow("SELECT enabled, draining, setup, env FROM server WHERE id = 1").Scan(&enabled, &draining, &setup, &env); err != nil {
+		t.Fatal(err)
+	}
+	if enabled || !draining || setup != "module load cuda" || env != `{"OMP_NUM_THREADS":"4"}` {
+		t.Errorf("server saved with enabled %t, draining %t, setup %q, env %s", enabled, draining, setup, env)
+	}
+}
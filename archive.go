@@ -4,18 +4,20 @@ import (
 	"bufio"
 	"bytes"
 	"database/sql"
-	"encoding/json"
 	"fmt"
-	"html/template"
 	"log"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/LCLS/GPUManager/api"
 	"golang.org/x/crypto/ssh"
 )
 
+// Archive is a server results are copied to. Its connection settings are
+// guarded by both the manager lock and clientMu, which is taken second.
 type Archive struct {
 	ID                    int
 	URL, WorkingDirectory string
@@ -23,10 +25,17 @@ type Archive struct {
 	Enabled               bool
 	SpaceUsed, SpaceTotal uint64
 
-	Client *ssh.Client
+	clientMu sync.Mutex
+	Client   *ssh.Client
 }
 
 func (a *Archive) Connect() error {
+	a.clientMu.Lock()
+	defer a.clientMu.Unlock()
+	return a.connect()
+}
+
+func (a *Archive) connect() error {
 	config := &ssh.ClientConfig{
 		User: a.Username,
 		Auth: []ssh.AuthMethod{
@@ -42,26 +51,45 @@ func (a *Archive) Connect() error {
 }
 
 func (a *Archive) Disconnect() {
-	a.Client.Close()
+	a.clientMu.Lock()
+	defer a.clientMu.Unlock()
+
+	if a.Client != nil {
+		a.Client.Close()
+	}
 	a.Client = nil
 }
 
-func (a *Archive) StringUsedTotal() string {
-	total := a.SpaceTotal
-	if a.SpaceTotal > (1024 * 1024 * 1024) {
-		return fmt.Sprintf("%.2d TB / %.2d TB", a.SpaceUsed/(1024*1024*1024), total/(1024*1024*1024))
-	} else if total > (1024 * 1024) {
-		return fmt.Sprintf("%.2d GB / %.2d GB", a.SpaceUsed/(1024*1024), total/(1024*1024))
-	} else if total > 1024 {
-		return fmt.Sprintf("%.2d MB / %.2d MB", a.SpaceUsed/1024, total/1024)
+// SSH returns the open connection to the archive, dialing it if necessary
+func (a *Archive) SSH() (*ssh.Client, error) {
+	a.clientMu.Lock()
+	defer a.clientMu.Unlock()
+
+	if a.Client == nil {
+		if err := a.connect(); err != nil {
+			return nil, err
+		}
 	}
-	return fmt.Sprintf("%.2d kB / %.2d kB", a.SpaceUsed, total)
+	return a.Client, nil
+}
+
+// API returns the representation of the archive used by the JSON API. It
+// must be called with the manager lock held.
+func (a *Archive) API() api.Archive {
+	return api.Archive{ID: a.ID, URL: a.URL, WorkingDirectory: a.WorkingDirectory, Username: a.Username, Enabled: a.Enabled, SpaceUsed: a.SpaceUsed, SpaceTotal: a.SpaceTotal}
 }
 
-var Archives []Archive
+func FindArchive(id int, archives []*Archive) *Archive {
+	for i := 0; i < len(archives); i++ {
+		if archives[i].ID == id {
+			return archives[i]
+		}
+	}
+	return nil
+}
 
-func LoadArchives(db *sql.DB) ([]Archive, error) {
-	var archives []Archive
+func LoadArchives(db *sql.DB) ([]*Archive, error) {
+	var archives []*Archive
 
 	// Load Servers
 	rows, err := db.Query("SELECT id, url, wdir, username, password, used, total, enabled FROM archive")
@@ -78,95 +106,83 @@ func LoadArchives(db *sql.DB) ([]Archive, error) {
 			return nil, err
 		}
 
-		archives = append(archives, Archive{ID: id, URL: url, WorkingDirectory: wdir, Username: username, Password: password, SpaceUsed: used, SpaceTotal: total, Enabled: enabled})
+		archives = append(archives, &Archive{ID: id, URL: url, WorkingDirectory: wdir, Username: username, Password: password, SpaceUsed: used, SpaceTotal: total, Enabled: enabled})
 	}
 	rows.Close()
 
 	return archives, nil
 }
 
-func archiveHandler(w http.ResponseWriter, r *http.Request) {
-	type ArchiveInfo struct {
-		ID                    int
-		URL, WorkingDirectory string
-		Enabled               bool
-		SpaceUsed, SpaceTotal uint64
-		SpacePercent          float64
-		SpaceText             string
-	}
-
-	var data []ArchiveInfo
-	for _, archive := range Archives {
-		data = append(data, ArchiveInfo{
-			ID:               archive.ID,
-			URL:              archive.URL,
-			WorkingDirectory: archive.WorkingDirectory,
-			Enabled:          archive.Enabled,
-			SpaceUsed:        archive.SpaceUsed,
-			SpaceTotal:       archive.SpaceTotal,
-			SpaceText:        archive.StringUsedTotal(),
-			SpacePercent:     float64(archive.SpaceUsed) / float64(archive.SpaceTotal) * 100.0,
-		})
-	}
-
-	t, _ := template.ParseFiles("archive.html")
-	t.Execute(w, data)
+func (m *Manager) archiveHandler(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, "archive.html")
 }
 
-func archiveAddHandler(w http.ResponseWriter, r *http.Request) {
-	type ArchiveResponse struct {
-		ID               int
-		WorkingDirectory string  `json:"wdir"`
-		URL              string  `json:"url"`
-		SpaceUsed        uint64  `json:"spaceused"`
-		SpaceTotal       uint64  `json:"spacetotal"`
-		SpacePercent     float64 `json:"spacepercent"`
-		SpaceText        string  `json:"spacetext"`
+// CreateArchive checks that the archive can be reached, creates its working
+// directory and records how much space is available
+func (m *Manager) CreateArchive(request api.ArchiveRequest) (*Archive, error) {
+	if request.URL == "" || request.Username == "" || request.Password == "" {
+		return nil, ErrMissingData
 	}
 
-	type JSONResponse struct {
-		Success bool            `json:"success"`
-		Message string          `json:"message"`
-		Archive ArchiveResponse `json:"archive"`
+	client, used, total, err := checkArchive(request.URL, request.WorkingDirectory, request.Username, request.Password)
+	if err != nil {
+		return nil, err
 	}
+	client.Close()
 
-	w.Header().Set("Content-Type", "application/json")
+	archive := &Archive{URL: request.URL, Username: request.Username, Password: request.Password, WorkingDirectory: request.WorkingDirectory, Enabled: true, SpaceUsed: used, SpaceTotal: total}
+
+	res, err := DB.Exec("insert into archive(url, wdir, username, password, used, total) values (?,?,?,?, ?,?)", archive.URL, archive.WorkingDirectory, archive.Username, archive.Password, archive.SpaceUsed, archive.SpaceTotal)
+	if err != nil {
+		return nil, err
+	}
 
-	if r.FormValue("server_name") == "" || r.FormValue("user_name") == "" || r.FormValue("password") == "" {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: "Missing Data"})
-		return
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
 	}
 
-	// Test if we can connect
+	archive.ID = int(id)
+
+	m.AddArchive(archive)
+	return archive, nil
+}
+
+// checkArchive connects to an archive with the given settings, creates its
+// working directory and returns the space used and in total in KiB. The
+// connection is returned open.
+func checkArchive(url, wdir, username, password string) (*ssh.Client, uint64, uint64, error) {
 	config := &ssh.ClientConfig{
-		User: r.FormValue("user_name"),
+		User: username,
 		Auth: []ssh.AuthMethod{
-			ssh.Password(r.FormValue("password")),
+			ssh.Password(password),
 		},
 	}
 
-	client, err := SSHDialTimeout("tcp", r.FormValue("server_name")+":22", config, 1*time.Minute)
+	client, err := SSHDialTimeout("tcp", url+":22", config, 1*time.Minute)
 	if err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: fmt.Sprintf("Error connecting to %s. Please check the url and username/password.", r.FormValue("server_name"))})
-		return
+		return nil, 0, 0, &RequestError{http.StatusBadGateway, fmt.Sprintf("Error connecting to %s. Please check the url and username/password.", url)}
 	}
 
+	used, total, err := archiveSpace(client, wdir)
+	if err != nil {
+		client.Close()
+		return nil, 0, 0, err
+	}
+	return client, used, total, nil
+}
+
+func archiveSpace(client *ssh.Client, wdir string) (uint64, uint64, error) {
 	session, err := client.NewSession()
 	if err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: "Unable to create session"})
-		return
+		return 0, 0, &RequestError{http.StatusBadGateway, "Unable to create session"}
 	}
 	defer session.Close()
 
-	result, err := session.CombinedOutput("mkdir -p " + r.FormValue("root") + "&& df -Pk " + r.FormValue("root"))
+	result, err := session.CombinedOutput("mkdir -p " + wdir + "&& df -Pk " + wdir)
 	if err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: "Unable to calculate space"})
-		return
+		return 0, 0, &RequestError{http.StatusBadGateway, "Unable to calculate space"}
 	}
-	session.Close()
-	client.Close()
-
-	archive := Archive{URL: r.FormValue("server_name"), Username: r.FormValue("user_name"), Password: r.FormValue("password"), WorkingDirectory: r.FormValue("root"), Enabled: true}
 
 	// Find Space
 	scanner := bufio.NewScanner(bytes.NewReader(result))
@@ -178,45 +194,120 @@ func archiveAddHandler(w http.ResponseWriter, r *http.Request) {
 	// Get Filesystem Data
 	scanner.Scan()
 	fields := strings.Fields(scanner.Text())
+	if len(fields) < 4 {
+		return 0, 0, &RequestError{http.StatusBadGateway, "Unable to calculate space"}
+	}
 
 	used, err := strconv.ParseUint(fields[2], 10, 64)
 	if err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
-		return
+		return 0, 0, err
 	}
-	archive.SpaceUsed = used
 
 	free, err := strconv.ParseUint(fields[3], 10, 64)
 	if err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
-		return
+		return 0, 0, err
+	}
+	return used, used + free, nil
+}
+
+// UpdateArchive changes the host, working directory or credentials of an
+// archive. The new settings are checked by connecting with them before they
+// are saved. Results already copied stay where they are, so after a move
+// they must be copied over for downloads of them to keep working.
+func (m *Manager) UpdateArchive(id int, update api.ArchiveUpdate) error {
+	m.mu.RLock()
+	archive := FindArchive(id, m.archives)
+	var url, wdir, username, password string
+	if archive != nil {
+		url, wdir, username, password = archive.URL, archive.WorkingDirectory, archive.Username, archive.Password
 	}
-	archive.SpaceTotal = archive.SpaceUsed + free
+	m.mu.RUnlock()
 
-	log.Printf("%+v\n", archive)
+	if archive == nil {
+		return ErrNotFound
+	}
 
-	res, err := DB.Exec("insert into archive(url, wdir, username, password, used, total) values (?,?,?,?, ?,?)", archive.URL, archive.WorkingDirectory, r.FormValue("user_name"), r.FormValue("password"), archive.SpaceUsed, archive.SpaceTotal)
-	if err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
-		return
+	changed := false
+	if update.URL != nil && *update.URL != url {
+		url, changed = *update.URL, true
+	}
+	if update.WorkingDirectory != nil && *update.WorkingDirectory != wdir {
+		wdir, changed = *update.WorkingDirectory, true
+	}
+	if update.Username != nil && *update.Username != username {
+		username, changed = *update.Username, true
+	}
+	if update.Password != nil && *update.Password != password {
+		password, changed = *update.Password, true
 	}
 
-	id, err := res.LastInsertId()
+	if !changed {
+		return nil
+	}
+	if url == "" || username == "" || password == "" {
+		return ErrMissingData
+	}
+
+	client, used, total, err := checkArchive(url, wdir, username, password)
 	if err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
-		return
+		return err
 	}
 
-	archive.ID = int(id)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := DB.Exec("update archive set url = ?, wdir = ?, username = ?, password = ?, used = ?, total = ? where id = ?", url, wdir, username, password, used, total, id); err != nil {
+		client.Close()
+		return err
+	}
+
+	archive.clientMu.Lock()
+	if archive.Client != nil {
+		archive.Client.Close()
+	}
+	archive.URL, archive.WorkingDirectory, archive.Username, archive.Password = url, wdir, username, password
+	archive.Client = client
+	archive.clientMu.Unlock()
+
+	archive.SpaceUsed, archive.SpaceTotal = used, total
+	log.Println("[Archive]", id, "updated,", url, wdir)
+	return nil
+}
+
+// SetArchiveEnabled sets whether results are copied to an archive
+func (m *Manager) SetArchiveEnabled(id int, enabled bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	archive := FindArchive(id, m.archives)
+	if archive == nil {
+		return ErrNotFound
+	}
+
+	if _, err := DB.Exec("update archive set enabled = ? where id = ?", enabled, id); err != nil {
+		return err
+	}
+
+	archive.Enabled = enabled
+	return nil
+}
+
+// DeleteArchive stops copying results to an archive. Results already copied
+// are left in place.
+func (m *Manager) DeleteArchive(id int) error {
+	if _, err := DB.Exec("DELETE FROM archive WHERE id = ?", id); err != nil {
+		return err
+	}
 
-	Archives = append(Archives, archive)
-	json.NewEncoder(w).Encode(JSONResponse{Success: true, Message: string(result), Archive: ArchiveResponse{
-		ID:               archive.ID,
-		WorkingDirectory: archive.WorkingDirectory,
-		URL:              archive.URL,
-		SpaceUsed:        archive.SpaceUsed,
-		SpaceTotal:       archive.SpaceTotal,
-		SpacePercent:     float64(archive.SpaceUsed) / float64(archive.SpaceTotal) * 100.0,
-		SpaceText:        archive.StringUsedTotal(),
-	}})
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := 0; i < len(m.archives); i++ {
+		if m.archives[i].ID == id {
+			m.archives[i].Disconnect()
+			m.archives = append(m.archives[:i], m.archives[i+1:]...)
+			break
+		}
+	}
+	return nil
 }
@@ -0,0 +1,10 @@
+-- +goose Up
+ALTER TABLE job_instance ADD COLUMN attempts INTEGER DEFAULT 0;
+ALTER TABLE job_instance ADD COLUMN failed boolean DEFAULT 0;
+ALTER TABLE job_instance ADD COLUMN error text DEFAULT "";
+
+-- +goose Down
+ALTER TABLE job_instance RENAME TO job_instance_old;
+CREATE TABLE job_instance(id integer primary key, completed boolean not null default 0, job_id integer not null, pid integer default -1, resource_id text default "", FOREIGN KEY(job_id) REFERENCES job(id));
+INSERT INTO job_instance SELECT id, completed, job_id, pid, resource_id FROM job_instance_old;
+DROP TABLE job_instance_old;
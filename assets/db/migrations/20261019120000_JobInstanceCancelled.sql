@@ -0,0 +1,8 @@
+-- +goose Up
+ALTER TABLE job_instance ADD COLUMN cancelled boolean DEFAULT 0;
+
+-- +goose Down
+ALTER TABLE job_instance RENAME TO job_instance_old;
+CREATE TABLE job_instance(id integer primary key, completed boolean not null default 0, job_id integer not null, pid integer default -1, resource_id text default "", attempts integer default 0, failed boolean default 0, error text default "", archived boolean default 0, FOREIGN KEY(job_id) REFERENCES job(id));
+INSERT INTO job_instance SELECT id, completed, job_id, pid, resource_id, attempts, failed, error, archived FROM job_instance_old;
+DROP TABLE job_instance_old;
@@ -0,0 +1,18 @@
+-- +goose Up
+ALTER TABLE model ADD COLUMN revision INTEGER DEFAULT 1;
+ALTER TABLE template ADD COLUMN revision INTEGER DEFAULT 1;
+ALTER TABLE job ADD COLUMN spec text DEFAULT "";
+
+-- +goose Down
+ALTER TABLE job RENAME TO job_old;
+CREATE TABLE job(id integer primary key, name text not null, model_id integer not null, template_id integer not null, count int not null, FOREIGN KEY(model_id) REFERENCES model(id), FOREIGN KEY(template_id) REFERENCES template(id));
+INSERT INTO job SELECT id, name, model_id, template_id, count FROM job_old;
+DROP TABLE job_old;
+ALTER TABLE template RENAME TO template_old;
+CREATE TABLE template(id integer primary key, name text not null, file text not null);
+INSERT INTO template SELECT id, name, file FROM template_old;
+DROP TABLE template_old;
+ALTER TABLE model RENAME TO model_old;
+CREATE TABLE model(id integer primary key, name text not null);
+INSERT INTO model SELECT id, name FROM model_old;
+DROP TABLE model_old;
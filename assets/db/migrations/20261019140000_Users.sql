@@ -0,0 +1,24 @@
+-- +goose Up
+create table user(id integer primary key, name text not null unique, password text not null, created datetime not null default CURRENT_TIMESTAMP);
+create table session(token text not null primary key, user_id integer not null, expires datetime not null, FOREIGN KEY(user_id) REFERENCES user(id));
+create table token(id integer primary key, name text not null, token text not null unique, user_id integer not null, created datetime not null default CURRENT_TIMESTAMP, last_used datetime, FOREIGN KEY(user_id) REFERENCES user(id));
+ALTER TABLE model ADD COLUMN owner text DEFAULT "";
+ALTER TABLE template ADD COLUMN owner text DEFAULT "";
+ALTER TABLE job ADD COLUMN owner text DEFAULT "";
+
+-- +goose Down
+ALTER TABLE job RENAME TO job_old;
+CREATE TABLE job(id integer primary key, name text not null, model_id integer not null, template_id integer not null, count int not null, spec text default "", FOREIGN KEY(model_id) REFERENCES model(id), FOREIGN KEY(template_id) REFERENCES template(id));
+INSERT INTO job SELECT id, name, model_id, template_id, count, spec FROM job_old;
+DROP TABLE job_old;
+ALTER TABLE template RENAME TO template_old;
+CREATE TABLE template(id integer primary key, name text not null, file text not null, revision integer default 1);
+INSERT INTO template SELECT id, name, file, revision FROM template_old;
+DROP TABLE template_old;
+ALTER TABLE model RENAME TO model_old;
+CREATE TABLE model(id integer primary key, name text not null, revision integer default 1);
+INSERT INTO model SELECT id, name, revision FROM model_old;
+DROP TABLE model_old;
+drop table token;
+drop table session;
+drop table user;
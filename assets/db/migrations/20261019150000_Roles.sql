@@ -0,0 +1,11 @@
+-- +goose Up
+ALTER TABLE user ADD COLUMN role text not null DEFAULT "user";
+-- Only the first account, the admin created on the first start, keeps
+-- managing servers and users. Admins promote anyone else who should.
+UPDATE user SET role = "admin" WHERE id = (SELECT min(id) FROM user);
+
+-- +goose Down
+ALTER TABLE user RENAME TO user_old;
+CREATE TABLE user(id integer primary key, name text not null unique, password text not null, created datetime not null default CURRENT_TIMESTAMP);
+INSERT INTO user SELECT id, name, password, created FROM user_old;
+DROP TABLE user_old;
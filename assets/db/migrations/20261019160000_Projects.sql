@@ -0,0 +1,24 @@
+-- +goose Up
+create table project(id integer primary key, name text not null unique, max_gpus integer not null default 0, max_gpu_hours real not null default 0, max_instances integer not null default 0);
+create table project_member(project_id integer not null, user text not null, PRIMARY KEY(project_id, user), FOREIGN KEY(project_id) REFERENCES project(id));
+create table gpu_usage(id integer primary key, project_id integer not null, resource text not null, start datetime not null, end datetime not null, FOREIGN KEY(project_id) REFERENCES project(id));
+ALTER TABLE model ADD COLUMN project text DEFAULT "";
+ALTER TABLE template ADD COLUMN project text DEFAULT "";
+ALTER TABLE job ADD COLUMN project text DEFAULT "";
+
+-- +goose Down
+ALTER TABLE job RENAME TO job_old;
+CREATE TABLE job(id integer primary key, name text not null, model_id integer not null, template_id integer not null, count int not null, spec text default "", owner text DEFAULT "", FOREIGN KEY(model_id) REFERENCES model(id), FOREIGN KEY(template_id) REFERENCES template(id));
+INSERT INTO job SELECT id, name, model_id, template_id, count, spec, owner FROM job_old;
+DROP TABLE job_old;
+ALTER TABLE template RENAME TO template_old;
+CREATE TABLE template(id integer primary key, name text not null, file text not null, revision integer default 1, owner text DEFAULT "");
+INSERT INTO template SELECT id, name, file, revision, owner FROM template_old;
+DROP TABLE template_old;
+ALTER TABLE model RENAME TO model_old;
+CREATE TABLE model(id integer primary key, name text not null, revision integer default 1, owner text DEFAULT "");
+INSERT INTO model SELECT id, name, revision, owner FROM model_old;
+DROP TABLE model_old;
+drop table gpu_usage;
+drop table project_member;
+drop table project;
@@ -0,0 +1,16 @@
+-- +goose Up
+create table audit(id integer primary key, time datetime not null, actor text not null, action text not null, target text not null, parameters text not null default "", status integer not null default 0, outcome text not null);
+create index audit_time on audit(time);
+
+-- The audit log is append-only
+-- +goose StatementBegin
+CREATE TRIGGER audit_no_update BEFORE UPDATE ON audit BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END;
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE TRIGGER audit_no_delete BEFORE DELETE ON audit BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END;
+-- +goose StatementEnd
+
+-- +goose Down
+drop trigger audit_no_delete;
+drop trigger audit_no_update;
+drop table audit;
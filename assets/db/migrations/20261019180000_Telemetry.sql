@@ -0,0 +1,6 @@
+-- +goose Up
+create table gpu_telemetry(id integer primary key, resource text not null, time datetime not null, utilization integer not null, memory_used integer not null, memory_total integer not null, temperature integer not null, power real not null, ecc_errors integer not null);
+create index gpu_telemetry_resource_time on gpu_telemetry(resource, time);
+
+-- +goose Down
+drop table gpu_telemetry;
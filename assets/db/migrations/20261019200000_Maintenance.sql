@@ -0,0 +1,17 @@
+-- +goose Up
+ALTER TABLE server_resource ADD COLUMN enabled boolean not null default 1;
+ALTER TABLE server ADD COLUMN draining boolean not null default 0;
+create table maintenance_window(id integer primary key, server_id integer not null, start datetime not null, end datetime not null, reason text not null default "", FOREIGN KEY(server_id) REFERENCES server(id));
+
+-- +goose Down
+drop table maintenance_window;
+
+ALTER TABLE server RENAME TO server_old;
+CREATE TABLE server (id integer primary key, url text not null, username text not null, password text not null, enabled boolean not null default 1, wdir TEXT DEFAULT "");
+INSERT INTO server SELECT id, url, username, password, enabled, wdir FROM server_old;
+DROP TABLE server_old;
+
+ALTER TABLE server_resource RENAME TO server_resource_old;
+CREATE TABLE server_resource(uuid text not null primary key, name text not null, inuse boolean not null, server_id integer not null, device integer, retired datetime, FOREIGN KEY(server_id) REFERENCES server(id));
+INSERT INTO server_resource SELECT uuid, name, inuse, server_id, device, retired FROM server_resource_old;
+DROP TABLE server_resource_old;
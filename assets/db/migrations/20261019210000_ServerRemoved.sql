@@ -0,0 +1,8 @@
+-- +goose Up
+ALTER TABLE server ADD COLUMN removed datetime;
+
+-- +goose Down
+ALTER TABLE server RENAME TO server_old;
+CREATE TABLE server (id integer primary key, url text not null, username text not null, password text not null, enabled boolean not null default 1, wdir TEXT DEFAULT "", draining boolean not null default 0);
+INSERT INTO server SELECT id, url, username, password, enabled, wdir, draining FROM server_old;
+DROP TABLE server_old;
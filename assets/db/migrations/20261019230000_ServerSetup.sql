@@ -0,0 +1,9 @@
+-- +goose Up
+ALTER TABLE server ADD COLUMN setup text not null default "source ~/.bash_profile";
+ALTER TABLE server ADD COLUMN env text not null default "";
+
+-- +goose Down
+ALTER TABLE server RENAME TO server_old;
+CREATE TABLE server (id integer primary key, url text not null, username text not null, password text not null, enabled boolean not null default 1, wdir TEXT DEFAULT "", draining boolean not null default 0, removed datetime, probe text DEFAULT "");
+INSERT INTO server SELECT id, url, username, password, enabled, wdir, draining, removed, probe FROM server_old;
+DROP TABLE server_old;
@@ -0,0 +1,14 @@
+-- +goose Up
+ALTER TABLE template ADD COLUMN container text not null default "";
+ALTER TABLE job_instance ADD COLUMN image_digest text not null default "";
+
+-- +goose Down
+ALTER TABLE template RENAME TO template_old;
+CREATE TABLE template(id integer primary key, name text not null, file text not null, revision INTEGER DEFAULT 1, owner text DEFAULT "", project text DEFAULT "");
+INSERT INTO template SELECT id, name, file, revision, owner, project FROM template_old;
+DROP TABLE template_old;
+
+ALTER TABLE job_instance RENAME TO job_instance_old;
+CREATE TABLE job_instance(id integer primary key, completed boolean not null default 0, job_id integer not null, pid INTEGER DEFAULT -1, resource_id text DEFAULT "", attempts INTEGER DEFAULT 0, failed boolean DEFAULT 0, error text DEFAULT "", archived boolean DEFAULT 0, cancelled boolean DEFAULT 0, FOREIGN KEY(job_id) REFERENCES job(id));
+INSERT INTO job_instance SELECT id, completed, job_id, pid, resource_id, attempts, failed, error, archived, cancelled FROM job_instance_old;
+DROP TABLE job_instance_old;
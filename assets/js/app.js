@@ -0,0 +1,157 @@
+// Helpers shared by the pages, which are all clients of the JSON API
+var API = "/api/v1";
+
+// apiRequest sends data as JSON, or as a multipart form if it is FormData
+function apiRequest(method, path, data) {
+  var options = {
+    type        : method,
+    url         : API + path,
+    dataType    : 'json'
+  };
+
+  if( data instanceof FormData ) {
+    options.data = data;
+    options.processData = false;
+    options.contentType = false;
+  }else if( data !== undefined ) {
+    options.data = JSON.stringify(data);
+    options.contentType = 'application/json';
+  }
+
+  return $.ajax(options).fail(showError);
+}
+
+function showError(xhr) {
+  var message = xhr.responseJSON && xhr.responseJSON.error ? xhr.responseJSON.error : xhr.statusText;
+  $("<div class=\"alert alert-danger alert-dismissible\" role=\"alert\"><button type=\"button\" class=\"close\" data-dismiss=\"alert\" aria-label=\"Close\"><span aria-hidden=\"true\">&times;</span></button></div>").append(document.createTextNode(message)).insertBefore("form:first");
+}
+
+// formObject returns the fields of a form as an object
+function formObject(form) {
+  var data = {};
+  $.each($(form).serializeArray(), function(i, field) {
+    data[field.name] = field.value;
+  });
+  return data;
+}
+
+// editItem fills a form with the settings of an item so that submitting it
+// saves changes to the item rather than adding a new one. Password fields are
+// left blank, which keeps the current password.
+function editItem(form, id, item) {
+  $(form).data("edit", id);
+  $.each(item, function(name, value) {
+    $(form).find("[name='" + name + "']").val(value);
+  });
+  $(form).find("[type=password]").val("").attr("placeholder", "Unchanged");
+  $(form).find("[type=submit]").text("Save");
+}
+
+// editing returns the id of the item a form is editing, if any
+function editing(form) {
+  return $(form).data("edit");
+}
+
+// editChanges returns the fields of a form being edited, without the blank
+// passwords that are to stay unchanged
+function editChanges(form) {
+  var data = formObject(form);
+  $(form).find("[type=password]").each(function() {
+    if( !this.value ) {
+      delete data[this.name];
+    }
+  });
+  return data;
+}
+
+// stopEditing puts a form back to adding items
+function stopEditing(form) {
+  $(form).removeData("edit");
+  $(form).find("[type=password]").removeAttr("placeholder");
+  $(form).find("[type=submit]").text("Add");
+  form.reset();
+}
+
+// escapeHTML escapes text for use in element content and quoted attributes
+function escapeHTML(text) {
+  return $("<div>").text(text).html().replace(/"/g, "&quot;").replace(/'/g, "&#39;");
+}
+
+function progressBar(value, max, type, text) {
+  var percent = max > 0 ? (value / max) * 100.0 : 0;
+  return "<div class=\"progress-bar progress-bar-" + type + "\" role=\"progressbar\" style=\"width: " + percent + "%;\" data-toggle=\"tooltip\" data-placement=\"bottom\" data-original-title=\"" + (text === undefined ? value : text) + "\" aria-valuenow=\"" + value + "\" aria-valuemin=\"0\" aria-valuemax=\"" + max + "\"></div>";
+}
+
+// resetTable replaces the rows of a sortable table
+function resetTable(table, rows) {
+  $(table + " > tbody").html(rows.join(""));
+  $(table).trigger("update");
+  $('[data-toggle="tooltip"]').tooltip({container: 'body'});
+}
+
+// The logged in user. Controls marked admin-only or user-only are shown once
+// their role is known.
+var currentUser = $.getJSON(API + "/me").done(function(user) {
+  $("body").addClass("role-" + user.role);
+});
+
+// projectOptions fills a select with the projects the current user may put
+// things in. The first option leaves the choice to the server.
+function projectOptions(select) {
+  $.when(currentUser, apiRequest('GET', '/projects')).done(function(user, projects) {
+    user = user[0];
+    var options = ["<option value=\"\">Default</option>"];
+    $.each(projects[0], function(i, project) {
+      if( user.role == "admin" || $.inArray(user.name, project.members) != -1 ) {
+        options.push("<option value=\""+escapeHTML(project.name)+"\">"+escapeHTML(project.name)+"</option>");
+      }
+    });
+    $(select).html(options.join(""));
+  });
+}
+
+// subscribe opens the event stream, optionally for a job or server such as
+// "job=3", and passes each event to the handler for its type. Events missed
+// while the stream was down are not replayed, so reconnected is called once
+// it is back up for the page to reload.
+function subscribe(query, handlers, reconnected) {
+  var source = new EventSource(API + "/events" + (query ? "?" + query : ""));
+  var opened = false;
+  source.onopen = function() {
+    if( opened && reconnected ) {
+      reconnected();
+    }
+    opened = true;
+  };
+  $.each(handlers, function(type, handler) {
+    source.addEventListener(type, function(message) {
+      handler(JSON.parse(message.data));
+    });
+  });
+  return source;
+}
+
+// replaceRow updates a row of a sortable table in place, or adds it
+function replaceRow(table, id, row) {
+  var existing = $(table + " > tbody > tr").filter(function() { return this.id == id; });
+  if( existing.length ) {
+    existing.replaceWith(row);
+  }else{
+    $(table + " > tbody").append(row);
+  }
+  $(table).trigger("update");
+  $('[data-toggle="tooltip"]').tooltip({container: 'body'});
+}
+
+// Send the browser to the login page once its session has expired
+$(document).ajaxError(function(event, xhr) {
+  if( xhr.status == 401 && window.location.pathname != "/login" ) {
+    window.location = "/login";
+  }
+});
+
+function logout() {
+  $.ajax({ type: 'POST', url: API + '/logout' }).always(function() {
+    window.location = "/login";
+  });
+}
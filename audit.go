@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/LCLS/GPUManager/api"
+	"gopkg.in/yaml.v3"
+)
+
+// Actor recorded for decisions the scheduler makes on its own
+const SchedulerActor = "scheduler"
+
+// Most of a request body kept as the parameters of an audit entry
+const auditBodyLimit = 64 * 1024
+
+// Audit appends an entry to the audit log. Parameters are stored as JSON with
+// any secrets in them redacted. Failing to record an entry is logged but does
+// not stop the action.
+func Audit(actor, action, target string, parameters interface{}, status int, outcome string) {
+	params := ""
+	if parameters != nil {
+		data, err := json.Marshal(redact(parameters))
+		if err != nil {
+			log.Println("[Audit] Unable to encode parameters of", action, ":", err)
+		}
+		params = string(data)
+	}
+
+	if _, err := DB.Exec("insert into audit(time, actor, action, target, parameters, status, outcome) values (?,?,?,?,?,?,?)", time.Now().UTC(), actor, action, target, params, status, outcome); err != nil {
+		log.Println("[Audit] Unable to record", actor, action, target, ":", err)
+	}
+}
+
+// secretField reports whether a parameter holds a secret by its name
+func secretField(name string) bool {
+	name = strings.ToLower(name)
+	for _, secret := range []string{"password", "secret", "token", "key"} {
+		if strings.Contains(name, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// redact replaces the values of secret fields anywhere in a JSON-like value
+func redact(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(v))
+		for key, field := range v {
+			if secretField(key) {
+				redacted[key] = "[redacted]"
+			} else {
+				redacted[key] = redact(field)
+			}
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(v))
+		for i, item := range v {
+			redacted[i] = redact(item)
+		}
+		return redacted
+	case map[string][]string:
+		redacted := make(map[string]interface{}, len(v))
+		for key, values := range v {
+			if secretField(key) {
+				redacted[key] = "[redacted]"
+			} else {
+				redacted[key] = values
+			}
+		}
+		return redacted
+	}
+	return value
+}
+
+func instanceTarget(instance *JobInstance) string {
+	return fmt.Sprintf("/instances/%d", instance.ID)
+}
+
+// auditRecorder keeps the status of a response, and its body if it is an
+// error, so that the outcome can be recorded
+type auditRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (a *auditRecorder) WriteHeader(status int) {
+	a.status = status
+	a.ResponseWriter.WriteHeader(status)
+}
+
+func (a *auditRecorder) Write(data []byte) (int, error) {
+	if a.status >= 400 && a.body.Len() < auditBodyLimit {
+		a.body.Write(data)
+	}
+	return a.ResponseWriter.Write(data)
+}
+
+// outcome describes the response, with the error message of a failure
+func (a *auditRecorder) outcome() string {
+	if a.status < 400 {
+		return "ok"
+	}
+
+	var response api.Error
+	if err := json.Unmarshal(a.body.Bytes(), &response); err == nil && response.Error != "" {
+		return response.Error
+	}
+	return http.StatusText(a.status)
+}
+
+// audited wraps an API handler so that every request to it is recorded along
+// with its outcome, including ones that are refused
+func audited(action string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Keep the start of a body the handler will read, without changing
+		// what it sees. Multipart forms are recorded once parsed.
+		var body []byte
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+			var err error
+			body, err = io.ReadAll(io.LimitReader(r.Body, auditBodyLimit))
+			if err != nil {
+				writeError(w, &RequestError{http.StatusBadRequest, "Unable to read body"})
+				return
+			}
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+		}
+
+		recorder := &auditRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(recorder, r)
+
+		parameters := auditParameters(r, body)
+		actor := CurrentUser(r).Name
+		if actor == "" {
+			// Logins are recorded against the user name that was tried
+			switch fields := parameters.(type) {
+			case map[string]interface{}:
+				actor, _ = fields["username"].(string)
+			case map[string][]string:
+				if len(fields["username"]) > 0 {
+					actor = fields["username"][0]
+				}
+			}
+		}
+
+		Audit(actor, action, strings.TrimPrefix(r.URL.Path, api.Version), parameters, recorder.status, recorder.outcome())
+	}
+}
+
+// auditParameters returns what was sent with a request: the fields and file
+// names of a form, or a JSON or YAML body. Any other body could hold secrets
+// that cannot be redacted, so only its digest and length are kept.
+func auditParameters(r *http.Request, body []byte) interface{} {
+	if r.MultipartForm != nil {
+		fields := make(map[string][]string)
+		for name, values := range r.MultipartForm.Value {
+			fields[name] = values
+		}
+		for name, files := range r.MultipartForm.File {
+			for _, file := range files {
+				fields[name] = append(fields[name], file.Filename)
+			}
+		}
+		return fields
+	}
+
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		if values, err := url.ParseQuery(string(body)); err == nil {
+			return map[string][]string(values)
+		}
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err == nil {
+		return value
+	}
+
+	// A YAML document is converted to the types JSON decodes to, which
+	// redact understands. Text that YAML reads as a single string is not a
+	// document.
+	var document interface{}
+	if err := yaml.Unmarshal(body, &document); err == nil {
+		switch document.(type) {
+		case map[string]interface{}, []interface{}:
+			if data, err := json.Marshal(document); err == nil && json.Unmarshal(data, &value) == nil {
+				return value
+			}
+		}
+	}
+
+	sum := sha256.Sum256(body)
+	return map[string]interface{}{"sha256": hex.EncodeToString(sum[:]), "length": len(body)}
+}
+
+// AuditEntries returns the entries matching the filter, newest first
+func AuditEntries(filter api.AuditFilter) ([]api.AuditEntry, error) {
+	query := "SELECT id, time, actor, action, target, parameters, status, outcome FROM audit WHERE 1=1"
+	var args []interface{}
+
+	if filter.Actor != "" {
+		query += " AND actor = ?"
+		args = append(args, filter.Actor)
+	}
+	if filter.Action != "" {
+		query += " AND action LIKE ?"
+		args = append(args, "%"+filter.Action+"%")
+	}
+	if filter.Target != "" {
+		query += " AND target LIKE ?"
+		args = append(args, filter.Target+"%")
+	}
+	if !filter.Since.IsZero() {
+		query += " AND time >= ?"
+		args = append(args, filter.Since.UTC())
+	}
+	if !filter.Until.IsZero() {
+		query += " AND time < ?"
+		args = append(args, filter.Until.UTC())
+	}
+	query += " ORDER BY id DESC"
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []api.AuditEntry{}
+	for rows.Next() {
+		var entry api.AuditEntry
+		var parameters string
+		if err := rows.Scan(&entry.ID, &entry.Time, &entry.Actor, &entry.Action, &entry.Target, &parameters, &entry.Status, &entry.Outcome); err != nil {
+			return nil, err
+		}
+		if parameters != "" {
+			entry.Parameters = json.RawMessage(parameters)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (m *Manager) auditHandler(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, "audit.html")
+}
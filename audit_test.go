@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func sha256Hex(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestAuditParameters(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		expected    string
+	}{
+		{name: "json", contentType: "application/json", body: `{"username": "alice", "password": "hunter2"}`, expected: `{"password":"[redacted]","username":"alice"}`},
+		{
+			name:        "yaml spec",
+			contentType: "application/yaml",
+			body:        "name: lysozyme\nenv:\n  OMP_NUM_THREADS: \"4\"\n  API_TOKEN: abc123\nparameters:\n  steps: 1000\n",
+			expected:    `{"env":{"API_TOKEN":"[redacted]","OMP_NUM_THREADS":"4"},"name":"lysozyme","parameters":{"steps":1000}}`,
+		},
+		{name: "yaml list", contentType: "application/yaml", body: "- password: hunter2\n- name: other\n", expected: `[{"password":"[redacted]"},{"name":"other"}]`},
+		{name: "form", contentType: "application/x-www-form-urlencoded", body: "username=alice&password=hunter2", expected: `{"password":"[redacted]","username":["alice"]}`},
+		{name: "text", contentType: "text/plain", body: "password hunter2", expected: `{"length":16,"sha256":"` + sha256Hex("password hunter2") + `"}`},
+		{name: "yaml with other keys", contentType: "application/yaml", body: "? [a, b]\n: hunter2\n", expected: `{"length":19,"sha256":"` + sha256Hex("? [a, b]\n: hunter2\n") + `"}`},
+		{name: "empty", body: " \n", expected: "null"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/", strings.NewReader(test.body))
+			r.Header.Set("Content-Type", test.contentType)
+
+			data, err := json.Marshal(redact(auditParameters(r, []byte(test.body))))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, data)
+			}
+			if strings.Contains(string(data), "hunter2") || strings.Contains(string(data), "abc123") {
+				t.Errorf("secret recorded: %s", data)
+			}
+		})
+	}
+}
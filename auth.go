@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/LCLS/GPUManager/api"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// How long a web session lasts after logging in
+var SessionLength = 7 * 24 * time.Hour
+
+// Name of the cookie holding the session token
+const sessionCookie = "session"
+
+// Prefix of personal API tokens, which makes them easy to recognise
+const tokenPrefix = "gpm_"
+
+var ErrUnauthorized = &RequestError{http.StatusUnauthorized, "Unauthorized"}
+var ErrForbidden = &RequestError{http.StatusForbidden, "Forbidden"}
+
+// dummyHash is compared against when logging in as an unknown user, so that
+// this takes as long as a wrong password does
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+
+// roleRank orders the roles. Each role may do everything the roles below it
+// may.
+var roleRank = map[string]int{api.RoleViewer: 1, api.RoleUser: 2, api.RoleAdmin: 3}
+
+func validRole(role string) bool {
+	_, ok := roleRank[role]
+	return ok
+}
+
+type User struct {
+	ID      int
+	Name    string
+	Role    string
+	Created time.Time
+}
+
+// API returns the representation of the user used by the JSON API
+func (u *User) API() api.User {
+	return api.User{ID: u.ID, Name: u.Name, Role: u.Role, Created: u.Created}
+}
+
+// Can reports whether the user has at least the given role
+func (u User) Can(role string) bool {
+	return roleRank[u.Role] >= roleRank[role]
+}
+
+// Owns reports whether the user may change something created by owner.
+// Admins may change anything.
+func (u User) Owns(owner string) bool {
+	return u.Role == api.RoleAdmin || (u.Can(api.RoleUser) && u.Name == owner)
+}
+
+type userKey struct{}
+
+// CurrentUser returns the user a request was authenticated as
+func CurrentUser(r *http.Request) User {
+	user, _ := r.Context().Value(userKey{}).(User)
+	return user
+}
+
+// newSecret returns a random token and the hash it is stored as. Only the
+// hash is kept, so a copy of the database cannot be used to log in.
+func newSecret() (string, string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+
+	secret := hex.EncodeToString(buf)
+	return secret, hashSecret(secret), nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateUser adds a local account with a bcrypt hash of the password
+func CreateUser(name, password, role string) (User, error) {
+	if name == "" || password == "" {
+		return User{}, ErrMissingData
+	}
+	if role == "" {
+		role = api.RoleUser
+	}
+	if !validRole(role) {
+		return User{}, &RequestError{http.StatusBadRequest, "Invalid Role"}
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, err
+	}
+
+	if _, err := FindUserByName(name); err == nil {
+		return User{}, &RequestError{http.StatusConflict, "User Exists"}
+	}
+
+	res, err := DB.Exec("insert into user(name, password, role) values (?,?,?)", name, string(hash), role)
+	if err != nil {
+		return User{}, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return User{}, err
+	}
+	return FindUser(int(id))
+}
+
+func FindUser(id int) (User, error) {
+	var user User
+	if err := DB.QueryRow("SELECT id, name, role, created FROM user WHERE id = ?", id).Scan(&user.ID, &user.Name, &user.Role, &user.Created); err != nil {
+		if err == sql.ErrNoRows {
+			return User{}, ErrNotFound
+		}
+		return User{}, err
+	}
+	return user, nil
+}
+
+func FindUserByName(name string) (User, error) {
+	var user User
+	if err := DB.QueryRow("SELECT id, name, role, created FROM user WHERE name = ?", name).Scan(&user.ID, &user.Name, &user.Role, &user.Created); err != nil {
+		if err == sql.ErrNoRows {
+			return User{}, ErrNotFound
+		}
+		return User{}, err
+	}
+	return user, nil
+}
+
+func LoadUsers() ([]User, error) {
+	rows, err := DB.Query("SELECT id, name, role, created FROM user ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.ID, &user.Name, &user.Role, &user.Created); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// SetPassword replaces the password of a user and ends their sessions
+func SetPassword(id int, password string) error {
+	if password == "" {
+		return ErrMissingData
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	res, err := DB.Exec("update user set password = ? where id = ?", string(hash), id)
+	if err != nil {
+		return err
+	}
+	if count, err := res.RowsAffected(); err == nil && count == 0 {
+		return ErrNotFound
+	}
+
+	_, err = DB.Exec("DELETE FROM session WHERE user_id = ?", id)
+	return err
+}
+
+// SetRole changes the role of a user. The last admin cannot be demoted, so
+// that there is always someone able to manage the others.
+func SetRole(id int, role string) error {
+	if !validRole(role) {
+		return &RequestError{http.StatusBadRequest, "Invalid Role"}
+	}
+
+	user, err := FindUser(id)
+	if err != nil {
+		return err
+	}
+
+	if user.Role == api.RoleAdmin && role != api.RoleAdmin {
+		var admins int
+		if err := DB.QueryRow("SELECT count(*) FROM user WHERE role = ?", api.RoleAdmin).Scan(&admins); err != nil {
+			return err
+		}
+		if admins <= 1 {
+			return &RequestError{http.StatusBadRequest, "Unable to demote the last admin"}
+		}
+	}
+
+	_, err = DB.Exec("update user set role = ? where id = ?", role, id)
+	return err
+}
+
+// DeleteUser removes a user along with their sessions and tokens. What they
+// own is kept.
+func DeleteUser(id int) error {
+	res, err := DB.Exec("DELETE FROM user WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if count, err := res.RowsAffected(); err == nil && count == 0 {
+		return ErrNotFound
+	}
+
+	if _, err := DB.Exec("DELETE FROM session WHERE user_id = ?", id); err != nil {
+		return err
+	}
+	_, err = DB.Exec("DELETE FROM token WHERE user_id = ?", id)
+	return err
+}
+
+// Login checks a password and starts a session, returning its token
+func Login(name, password string) (User, string, time.Time, error) {
+	var id int
+	var hash string
+	if err := DB.QueryRow("SELECT id, password FROM user WHERE name = ?", name).Scan(&id, &hash); err != nil {
+		if err == sql.ErrNoRows {
+			bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+			return User{}, "", time.Time{}, ErrUnauthorized
+		}
+		return User{}, "", time.Time{}, err
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		return User{}, "", time.Time{}, ErrUnauthorized
+	}
+
+	token, stored, err := newSecret()
+	if err != nil {
+		return User{}, "", time.Time{}, err
+	}
+
+	expires := time.Now().Add(SessionLength)
+	if _, err := DB.Exec("insert into session(token, user_id, expires) values (?,?,?)", stored, id, expires); err != nil {
+		return User{}, "", time.Time{}, err
+	}
+
+	user, err := FindUser(id)
+	return user, token, expires, err
+}
+
+func Logout(token string) error {
+	_, err := DB.Exec("DELETE FROM session WHERE token = ?", hashSecret(token))
+	return err
+}
+
+// SessionUser returns the user a session token belongs to
+func SessionUser(token string) (User, error) {
+	var id int
+	var expires time.Time
+	if err := DB.QueryRow("SELECT user_id, expires FROM session WHERE token = ?", hashSecret(token)).Scan(&id, &expires); err != nil {
+		if err == sql.ErrNoRows {
+			return User{}, ErrUnauthorized
+		}
+		return User{}, err
+	}
+
+	if time.Now().After(expires) {
+		Logout(token)
+		return User{}, ErrUnauthorized
+	}
+	return FindUser(id)
+}
+
+// CreateToken makes a personal API token. The secret is returned only here.
+func CreateToken(user User, name string) (api.Token, error) {
+	if name == "" {
+		return api.Token{}, &RequestError{http.StatusBadRequest, "Missing Name"}
+	}
+
+	secret, stored, err := newSecret()
+	if err != nil {
+		return api.Token{}, err
+	}
+
+	created := time.Now()
+	res, err := DB.Exec("insert into token(name, token, user_id, created) values (?,?,?,?)", name, stored, user.ID, created)
+	if err != nil {
+		return api.Token{}, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return api.Token{}, err
+	}
+	return api.Token{ID: int(id), Name: name, Created: created, Secret: tokenPrefix + secret}, nil
+}
+
+// Tokens lists the personal API tokens of a user, without their secrets
+func Tokens(user User) ([]api.Token, error) {
+	rows, err := DB.Query("SELECT id, name, created, last_used FROM token WHERE user_id = ? ORDER BY created", user.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []api.Token{}
+	for rows.Next() {
+		var token api.Token
+		var lastUsed sql.NullTime
+		if err := rows.Scan(&token.ID, &token.Name, &token.Created, &lastUsed); err != nil {
+			return nil, err
+		}
+		if lastUsed.Valid {
+			token.LastUsed = &lastUsed.Time
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+func DeleteToken(user User, id int) error {
+	res, err := DB.Exec("DELETE FROM token WHERE id = ? AND user_id = ?", id, user.ID)
+	if err != nil {
+		return err
+	}
+	if count, err := res.RowsAffected(); err == nil && count == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// TokenUser returns the user a personal API token belongs to
+func TokenUser(secret string) (User, error) {
+	if !strings.HasPrefix(secret, tokenPrefix) {
+		return User{}, ErrUnauthorized
+	}
+	stored := hashSecret(strings.TrimPrefix(secret, tokenPrefix))
+
+	var id int
+	if err := DB.QueryRow("SELECT user_id FROM token WHERE token = ?", stored).Scan(&id); err != nil {
+		if err == sql.ErrNoRows {
+			return User{}, ErrUnauthorized
+		}
+		return User{}, err
+	}
+
+	if _, err := DB.Exec("update token set last_used = ? where token = ?", time.Now(), stored); err != nil {
+		log.Println("[Auth] Unable to record token use:", err)
+	}
+	return FindUser(id)
+}
+
+// EnsureAdmin creates an admin account if there are no users at all, so that
+// a new installation can be logged in to. Its password is logged once.
+func EnsureAdmin() error {
+	var count int
+	if err := DB.QueryRow("SELECT count(*) FROM user").Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	password, _, err := newSecret()
+	if err != nil {
+		return err
+	}
+	password = password[:16]
+
+	if _, err := CreateUser("admin", password, api.RoleAdmin); err != nil {
+		return err
+	}
+	log.Println("[Auth] Created user admin with password", password, "- change it after logging in")
+	return nil
+}
+
+// public lists the paths that can be requested without logging in
+func public(path string) bool {
+	switch {
+	case path == "/login", path == api.Version+"/login":
+		return true
+	case strings.HasPrefix(path, "/js/"), strings.HasPrefix(path, "/css/"), strings.HasPrefix(path, "/fonts/"):
+		return true
+	}
+	return false
+}
+
+// machine reports whether the path is read by programs rather than people,
+// which are refused rather than sent to the login page
+func machine(path string) bool {
+	return strings.HasPrefix(path, api.Version+"/") || path == "/metrics"
+}
+
+// RequireLogin authenticates every request by its session cookie or by a
+// personal API token given as a bearer token. Unauthenticated API requests
+// are refused and page requests are sent to the login page.
+func RequireLogin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if public(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, err := requestUser(r)
+		if err != nil {
+			if err != ErrUnauthorized {
+				log.Println("[Auth] Error:", err)
+			}
+
+			if machine(r.URL.Path) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="GPUManager"`)
+				writeError(w, ErrUnauthorized)
+				return
+			}
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, user)))
+	})
+}
+
+// Require wraps a handler so that it is only run for users with at least the
+// given role. An empty role allows anyone.
+func Require(role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !CurrentUser(r).Can(role) {
+			if machine(r.URL.Path) {
+				writeError(w, ErrForbidden)
+				return
+			}
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func requestUser(r *http.Request) (User, error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		secret, ok := strings.CutPrefix(header, "Bearer ")
+		if !ok {
+			return User{}, ErrUnauthorized
+		}
+		return TokenUser(secret)
+	}
+
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return User{}, ErrUnauthorized
+	}
+	return SessionUser(cookie.Value)
+}
+
+func (m *Manager) loginHandler(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, "login.html")
+}
+
+func (m *Manager) accountHandler(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, "account.html")
+}
@@ -0,0 +1,663 @@
+// Package client is a Go client for the GPUManager JSON API. Requests and
+// responses use the types of the api package.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LCLS/GPUManager/api"
+)
+
+// Error is returned when the manager responds with a 4xx or 5xx status
+type Error struct {
+	Status  int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s", e.Status, e.Message)
+}
+
+// Client talks to a single manager
+type Client struct {
+	// BaseURL is the address of the manager, such as http://gpumanager:8080
+	BaseURL string
+
+	// Token is a personal API token, created on the account page
+	Token string
+
+	// HTTP is used to make requests. http.DefaultClient is used if it is nil.
+	HTTP *http.Client
+}
+
+// New returns a client for the manager at baseURL that authenticates with
+// the personal API token
+func New(baseURL, token string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/"), Token: token}
+}
+
+func (c *Client) http() *http.Client {
+	if c.HTTP != nil {
+		return c.HTTP
+	}
+	return http.DefaultClient
+}
+
+// Do sends a request to the path under the API prefix. The body is encoded
+// as JSON unless it is already an io.Reader, in which case contentType is
+// used. If out is non-nil the response is decoded into it.
+func (c *Client) Do(ctx context.Context, method, path string, body interface{}, contentType string, out interface{}) error {
+	resp, err := c.send(ctx, method, path, body, contentType)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Stream sends a GET request to the path under the API prefix and returns
+// the body of the response, which the caller must close
+func (c *Client) Stream(ctx context.Context, path string) (io.ReadCloser, error) {
+	resp, err := c.send(ctx, http.MethodGet, path, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// send makes a request and turns an error status into an *Error
+func (c *Client) send(ctx context.Context, method, path string, body interface{}, contentType string) (*http.Response, error) {
+	var reader io.Reader
+	switch b := body.(type) {
+	case nil:
+	case io.Reader:
+		reader = b
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+		contentType = "application/json"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+api.Version+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	resp, err := c.http().Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+
+		var apiErr api.Error
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil || apiErr.Error == "" {
+			apiErr.Error = http.StatusText(resp.StatusCode)
+		}
+		return nil, &Error{Status: resp.StatusCode, Message: apiErr.Error}
+	}
+	return resp, nil
+}
+
+func (c *Client) get(ctx context.Context, path string, out interface{}) error {
+	return c.Do(ctx, http.MethodGet, path, nil, "", out)
+}
+
+func (c *Client) delete(ctx context.Context, path string) error {
+	return c.Do(ctx, http.MethodDelete, path, nil, "", nil)
+}
+
+// upload posts a multipart form with the name, the project if one is given,
+// and the files, keyed by file name
+func (c *Client) upload(ctx context.Context, path string, fields map[string]string, files map[string]io.Reader, out interface{}) error {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+
+	for name, value := range fields {
+		if value == "" {
+			continue
+		}
+		if err := form.WriteField(name, value); err != nil {
+			return err
+		}
+	}
+	for filename, file := range files {
+		part, err := form.CreateFormFile("files", filename)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(part, file); err != nil {
+			return err
+		}
+	}
+	if err := form.Close(); err != nil {
+		return err
+	}
+
+	return c.Do(ctx, http.MethodPost, path, &body, form.FormDataContentType(), out)
+}
+
+// OpenAPI returns the OpenAPI description served by the manager
+func (c *Client) OpenAPI(ctx context.Context) (json.RawMessage, error) {
+	var spec json.RawMessage
+	err := c.get(ctx, "/openapi.json", &spec)
+	return spec, err
+}
+
+// JobSpecSchema returns the JSON Schema of job specifications
+func (c *Client) JobSpecSchema(ctx context.Context) (json.RawMessage, error) {
+	var schema json.RawMessage
+	err := c.get(ctx, "/jobspec.schema.json", &schema)
+	return schema, err
+}
+
+// Login starts a session with a user name and password, which is kept in a
+// cookie jar on the client. It is only needed to create a first API token.
+func (c *Client) Login(ctx context.Context, username, password string) (api.User, error) {
+	if c.HTTP == nil {
+		c.HTTP = &http.Client{}
+	}
+	if c.HTTP.Jar == nil {
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			return api.User{}, err
+		}
+		c.HTTP.Jar = jar
+	}
+
+	var user api.User
+	err := c.Do(ctx, http.MethodPost, "/login", api.LoginRequest{Username: username, Password: password}, "", &user)
+	return user, err
+}
+
+// Logout ends the session started by Login
+func (c *Client) Logout(ctx context.Context) error {
+	return c.Do(ctx, http.MethodPost, "/logout", nil, "", nil)
+}
+
+// Me returns the user the client is authenticated as
+func (c *Client) Me(ctx context.Context) (api.User, error) {
+	var user api.User
+	err := c.get(ctx, "/me", &user)
+	return user, err
+}
+
+// Tokens lists the personal API tokens of the current user
+func (c *Client) Tokens(ctx context.Context) ([]api.Token, error) {
+	var tokens []api.Token
+	err := c.get(ctx, "/tokens", &tokens)
+	return tokens, err
+}
+
+// CreateToken makes a personal API token. Its secret is only returned here.
+func (c *Client) CreateToken(ctx context.Context, name string) (api.Token, error) {
+	var token api.Token
+	err := c.Do(ctx, http.MethodPost, "/tokens", api.TokenRequest{Name: name}, "", &token)
+	return token, err
+}
+
+func (c *Client) DeleteToken(ctx context.Context, id int) error {
+	return c.delete(ctx, fmt.Sprintf("/tokens/%d", id))
+}
+
+// Users
+
+func (c *Client) Users(ctx context.Context) ([]api.User, error) {
+	var users []api.User
+	err := c.get(ctx, "/users", &users)
+	return users, err
+}
+
+func (c *Client) CreateUser(ctx context.Context, request api.UserRequest) (api.User, error) {
+	var user api.User
+	err := c.Do(ctx, http.MethodPost, "/users", request, "", &user)
+	return user, err
+}
+
+// UpdateUser changes the password or role of a user. Changing the password
+// ends their sessions.
+func (c *Client) UpdateUser(ctx context.Context, id int, update api.UserUpdate) (api.User, error) {
+	var user api.User
+	err := c.Do(ctx, http.MethodPatch, fmt.Sprintf("/users/%d", id), update, "", &user)
+	return user, err
+}
+
+// DeleteUser removes a user and their sessions and tokens
+func (c *Client) DeleteUser(ctx context.Context, id int) error {
+	return c.delete(ctx, fmt.Sprintf("/users/%d", id))
+}
+
+// Servers
+
+func (c *Client) Servers(ctx context.Context) ([]api.Server, error) {
+	var servers []api.Server
+	err := c.get(ctx, "/servers", &servers)
+	return servers, err
+}
+
+func (c *Client) Server(ctx context.Context, id int) (api.Server, error) {
+	var server api.Server
+	err := c.get(ctx, fmt.Sprintf("/servers/%d", id), &server)
+	return server, err
+}
+
+// AddServer adds a server and starts running instances on its GPUs
+func (c *Client) AddServer(ctx context.Context, request api.ServerRequest) (api.Server, error) {
+	var server api.Server
+	err := c.Do(ctx, http.MethodPost, "/servers", request, "", &server)
+	return server, err
+}
+
+func (c *Client) UpdateServer(ctx context.Context, id int, update api.ServerUpdate) (api.Server, error) {
+	var server api.Server
+	err := c.Do(ctx, http.MethodPatch, fmt.Sprintf("/servers/%d", id), update, "", &server)
+	return server, err
+}
+
+// ProbeServer checks again that a server has what instances need
+func (c *Client) ProbeServer(ctx context.Context, id int) (api.Probe, error) {
+	var probe api.Probe
+	err := c.Do(ctx, http.MethodPost, fmt.Sprintf("/servers/%d/probe", id), nil, "", &probe)
+	return probe, err
+}
+
+// DeleteServer removes a server. Unless force is set the server must have
+// been drained first; with it, its running instances are killed and queued
+// again.
+func (c *Client) DeleteServer(ctx context.Context, id int, force bool) error {
+	path := fmt.Sprintf("/servers/%d", id)
+	if force {
+		path += "?force=true"
+	}
+	return c.delete(ctx, path)
+}
+
+func (c *Client) ServerResources(ctx context.Context, id int) ([]api.Resource, error) {
+	var resources []api.Resource
+	err := c.get(ctx, fmt.Sprintf("/servers/%d/resources", id), &resources)
+	return resources, err
+}
+
+// RescanServer discovers the GPUs of a server again and reports what changed
+func (c *Client) RescanServer(ctx context.Context, id int) (api.Rescan, error) {
+	var rescan api.Rescan
+	err := c.Do(ctx, http.MethodPost, fmt.Sprintf("/servers/%d/rescan", id), nil, "", &rescan)
+	return rescan, err
+}
+
+// Maintenance
+
+// MaintenanceWindows returns the maintenance windows that have not ended,
+// soonest first
+func (c *Client) MaintenanceWindows(ctx context.Context) ([]api.MaintenanceWindow, error) {
+	var windows []api.MaintenanceWindow
+	err := c.get(ctx, "/maintenance", &windows)
+	return windows, err
+}
+
+// AddMaintenance schedules a maintenance window. Its server drains ahead of
+// it.
+func (c *Client) AddMaintenance(ctx context.Context, request api.MaintenanceRequest) (api.MaintenanceWindow, error) {
+	var window api.MaintenanceWindow
+	err := c.Do(ctx, http.MethodPost, "/maintenance", request, "", &window)
+	return window, err
+}
+
+func (c *Client) Maintenance(ctx context.Context, id int) (api.MaintenanceWindow, error) {
+	var window api.MaintenanceWindow
+	err := c.get(ctx, fmt.Sprintf("/maintenance/%d", id), &window)
+	return window, err
+}
+
+func (c *Client) DeleteMaintenance(ctx context.Context, id int) error {
+	return c.delete(ctx, fmt.Sprintf("/maintenance/%d", id))
+}
+
+// Resources
+
+func (c *Client) Resources(ctx context.Context) ([]api.Resource, error) {
+	var resources []api.Resource
+	err := c.get(ctx, "/resources", &resources)
+	return resources, err
+}
+
+func (c *Client) Resource(ctx context.Context, uuid string) (api.Resource, error) {
+	var resource api.Resource
+	err := c.get(ctx, "/resources/"+url.PathEscape(uuid), &resource)
+	return resource, err
+}
+
+// UpdateResource changes whether a GPU is given new instances
+func (c *Client) UpdateResource(ctx context.Context, uuid string, update api.ResourceUpdate) (api.Resource, error) {
+	var resource api.Resource
+	err := c.Do(ctx, http.MethodPatch, "/resources/"+url.PathEscape(uuid), update, "", &resource)
+	return resource, err
+}
+
+// ResourceTelemetry returns the telemetry of a GPU sampled in [since, until),
+// oldest first. Zero times default to a day ago and to now.
+func (c *Client) ResourceTelemetry(ctx context.Context, uuid string, since, until time.Time) ([]api.Telemetry, error) {
+	query := url.Values{}
+	if !since.IsZero() {
+		query.Set("since", since.Format(time.RFC3339))
+	}
+	if !until.IsZero() {
+		query.Set("until", until.Format(time.RFC3339))
+	}
+
+	var samples []api.Telemetry
+	err := c.get(ctx, "/resources/"+url.PathEscape(uuid)+"/telemetry?"+query.Encode(), &samples)
+	return samples, err
+}
+
+// Models
+
+func (c *Client) Models(ctx context.Context) ([]api.Model, error) {
+	var models []api.Model
+	err := c.get(ctx, "/models", &models)
+	return models, err
+}
+
+func (c *Client) Model(ctx context.Context, id int) (api.Model, error) {
+	var model api.Model
+	err := c.get(ctx, fmt.Sprintf("/models/%d", id), &model)
+	return model, err
+}
+
+// CreateModel uploads a model made of the given files, keyed by file name
+func (c *Client) CreateModel(ctx context.Context, name, project string, files map[string]io.Reader) (api.Model, error) {
+	var model api.Model
+	err := c.upload(ctx, "/models", map[string]string{"name": name, "project": project}, files, &model)
+	return model, err
+}
+
+func (c *Client) DeleteModel(ctx context.Context, id int) error {
+	return c.delete(ctx, fmt.Sprintf("/models/%d", id))
+}
+
+// Templates
+
+func (c *Client) Templates(ctx context.Context) ([]api.Template, error) {
+	var templates []api.Template
+	err := c.get(ctx, "/templates", &templates)
+	return templates, err
+}
+
+func (c *Client) Template(ctx context.Context, id int) (api.Template, error) {
+	var template api.Template
+	err := c.get(ctx, fmt.Sprintf("/templates/%d", id), &template)
+	return template, err
+}
+
+// CreateTemplate uploads a template from the contents of file. If container
+// is set the template is run in that image.
+func (c *Client) CreateTemplate(ctx context.Context, name, project, container string, filename string, file io.Reader) (api.Template, error) {
+	var template api.Template
+	err := c.upload(ctx, "/templates", map[string]string{"name": name, "project": project, "container": container}, map[string]io.Reader{filename: file}, &template)
+	return template, err
+}
+
+func (c *Client) DeleteTemplate(ctx context.Context, id int) error {
+	return c.delete(ctx, fmt.Sprintf("/templates/%d", id))
+}
+
+// Jobs
+
+func (c *Client) Jobs(ctx context.Context) ([]api.Job, error) {
+	var jobs []api.Job
+	err := c.get(ctx, "/jobs", &jobs)
+	return jobs, err
+}
+
+func (c *Client) Job(ctx context.Context, id int) (api.Job, error) {
+	var job api.Job
+	err := c.get(ctx, fmt.Sprintf("/jobs/%d", id), &job)
+	return job, err
+}
+
+// SubmitJob creates a job and queues its instances
+func (c *Client) SubmitJob(ctx context.Context, request api.JobRequest) (api.Job, error) {
+	var job api.Job
+	err := c.Do(ctx, http.MethodPost, "/jobs", request, "", &job)
+	return job, err
+}
+
+func (c *Client) DeleteJob(ctx context.Context, id int) error {
+	return c.delete(ctx, fmt.Sprintf("/jobs/%d", id))
+}
+
+func (c *Client) JobInstances(ctx context.Context, id int) ([]api.Instance, error) {
+	var instances []api.Instance
+	err := c.get(ctx, fmt.Sprintf("/jobs/%d/instances", id), &instances)
+	return instances, err
+}
+
+// SubmitJobSpec creates a job from a YAML or JSON job specification
+func (c *Client) SubmitJobSpec(ctx context.Context, spec []byte) (api.Job, error) {
+	var job api.Job
+	err := c.Do(ctx, http.MethodPost, "/jobs/spec", bytes.NewReader(spec), "application/yaml", &job)
+	return job, err
+}
+
+// JobScript returns the script the instances of a job are run with on a
+// server
+func (c *Client) JobScript(ctx context.Context, id, server int) ([]byte, error) {
+	body, err := c.Stream(ctx, fmt.Sprintf("/jobs/%d/script?server=%d", id, server))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return io.ReadAll(body)
+}
+
+// JobSpec returns the specification of a job
+func (c *Client) JobSpec(ctx context.Context, id int) ([]byte, error) {
+	body, err := c.Stream(ctx, fmt.Sprintf("/jobs/%d/spec", id))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return io.ReadAll(body)
+}
+
+// CancelJob drops the queued instances of a job and kills its running ones
+func (c *Client) CancelJob(ctx context.Context, id int) (api.Job, error) {
+	var job api.Job
+	err := c.Do(ctx, http.MethodPost, fmt.Sprintf("/jobs/%d/cancel", id), nil, "", &job)
+	return job, err
+}
+
+// Instances
+
+func (c *Client) Instance(ctx context.Context, id int) (api.Instance, error) {
+	var instance api.Instance
+	err := c.get(ctx, fmt.Sprintf("/instances/%d", id), &instance)
+	return instance, err
+}
+
+// InstanceLog returns the output of the simulation of an instance, or its
+// last lines if lines is not 0. With follow the body stays open and carries
+// what the simulation writes next until the instance stops running.
+func (c *Client) InstanceLog(ctx context.Context, id, lines int, follow bool) (io.ReadCloser, error) {
+	query := url.Values{}
+	if lines > 0 {
+		query.Set("lines", strconv.Itoa(lines))
+	}
+	if follow {
+		query.Set("follow", "true")
+	}
+	return c.Stream(ctx, fmt.Sprintf("/instances/%d/log?%s", id, query.Encode()))
+}
+
+// InstanceResults returns the files of an instance as a gzipped tar archive
+func (c *Client) InstanceResults(ctx context.Context, id int) (io.ReadCloser, error) {
+	return c.Stream(ctx, fmt.Sprintf("/instances/%d/results", id))
+}
+
+// Archives
+
+func (c *Client) Archives(ctx context.Context) ([]api.Archive, error) {
+	var archives []api.Archive
+	err := c.get(ctx, "/archives", &archives)
+	return archives, err
+}
+
+func (c *Client) Archive(ctx context.Context, id int) (api.Archive, error) {
+	var archive api.Archive
+	err := c.get(ctx, fmt.Sprintf("/archives/%d", id), &archive)
+	return archive, err
+}
+
+func (c *Client) AddArchive(ctx context.Context, request api.ArchiveRequest) (api.Archive, error) {
+	var archive api.Archive
+	err := c.Do(ctx, http.MethodPost, "/archives", request, "", &archive)
+	return archive, err
+}
+
+func (c *Client) UpdateArchive(ctx context.Context, id int, update api.ArchiveUpdate) (api.Archive, error) {
+	var archive api.Archive
+	err := c.Do(ctx, http.MethodPatch, fmt.Sprintf("/archives/%d", id), update, "", &archive)
+	return archive, err
+}
+
+func (c *Client) DeleteArchive(ctx context.Context, id int) error {
+	return c.delete(ctx, fmt.Sprintf("/archives/%d", id))
+}
+
+// Projects
+
+// Projects lists the projects with their limits and their usage this month
+func (c *Client) Projects(ctx context.Context) ([]api.Project, error) {
+	var projects []api.Project
+	err := c.get(ctx, "/projects", &projects)
+	return projects, err
+}
+
+func (c *Client) Project(ctx context.Context, id int) (api.Project, error) {
+	var project api.Project
+	err := c.get(ctx, fmt.Sprintf("/projects/%d", id), &project)
+	return project, err
+}
+
+func (c *Client) AddProject(ctx context.Context, request api.ProjectRequest) (api.Project, error) {
+	var project api.Project
+	err := c.Do(ctx, http.MethodPost, "/projects", request, "", &project)
+	return project, err
+}
+
+func (c *Client) UpdateProject(ctx context.Context, id int, update api.ProjectUpdate) (api.Project, error) {
+	var project api.Project
+	err := c.Do(ctx, http.MethodPatch, fmt.Sprintf("/projects/%d", id), update, "", &project)
+	return project, err
+}
+
+func (c *Client) DeleteProject(ctx context.Context, id int) error {
+	return c.delete(ctx, fmt.Sprintf("/projects/%d", id))
+}
+
+// Audit returns the newest entries of the audit log that match the filter
+func (c *Client) Audit(ctx context.Context, filter api.AuditFilter) ([]api.AuditEntry, error) {
+	var entries []api.AuditEntry
+	err := c.get(ctx, "/audit?"+auditQuery(filter).Encode(), &entries)
+	return entries, err
+}
+
+// AuditExport returns every entry of the audit log that matches the filter,
+// newest first, as a JSON array the caller must close. The limit of the
+// filter is not used.
+func (c *Client) AuditExport(ctx context.Context, filter api.AuditFilter) (io.ReadCloser, error) {
+	query := auditQuery(filter)
+	query.Del("limit")
+	return c.Stream(ctx, "/audit/export?"+query.Encode())
+}
+
+func auditQuery(filter api.AuditFilter) url.Values {
+	query := url.Values{}
+	if filter.Actor != "" {
+		query.Set("actor", filter.Actor)
+	}
+	if filter.Action != "" {
+		query.Set("action", filter.Action)
+	}
+	if filter.Target != "" {
+		query.Set("target", filter.Target)
+	}
+	if !filter.Since.IsZero() {
+		query.Set("since", filter.Since.Format(time.RFC3339))
+	}
+	if !filter.Until.IsZero() {
+		query.Set("until", filter.Until.Format(time.RFC3339))
+	}
+	if filter.Limit > 0 {
+		query.Set("limit", strconv.Itoa(filter.Limit))
+	}
+	return query
+}
+
+// Events calls fn with each event for a job or server, or with every event if
+// both are zero, until the stream ends or fn returns an error. Events are not
+// replayed, so state should be reloaded after subscribing again.
+func (c *Client) Events(ctx context.Context, job, server int, fn func(api.Event) error) error {
+	query := url.Values{}
+	if job != 0 {
+		query.Set("job", strconv.Itoa(job))
+	}
+	if server != 0 {
+		query.Set("server", strconv.Itoa(server))
+	}
+
+	body, err := c.Stream(ctx, "/events?"+query.Encode())
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	// Each event is a single data line; the id and event lines repeat what
+	// it holds
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+
+		var event api.Event
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return err
+		}
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,339 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LCLS/GPUManager/api"
+)
+
+// newTestClient returns a client of a test server that hands each request to
+// handler
+func newTestClient(t *testing.T, handler http.HandlerFunc) *Client {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return New(server.URL+"/", "secret")
+}
+
+// calls makes every request the client has, with 1 for IDs
+var calls = map[string]func(ctx context.Context, c *Client) error{
+	"OpenAPI":       func(ctx context.Context, c *Client) error { _, err := c.OpenAPI(ctx); return err },
+	"JobSpecSchema": func(ctx context.Context, c *Client) error { _, err := c.JobSpecSchema(ctx); return err },
+	"Login":         func(ctx context.Context, c *Client) error { _, err := c.Login(ctx, "admin", "password"); return err },
+	"Logout":        func(ctx context.Context, c *Client) error { return c.Logout(ctx) },
+	"Me":            func(ctx context.Context, c *Client) error { _, err := c.Me(ctx); return err },
+	"Tokens":        func(ctx context.Context, c *Client) error { _, err := c.Tokens(ctx); return err },
+	"CreateToken":   func(ctx context.Context, c *Client) error { _, err := c.CreateToken(ctx, "ci"); return err },
+	"DeleteToken":   func(ctx context.Context, c *Client) error { return c.DeleteToken(ctx, 1) },
+	"Users":         func(ctx context.Context, c *Client) error { _, err := c.Users(ctx); return err },
+	"CreateUser": func(ctx context.Context, c *Client) error {
+		_, err := c.CreateUser(ctx, api.UserRequest{Name: "alice"})
+		return err
+	},
+	"UpdateUser": func(ctx context.Context, c *Client) error {
+		_, err := c.UpdateUser(ctx, 1, api.UserUpdate{})
+		return err
+	},
+	"DeleteUser": func(ctx context.Context, c *Client) error { return c.DeleteUser(ctx, 1) },
+	"Servers":    func(ctx context.Context, c *Client) error { _, err := c.Servers(ctx); return err },
+	"Server":     func(ctx context.Context, c *Client) error { _, err := c.Server(ctx, 1); return err },
+	"AddServer": func(ctx context.Context, c *Client) error {
+		_, err := c.AddServer(ctx, api.ServerRequest{})
+		return err
+	},
+	"UpdateServer": func(ctx context.Context, c *Client) error {
+		_, err := c.UpdateServer(ctx, 1, api.ServerUpdate{})
+		return err
+	},
+	"ProbeServer":        func(ctx context.Context, c *Client) error { _, err := c.ProbeServer(ctx, 1); return err },
+	"DeleteServer":       func(ctx context.Context, c *Client) error { return c.DeleteServer(ctx, 1, true) },
+	"ServerResources":    func(ctx context.Context, c *Client) error { _, err := c.ServerResources(ctx, 1); return err },
+	"RescanServer":       func(ctx context.Context, c *Client) error { _, err := c.RescanServer(ctx, 1); return err },
+	"MaintenanceWindows": func(ctx context.Context, c *Client) error { _, err := c.MaintenanceWindows(ctx); return err },
+	"AddMaintenance": func(ctx context.Context, c *Client) error {
+		_, err := c.AddMaintenance(ctx, api.MaintenanceRequest{})
+		return err
+	},
+	"Maintenance":       func(ctx context.Context, c *Client) error { _, err := c.Maintenance(ctx, 1); return err },
+	"DeleteMaintenance": func(ctx context.Context, c *Client) error { return c.DeleteMaintenance(ctx, 1) },
+	"Resources":         func(ctx context.Context, c *Client) error { _, err := c.Resources(ctx); return err },
+	"Resource":          func(ctx context.Context, c *Client) error { _, err := c.Resource(ctx, "GPU-1"); return err },
+	"UpdateResource": func(ctx context.Context, c *Client) error {
+		_, err := c.UpdateResource(ctx, "GPU-1", api.ResourceUpdate{})
+		return err
+	},
+	"ResourceTelemetry": func(ctx context.Context, c *Client) error {
+		_, err := c.ResourceTelemetry(ctx, "GPU-1", time.Time{}, time.Time{})
+		return err
+	},
+	"Models": func(ctx context.Context, c *Client) error { _, err := c.Models(ctx); return err },
+	"Model":  func(ctx context.Context, c *Client) error { _, err := c.Model(ctx, 1); return err },
+	"CreateModel": func(ctx context.Context, c *Client) error {
+		_, err := c.CreateModel(ctx, "lysozyme", "", map[string]io.Reader{"input.pdb": strings.NewReader("ATOM\n")})
+		return err
+	},
+	"DeleteModel": func(ctx context.Context, c *Client) error { return c.DeleteModel(ctx, 1) },
+	"Templates":   func(ctx context.Context, c *Client) error { _, err := c.Templates(ctx); return err },
+	"Template":    func(ctx context.Context, c *Client) error { _, err := c.Template(ctx, 1); return err },
+	"CreateTemplate": func(ctx context.Context, c *Client) error {
+		_, err := c.CreateTemplate(ctx, "sim", "", "", "sim.py", strings.NewReader("print()\n"))
+		return err
+	},
+	"DeleteTemplate": func(ctx context.Context, c *Client) error { return c.DeleteTemplate(ctx, 1) },
+	"Jobs":           func(ctx context.Context, c *Client) error { _, err := c.Jobs(ctx); return err },
+	"Job":            func(ctx context.Context, c *Client) error { _, err := c.Job(ctx, 1); return err },
+	"SubmitJob":      func(ctx context.Context, c *Client) error { _, err := c.SubmitJob(ctx, api.JobRequest{}); return err },
+	"SubmitJobSpec": func(ctx context.Context, c *Client) error {
+		_, err := c.SubmitJobSpec(ctx, []byte("name: test\n"))
+		return err
+	},
+	"DeleteJob":       func(ctx context.Context, c *Client) error { return c.DeleteJob(ctx, 1) },
+	"JobInstances":    func(ctx context.Context, c *Client) error { _, err := c.JobInstances(ctx, 1); return err },
+	"CancelJob":       func(ctx context.Context, c *Client) error { _, err := c.CancelJob(ctx, 1); return err },
+	"JobSpec":         func(ctx context.Context, c *Client) error { _, err := c.JobSpec(ctx, 1); return err },
+	"JobScript":       func(ctx context.Context, c *Client) error { _, err := c.JobScript(ctx, 1, 0); return err },
+	"Instance":        func(ctx context.Context, c *Client) error { _, err := c.Instance(ctx, 1); return err },
+	"InstanceLog":     func(ctx context.Context, c *Client) error { return closeStream(c.InstanceLog(ctx, 1, 0, false)) },
+	"InstanceResults": func(ctx context.Context, c *Client) error { return closeStream(c.InstanceResults(ctx, 1)) },
+	"Archives":        func(ctx context.Context, c *Client) error { _, err := c.Archives(ctx); return err },
+	"Archive":         func(ctx context.Context, c *Client) error { _, err := c.Archive(ctx, 1); return err },
+	"AddArchive": func(ctx context.Context, c *Client) error {
+		_, err := c.AddArchive(ctx, api.ArchiveRequest{})
+		return err
+	},
+	"UpdateArchive": func(ctx context.Context, c *Client) error {
+		_, err := c.UpdateArchive(ctx, 1, api.ArchiveUpdate{})
+		return err
+	},
+	"DeleteArchive": func(ctx context.Context, c *Client) error { return c.DeleteArchive(ctx, 1) },
+	"Projects":      func(ctx context.Context, c *Client) error { _, err := c.Projects(ctx); return err },
+	"Project":       func(ctx context.Context, c *Client) error { _, err := c.Project(ctx, 1); return err },
+	"AddProject": func(ctx context.Context, c *Client) error {
+		_, err := c.AddProject(ctx, api.ProjectRequest{})
+		return err
+	},
+	"UpdateProject": func(ctx context.Context, c *Client) error {
+		_, err := c.UpdateProject(ctx, 1, api.ProjectUpdate{})
+		return err
+	},
+	"DeleteProject": func(ctx context.Context, c *Client) error { return c.DeleteProject(ctx, 1) },
+	"Audit":         func(ctx context.Context, c *Client) error { _, err := c.Audit(ctx, api.AuditFilter{}); return err },
+	"AuditExport":   func(ctx context.Context, c *Client) error { return closeStream(c.AuditExport(ctx, api.AuditFilter{})) },
+	"Events": func(ctx context.Context, c *Client) error {
+		return c.Events(ctx, 0, 0, func(api.Event) error { return nil })
+	},
+}
+
+func closeStream(body io.ReadCloser, err error) error {
+	if err != nil {
+		return err
+	}
+	return body.Close()
+}
+
+// TestOperations checks that the client has a method for every operation in
+// the OpenAPI description, and makes no request that is not described
+func TestOperations(t *testing.T) {
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(api.OpenAPI, &spec); err != nil {
+		t.Fatal(err)
+	}
+
+	// Operations are matched by the pattern of their path, as the client
+	// fills in the parameters
+	parameter := regexp.MustCompile(`\\\{[a-z]+\\\}`)
+	type operation struct {
+		name    string
+		pattern *regexp.Regexp
+	}
+	var operations []operation
+	for path, methods := range spec.Paths {
+		for method := range methods {
+			if method == "parameters" {
+				continue
+			}
+			pattern := parameter.ReplaceAllString(regexp.QuoteMeta(path), "[^/]+")
+			operations = append(operations, operation{strings.ToUpper(method) + " " + path, regexp.MustCompile("^" + strings.ToUpper(method) + " " + pattern + "$")})
+		}
+	}
+
+	var request string
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		request = r.Method + " " + strings.TrimPrefix(r.URL.Path, api.Version)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	used := map[string]bool{}
+	for name, call := range calls {
+		request = ""
+		if err := call(context.Background(), c); err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+
+		found := false
+		for _, operation := range operations {
+			if operation.pattern.MatchString(request) {
+				used[operation.name] = true
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%s requested %q, which is not described", name, request)
+		}
+	}
+
+	for _, operation := range operations {
+		if !used[operation.name] {
+			t.Errorf("no method for %s", operation.name)
+		}
+	}
+}
+
+// TestRequests checks what the client sends and that it decodes the
+// response
+func TestRequests(t *testing.T) {
+	t.Run("json", func(t *testing.T) {
+		c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost || r.URL.Path != api.Version+"/jobs" {
+				t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			}
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				t.Errorf("unexpected authorization %q", r.Header.Get("Authorization"))
+			}
+			if r.Header.Get("Content-Type") != "application/json" {
+				t.Errorf("unexpected content type %q", r.Header.Get("Content-Type"))
+			}
+
+			var request api.JobRequest
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				t.Error(err)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(api.Job{ID: 7, Name: request.Name, Count: request.Count})
+		})
+
+		job, err := c.SubmitJob(context.Background(), api.JobRequest{Name: "lysozyme", ModelID: 1, TemplateID: 2, Count: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.ID != 7 || job.Name != "lysozyme" || job.Count != 3 {
+			t.Errorf("unexpected job %+v", job)
+		}
+	})
+
+	t.Run("query", func(t *testing.T) {
+		since := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+		c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+			query := r.URL.Query()
+			if query.Get("actor") != "alice" || query.Get("since") != "2026-10-01T00:00:00Z" || query.Get("limit") != "5" || query.Has("until") {
+				t.Errorf("unexpected query %q", r.URL.RawQuery)
+			}
+			json.NewEncoder(w).Encode([]api.AuditEntry{{ID: 1, Actor: "alice"}})
+		})
+
+		entries, err := c.Audit(context.Background(), api.AuditFilter{Actor: "alice", Since: since, Limit: 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].Actor != "alice" {
+			t.Errorf("unexpected entries %+v", entries)
+		}
+	})
+
+	t.Run("upload", func(t *testing.T) {
+		c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+			if err := r.ParseMultipartForm(1 << 20); err != nil {
+				t.Fatal(err)
+			}
+			if r.FormValue("name") != "lysozyme" || r.MultipartForm.Value["project"] != nil {
+				t.Errorf("unexpected fields %v", r.MultipartForm.Value)
+			}
+			files := r.MultipartForm.File["files"]
+			if len(files) != 1 || files[0].Filename != "input.pdb" {
+				t.Errorf("unexpected files %v", files)
+			}
+			json.NewEncoder(w).Encode(api.Model{ID: 3, Name: r.FormValue("name")})
+		})
+
+		model, err := c.CreateModel(context.Background(), "lysozyme", "", map[string]io.Reader{"input.pdb": strings.NewReader("ATOM\n")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if model.ID != 3 {
+			t.Errorf("unexpected model %+v", model)
+		}
+	})
+
+	t.Run("events", func(t *testing.T) {
+		c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("job") != "4" {
+				t.Errorf("unexpected query %q", r.URL.RawQuery)
+			}
+			w.Header().Set("Content-Type", "text/event-stream")
+			io.WriteString(w, "id: 1\nevent: job\ndata: {\"id\":1,\"type\":\"job\",\"job_id\":4,\"data\":{}}\n\n")
+			io.WriteString(w, "id: 2\nevent: instance\ndata: {\"id\":2,\"type\":\"instance\",\"job_id\":4,\"data\":{}}\n\n")
+		})
+
+		var events []api.Event
+		err := c.Events(context.Background(), 4, 0, func(event api.Event) error {
+			events = append(events, event)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 2 || events[0].Type != "job" || events[1].ID != 2 || events[1].JobID != 4 {
+			t.Errorf("unexpected events %+v", events)
+		}
+	})
+}
+
+// TestErrors checks that error statuses are returned as an *Error with the
+// message of the manager, or the status text when there is none
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		message string
+	}{
+		{name: "message", status: http.StatusForbidden, body: `{"error": "Only admins may do this"}`, message: "Only admins may do this"},
+		{name: "empty", status: http.StatusNotFound, body: `{}`, message: "Not Found"},
+		{name: "not json", status: http.StatusBadGateway, body: "<html>Bad Gateway</html>", message: "Bad Gateway"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.status)
+				io.WriteString(w, test.body)
+			})
+
+			_, err := c.Job(context.Background(), 1)
+			var apiErr *Error
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("expected an *Error, got %v", err)
+			}
+			if apiErr.Status != test.status || apiErr.Message != test.message {
+				t.Errorf("expected %d %q, got %d %q", test.status, test.message, apiErr.Status, apiErr.Message)
+			}
+
+			if _, err := c.InstanceLog(context.Background(), 1, 0, false); !errors.As(err, &apiErr) || apiErr.Status != test.status {
+				t.Errorf("expected a streamed request to fail with %d, got %v", test.status, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/LCLS/GPUManager/api"
+	"github.com/LCLS/GPUManager/client"
+)
+
+func jobsList(ctx context.Context, c *client.Client, args []string) error {
+	jobs, err := c.Jobs(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := table()
+	fmt.Fprintln(w, "ID\tNAME\tMODEL\tTEMPLATE\tQUEUED\tRUNNING\tCOMPLETED\tFAILED\tCANCELLED")
+	for _, job := range jobs {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\n", job.ID, job.Name, job.Model, job.Template, job.Queued, job.Running, job.Completed, job.Failed, job.Cancelled)
+	}
+	return w.Flush()
+}
+
+func jobsSubmit(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected job spec file")
+	}
+
+	data, err := os.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+
+	job, err := c.SubmitJobSpec(ctx, data)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Submitted job %d with %d instances\n", job.ID, job.Count)
+	return nil
+}
+
+// jobsWatch prints the progress of a job each time it changes, until none of
+// its instances are left queued or running
+func jobsWatch(ctx context.Context, c *client.Client, args []string) error {
+	id, err := argID(args, "job ID")
+	if err != nil {
+		return err
+	}
+
+	job, err := c.Job(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	for printProgress(job) {
+		err := c.Events(ctx, id, 0, func(event api.Event) error {
+			switch event.Type {
+			case api.EventJobRemoved:
+				return fmt.Errorf("job %d was removed", id)
+			case api.EventJob:
+			default:
+				return nil
+			}
+			if err := json.Unmarshal(event.Data, &job); err != nil {
+				return err
+			}
+			if !printProgress(job) {
+				return errFinished
+			}
+			return nil
+		})
+
+		switch {
+		case err == errFinished || ctx.Err() != nil:
+			return nil
+		case err != nil:
+			return err
+		}
+
+		// The stream ended, so catch up on what was missed before following
+		// it again
+		if job, err = c.Job(ctx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// errFinished stops following events once a job has finished
+var errFinished = errors.New("finished")
+
+// printProgress prints the progress of a job and reports whether it has
+// instances left to run
+func printProgress(job api.Job) bool {
+	fmt.Printf("%s  queued %d  running %d  completed %d  failed %d  cancelled %d\n", time.Now().Format("15:04:05"), job.Queued, job.Running, job.Completed, job.Failed, job.Cancelled)
+	return job.Queued != 0 || job.Running != 0
+}
+
+// jobsExport prints the specification of a job
+func jobsExport(ctx context.Context, c *client.Client, args []string) error {
+	id, err := argID(args, "job ID")
+	if err != nil {
+		return err
+	}
+
+	spec, err := c.JobSpec(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.Write(spec)
+	return err
+}
+
+// jobsScript prints the script the instances of a job are run with on a
+// server
+func jobsScript(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("jobs script", flag.ContinueOnError)
+	server := flags.Int("server", 0, "ID of the server")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	id, err := argID(flags.Args(), "job ID")
+	if err != nil {
+		return err
+	}
+
+	script, err := c.JobScript(ctx, id, *server)
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.Write(script)
+	return err
+}
+
+func jobsCancel(ctx context.Context, c *client.Client, args []string) error {
+	id, err := argID(args, "job ID")
+	if err != nil {
+		return err
+	}
+
+	job, err := c.CancelJob(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Cancelled job %d, %d instances still stopping\n", job.ID, job.Running)
+	return nil
+}
+
+func instancesList(ctx context.Context, c *client.Client, args []string) error {
+	id, err := argID(args, "job ID")
+	if err != nil {
+		return err
+	}
+
+	instances, err := c.JobInstances(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	w := table()
+	fmt.Fprintln(w, "ID\tNUMBER\tSTATE\tRESOURCE\tATTEMPTS\tIMAGE\tERROR")
+	for _, instance := range instances {
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%d\t%s\t%s\n", instance.ID, instance.Number, instance.State, instance.Resource, instance.Attempts, instance.ImageDigest, instance.Error)
+	}
+	return w.Flush()
+}
+
+// instancesLog prints the log of an instance, like tail
+func instancesLog(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("instances log", flag.ContinueOnError)
+	lines := flags.Int("n", 0, "Print only the last lines of the log")
+	follow := flags.Bool("f", false, "Keep printing what is written until the instance stops running")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	id, err := argID(flags.Args(), "instance ID")
+	if err != nil {
+		return err
+	}
+
+	body, err := c.InstanceLog(ctx, id, *lines, *follow)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	_, err = io.Copy(os.Stdout, body)
+	return err
+}
+
+// instancesDownload saves the results of an instance as a gzipped tar archive
+func instancesDownload(ctx context.Context, c *client.Client, args []string) error {
+	var output string
+
+	flags := flag.NewFlagSet("instances download", flag.ContinueOnError)
+	flags.StringVar(&output, "o", "", "File to write, instance-ID.tar.gz by default")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	id, err := argID(flags.Args(), "instance ID")
+	if err != nil {
+		return err
+	}
+
+	if output == "" {
+		output = fmt.Sprintf("instance-%d.tar.gz", id)
+	}
+
+	body, err := c.InstanceResults(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	file, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(file, body); err != nil {
+		file.Close()
+		os.Remove(output)
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	fmt.Println("Saved", output)
+	return nil
+}
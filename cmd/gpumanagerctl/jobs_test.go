@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/LCLS/GPUManager/api"
+	"github.com/LCLS/GPUManager/client"
+)
+
+// runCommand runs a command against a test server that hands each request
+// to handler, and returns what the command printed
+func runCommand(t *testing.T, handler http.HandlerFunc, args ...string) (string, error) {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	run, ok := commands[args[0]][args[1]]
+	if !ok {
+		t.Fatalf("no command %s %s", args[0], args[1])
+	}
+
+	output, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer output.Close()
+
+	stdout := os.Stdout
+	os.Stdout = output
+	err = run(context.Background(), client.New(server.URL, "secret"), args[2:])
+	os.Stdout = stdout
+
+	printed, readErr := os.ReadFile(output.Name())
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	return string(printed), err
+}
+
+// writeJSON answers a request of a test server
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeEvents answers a request for the event stream with events
+func writeEvents(t *testing.T, w http.ResponseWriter, events ...api.Event) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	for _, event := range events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			t.Error(err)
+		}
+		io.WriteString(w, "event: "+event.Type+"\ndata: "+string(data)+"\n\n")
+	}
+}
+
+func jobEvent(t *testing.T, job api.Job) api.Event {
+	data, err := json.Marshal(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return api.Event{Type: api.EventJob, JobID: job.ID, Data: data}
+}
+
+func TestJobsSubmit(t *testing.T) {
+	spec := filepath.Join(t.TempDir(), "spec.yaml")
+	if err := os.WriteFile(spec, []byte("name: lysozyme\ncount: 3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := runCommand(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != api.Version+"/jobs/spec" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("unexpected authorization %q", r.Header.Get("Authorization"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != "name: lysozyme\ncount: 3\n" {
+			t.Errorf("unexpected spec %q", body)
+		}
+		writeJSON(w, http.StatusCreated, api.Job{ID: 5, Name: "lysozyme", Count: 3})
+	}, "jobs", "submit", spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != "Submitted job 5 with 3 instances\n" {
+		t.Errorf("unexpected output %q", output)
+	}
+
+	_, err = runCommand(t, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusBadRequest, api.Error{Error: "count must be positive"})
+	}, "jobs", "submit", spec)
+	if err == nil || !strings.Contains(err.Error(), "count must be positive") {
+		t.Errorf("expected the error of the server, got %v", err)
+	}
+}
+
+// TestJobsWatch checks that watch prints the progress of a job from its
+// events until it finishes, catching up when the stream ends
+func TestJobsWatch(t *testing.T) {
+	running := api.Job{ID: 5, Count: 2, Queued: 1, Running: 1}
+	halfway := api.Job{ID: 5, Count: 2, Running: 1, Completed: 1}
+	finished := api.Job{ID: 5, Count: 2, Completed: 2}
+
+	tests := []struct {
+		name     string
+		jobs     []api.Job
+		events   [][]api.Event
+		progress []string
+		err      string
+	}{
+		{name: "finished", jobs: []api.Job{finished}, progress: []string{"completed 2"}},
+		{name: "events", jobs: []api.Job{running}, events: [][]api.Event{{
+			{Type: api.EventInstance, JobID: 5, Data: json.RawMessage(`{}`)},
+			jobEvent(t, halfway),
+			jobEvent(t, finished),
+		}}, progress: []string{"queued 1  running 1", "running 1  completed 1", "completed 2"}},
+		{name: "reconnect", jobs: []api.Job{running, finished}, events: [][]api.Event{{}}, progress: []string{"queued 1  running 1", "completed 2"}},
+		{name: "removed", jobs: []api.Job{running}, events: [][]api.Event{{
+			{Type: api.EventJobRemoved, JobID: 5, Data: json.RawMessage(`{}`)},
+		}}, progress: []string{"queued 1  running 1"}, err: "job 5 was removed"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			jobs, events := test.jobs, test.events
+			output, err := runCommand(t, func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case api.Version + "/jobs/5":
+					if len(jobs) == 0 {
+						t.Error("job requested again")
+						writeJSON(w, http.StatusNotFound, api.Error{Error: "Not found"})
+						return
+					}
+					writeJSON(w, http.StatusOK, jobs[0])
+					jobs = jobs[1:]
+				case api.Version + "/events":
+					if r.URL.Query().Get("job") != "5" {
+						t.Errorf("unexpected query %q", r.URL.RawQuery)
+					}
+					if len(events) == 0 {
+						t.Error("events requested again")
+						writeJSON(w, http.StatusNotFound, api.Error{Error: "Not found"})
+						return
+					}
+					writeEvents(t, w, events[0]...)
+					events = events[1:]
+				default:
+					t.Errorf("unexpected request %s", r.URL.Path)
+				}
+			}, "jobs", "watch", "5")
+
+			if test.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if test.err != "" && (err == nil || err.Error() != test.err) {
+				t.Fatalf("expected %q, got %v", test.err, err)
+			}
+
+			lines := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+			if len(lines) != len(test.progress) {
+				t.Fatalf("expected %d lines, got %q", len(test.progress), output)
+			}
+			for i, progress := range test.progress {
+				if !strings.Contains(lines[i], progress) {
+					t.Errorf("line %d: expected %q, got %q", i, progress, lines[i])
+				}
+			}
+		})
+	}
+}
+
+func TestInstancesLog(t *testing.T) {
+	tests := []struct {
+		name  string
+		args  []string
+		query string
+	}{
+		{name: "whole", args: []string{"7"}, query: ""},
+		{name: "tail", args: []string{"-n", "10", "7"}, query: "lines=10"},
+		{name: "follow", args: []string{"-n", "10", "-f", "7"}, query: "follow=true&lines=10"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output, err := runCommand(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != api.Version+"/instances/7/log" || r.URL.Query().Encode() != test.query {
+					t.Errorf("unexpected request %s?%s", r.URL.Path, r.URL.RawQuery)
+				}
+				w.Header().Set("Content-Type", "text/plain")
+				io.WriteString(w, "step 1\nstep 2\n")
+			}, append([]string{"instances", "log"}, test.args...)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if output != "step 1\nstep 2\n" {
+				t.Errorf("unexpected output %q", output)
+			}
+		})
+	}
+
+	_, err := runCommand(t, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusForbidden, api.Error{Error: "Forbidden"})
+	}, "instances", "log", "7")
+	if err == nil || err.Error() != "403 Forbidden" {
+		t.Errorf("expected 403 Forbidden, got %v", err)
+	}
+}
+
+func TestInstancesDownload(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		status int
+		file   string
+	}{
+		{name: "default name", args: []string{"7"}, status: http.StatusOK, file: "instance-7.tar.gz"},
+		{name: "output", args: []string{"-o", "results.tar.gz", "7"}, status: http.StatusOK, file: "results.tar.gz"},
+		{name: "not found", args: []string{"7"}, status: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+
+			output, err := runCommand(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != api.Version+"/instances/7/results" {
+					t.Errorf("unexpected request %s", r.URL.Path)
+				}
+				if test.status != http.StatusOK {
+					writeJSON(w, test.status, api.Error{Error: "Not found"})
+					return
+				}
+				w.Header().Set("Content-Type", "application/gzip")
+				io.WriteString(w, "archive")
+			}, append([]string{"instances", "download"}, test.args...)...)
+
+			if test.file == "" {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				if files, _ := filepath.Glob("*"); len(files) != 0 {
+					t.Errorf("expected no file, found %v", files)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if output != "Saved "+test.file+"\n" {
+				t.Errorf("unexpected output %q", output)
+			}
+			data, err := os.ReadFile(test.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != "archive" {
+				t.Errorf("unexpected contents %q", data)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+// Command gpumanagerctl operates a running GPUManager through its JSON API.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/LCLS/GPUManager/client"
+)
+
+const usage = `Usage: gpumanagerctl [-server URL] [-token TOKEN] <command> [arguments]
+
+Commands:
+  login -user NAME
+  tokens list
+  tokens create NAME
+  tokens remove ID
+  servers list
+  servers add -url HOST -user NAME [-wdir DIR] [-setup COMMANDS] [-env NAME=VALUE]...
+  servers edit [-url HOST] [-user NAME] [-wdir DIR] [-password] [-setup COMMANDS] [-env NAME=VALUE]... ID
+  servers rescan ID
+  servers probe ID
+  servers drain ID
+  servers undrain ID
+  servers remove [-force] ID
+  resources list
+  resources enable UUID
+  resources disable UUID
+  maintenance list
+  maintenance add -server ID -start TIME -end TIME [-reason TEXT]
+  maintenance remove ID
+  models list
+  models upload [-project NAME] NAME DIR
+  templates list
+  templates upload [-project NAME] [-container IMAGE] NAME FILE
+  projects list
+  projects add -name NAME [-members A,B] [-gpus N] [-gpu-hours H] [-instances N]
+  jobs list
+  jobs submit SPEC.yaml
+  jobs export ID
+  jobs script -server ID JOB
+  jobs watch ID
+  jobs cancel ID
+  instances list JOB
+  instances log [-n LINES] [-f] ID
+  instances download [-o FILE] ID
+
+The server defaults to $GPUMANAGER_URL, or http://localhost:8080, and the
+token to $GPUMANAGER_TOKEN. Use login to create a token with your password.
+The password for servers add and servers edit -password is read from
+$GPUMANAGER_PASSWORD if it is set.
+Maintenance times are RFC 3339, such as 2026-11-02T08:00:00Z.
+`
+
+// command runs a subcommand with the arguments that follow it
+type command func(ctx context.Context, c *client.Client, args []string) error
+
+var commands = map[string]map[string]command{
+	"login": {
+		"": login,
+	},
+	"tokens": {
+		"list":   tokensList,
+		"create": tokensCreate,
+		"remove": tokensRemove,
+	},
+	"servers": {
+		"list":    serversList,
+		"add":     serversAdd,
+		"edit":    serversEdit,
+		"rescan":  serversRescan,
+		"probe":   serversProbe,
+		"drain":   serversDrain,
+		"undrain": serversUndrain,
+		"remove":  serversRemove,
+	},
+	"resources": {
+		"list":    resourcesList,
+		"enable":  resourcesEnable,
+		"disable": resourcesDisable,
+	},
+	"maintenance": {
+		"list":   maintenanceList,
+		"add":    maintenanceAdd,
+		"remove": maintenanceRemove,
+	},
+	"models": {
+		"list":   modelsList,
+		"upload": modelsUpload,
+	},
+	"templates": {
+		"list":   templatesList,
+		"upload": templatesUpload,
+	},
+	"projects": {
+		"list": projectsList,
+		"add":  projectsAdd,
+	},
+	"jobs": {
+		"list":   jobsList,
+		"submit": jobsSubmit,
+		"export": jobsExport,
+		"script": jobsScript,
+		"watch":  jobsWatch,
+		"cancel": jobsCancel,
+	},
+	"instances": {
+		"list":     instancesList,
+		"log":      instancesLog,
+		"download": instancesDownload,
+	},
+}
+
+func main() {
+	server := os.Getenv("GPUMANAGER_URL")
+	if server == "" {
+		server = "http://localhost:8080"
+	}
+
+	token := os.Getenv("GPUMANAGER_TOKEN")
+
+	flag.StringVar(&server, "server", server, "Address of the manager")
+	flag.StringVar(&token, "token", token, "Personal API token")
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// Commands without a subcommand are stored under ""
+	run, ok := commands[args[0]][""]
+	if ok {
+		args = args[1:]
+	} else if len(args) > 1 {
+		run, ok = commands[args[0]][args[1]]
+		args = args[2:]
+	}
+	if !ok {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	if err := run(ctx, client.New(server, token), args); err != nil {
+		fmt.Fprintln(os.Stderr, "gpumanagerctl:", err)
+		os.Exit(1)
+	}
+}
+
+// argID parses the single ID argument of a command
+func argID(args []string, name string) (int, error) {
+	if len(args) != 1 {
+		return 0, fmt.Errorf("expected %s", name)
+	}
+
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", name, args[0])
+	}
+	return id, nil
+}
+
+func table() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/LCLS/GPUManager/api"
+	"github.com/LCLS/GPUManager/client"
+)
+
+// limit formats a project limit, which is unlimited when zero
+func limit(value float64) string {
+	if value <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%g", value)
+}
+
+func projectsList(ctx context.Context, c *client.Client, args []string) error {
+	projects, err := c.Projects(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := table()
+	fmt.Fprintln(w, "ID\tNAME\tGPUS\tGPU-HOURS\tINSTANCES/JOB\tMEMBERS")
+	for _, project := range projects {
+		fmt.Fprintf(w, "%d\t%s\t%d/%s\t%.1f/%s\t%s\t%s\n", project.ID, project.Name, project.GPUsInUse, limit(float64(project.MaxGPUs)), project.GPUHoursUsed, limit(project.MaxGPUHours), limit(float64(project.MaxInstances)), strings.Join(project.Members, ", "))
+	}
+	return w.Flush()
+}
+
+func projectsAdd(ctx context.Context, c *client.Client, args []string) error {
+	var request api.ProjectRequest
+	var members string
+
+	flags := flag.NewFlagSet("projects add", flag.ContinueOnError)
+	flags.StringVar(&request.Name, "name", "", "Name of the project")
+	flags.StringVar(&members, "members", "", "Comma separated user names of the members")
+	flags.IntVar(&request.MaxGPUs, "gpus", 0, "Most GPUs used at once, or 0 for no limit")
+	flags.Float64Var(&request.MaxGPUHours, "gpu-hours", 0, "Most GPU-hours used a month, or 0 for no limit")
+	flags.IntVar(&request.MaxInstances, "instances", 0, "Most instances in a job, or 0 for no limit")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if members != "" {
+		request.Members = strings.Split(members, ",")
+	}
+
+	project, err := c.AddProject(ctx, request)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Added project %d\n", project.ID)
+	return nil
+}
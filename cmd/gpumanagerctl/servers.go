@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/LCLS/GPUManager/api"
+	"github.com/LCLS/GPUManager/client"
+	"golang.org/x/term"
+)
+
+func serversList(ctx context.Context, c *client.Client, args []string) error {
+	servers, err := c.Servers(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := table()
+	fmt.Fprintln(w, "ID\tURL\tDIRECTORY\tENABLED\tGPUS IN USE")
+	for _, server := range servers {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%t\t%d/%d\n", server.ID, server.URL, server.WorkingDirectory, server.Enabled, server.InUse, len(server.Resources))
+	}
+	return w.Flush()
+}
+
+func serversAdd(ctx context.Context, c *client.Client, args []string) error {
+	var request api.ServerRequest
+
+	flags := flag.NewFlagSet("servers add", flag.ContinueOnError)
+	flags.StringVar(&request.URL, "url", "", "Host name of the server")
+	flags.StringVar(&request.Username, "user", "", "User to log in as")
+	flags.StringVar(&request.WorkingDirectory, "wdir", "", "Directory to run simulations in")
+	setup := flags.String("setup", "", "Shell commands run before every instance, instead of sourcing ~/.bash_profile")
+	env := envFlag{}
+	flags.Var(env, "env", "Environment variable to set for every instance, as NAME=VALUE. May be repeated.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "setup" {
+			request.Setup = setup
+		}
+	})
+	if len(env) > 0 {
+		request.Env = env
+	}
+
+	password, err := readPassword(request.Username, request.URL)
+	if err != nil {
+		return err
+	}
+	request.Password = password
+
+	server, err := c.AddServer(ctx, request)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Added server %d with %d GPUs\n", server.ID, len(server.Resources))
+	return nil
+}
+
+// serversEdit changes the settings of a server given as flags. The manager
+// checks that it can connect with them before saving them.
+func serversEdit(ctx context.Context, c *client.Client, args []string) error {
+	var update api.ServerUpdate
+	var changePassword bool
+
+	flags := flag.NewFlagSet("servers edit", flag.ContinueOnError)
+	url := flags.String("url", "", "New host name of the server")
+	username := flags.String("user", "", "New user to log in as")
+	wdir := flags.String("wdir", "", "New directory to run simulations in")
+	flags.BoolVar(&changePassword, "password", false, "Change the password")
+	setup := flags.String("setup", "", "New shell commands run before every instance")
+	env := envFlag{}
+	flags.Var(env, "env", "Environment variable to set for every instance, as NAME=VALUE. May be repeated, and replaces all the variables of the server.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	id, err := argID(flags.Args(), "server ID")
+	if err != nil {
+		return err
+	}
+
+	// Only the flags that were given are changed
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "url":
+			update.URL = url
+		case "user":
+			update.Username = username
+		case "wdir":
+			update.WorkingDirectory = wdir
+		case "setup":
+			update.Setup = setup
+		case "env":
+			update.Env = env
+		}
+	})
+
+	if changePassword {
+		server, err := c.Server(ctx, id)
+		if err != nil {
+			return err
+		}
+		if update.URL != nil {
+			server.URL = *update.URL
+		}
+		if update.Username != nil {
+			server.Username = *update.Username
+		}
+
+		password, err := readPassword(server.Username, server.URL)
+		if err != nil {
+			return err
+		}
+		update.Password = &password
+	}
+
+	server, err := c.UpdateServer(ctx, id, update)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Updated server %d, %s@%s:%s\n", server.ID, server.Username, server.URL, server.WorkingDirectory)
+	return nil
+}
+
+// envFlag collects NAME=VALUE flags into environment variables
+type envFlag map[string]string
+
+func (e envFlag) String() string {
+	return fmt.Sprint(map[string]string(e))
+}
+
+func (e envFlag) Set(value string) error {
+	name, value, ok := strings.Cut(value, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("expected NAME=VALUE")
+	}
+	e[name] = value
+	return nil
+}
+
+// readPassword returns $GPUMANAGER_PASSWORD, or asks for the password of the
+// user on the host
+func readPassword(username, host string) (string, error) {
+	if password := os.Getenv("GPUMANAGER_PASSWORD"); password != "" {
+		return password, nil
+	}
+
+	fmt.Fprintf(os.Stderr, "Password for %s@%s: ", username, host)
+	password, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	return string(password), err
+}
+
+func serversRescan(ctx context.Context, c *client.Client, args []string) error {
+	id, err := argID(args, "server ID")
+	if err != nil {
+		return err
+	}
+
+	rescan, err := c.RescanServer(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	w := table()
+	fmt.Fprintln(w, "CHANGE\tDEVICE\tNAME\tUUID")
+	for _, resource := range rescan.Added {
+		fmt.Fprintf(w, "added\t%d\t%s\t%s\n", resource.DeviceID, resource.Name, resource.UUID)
+	}
+	for _, resource := range rescan.Retired {
+		fmt.Fprintf(w, "retired\t%d\t%s\t%s\n", resource.DeviceID, resource.Name, resource.UUID)
+	}
+	for _, change := range rescan.Renumbered {
+		fmt.Fprintf(w, "renumbered\t%d -> %d\t%s\t%s\n", change.From, change.To, change.Name, change.UUID)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Printf("%d GPUs on %s\n", len(rescan.Server.Resources), rescan.Server.URL)
+	return nil
+}
+
+func serversProbe(ctx context.Context, c *client.Client, args []string) error {
+	id, err := argID(args, "server ID")
+	if err != nil {
+		return err
+	}
+
+	probe, err := c.ProbeServer(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	w := table()
+	fmt.Fprintln(w, "CHECK\tPASSED\tVALUE\tERROR")
+	for _, check := range probe.Checks {
+		fmt.Fprintf(w, "%s\t%t\t%s\t%s\n", check.Name, check.Passed, check.Value, check.Error)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if !probe.Passed {
+		return fmt.Errorf("server %d failed its probe", id)
+	}
+	return nil
+}
+
+func serversDrain(ctx context.Context, c *client.Client, args []string) error {
+	return setDraining(ctx, c, args, true)
+}
+
+func serversUndrain(ctx context.Context, c *client.Client, args []string) error {
+	return setDraining(ctx, c, args, false)
+}
+
+func setDraining(ctx context.Context, c *client.Client, args []string, draining bool) error {
+	id, err := argID(args, "server ID")
+	if err != nil {
+		return err
+	}
+
+	server, err := c.UpdateServer(ctx, id, api.ServerUpdate{Draining: &draining})
+	if err != nil {
+		return err
+	}
+
+	switch server.Maintenance {
+	case api.MaintenanceDraining:
+		fmt.Printf("%s is draining, %d instances still running\n", server.URL, server.InUse)
+	case api.MaintenanceReady:
+		fmt.Printf("%s is ready for maintenance\n", server.URL)
+	default:
+		fmt.Printf("%s is accepting instances\n", server.URL)
+	}
+	return nil
+}
+
+// serversRemove removes a server. Without -force the server must have been
+// drained first.
+func serversRemove(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("servers remove", flag.ContinueOnError)
+	force := flags.Bool("force", false, "Kill the instances running on the server and queue them again")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	id, err := argID(flags.Args(), "server ID")
+	if err != nil {
+		return err
+	}
+
+	if err := c.DeleteServer(ctx, id, *force); err != nil {
+		return err
+	}
+
+	fmt.Printf("Removed server %d\n", id)
+	return nil
+}
+
+func resourcesList(ctx context.Context, c *client.Client, args []string) error {
+	resources, err := c.Resources(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := table()
+	fmt.Fprintln(w, "SERVER\tDEVICE\tNAME\tUUID\tENABLED\tIN USE")
+	for _, resource := range resources {
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%t\t%t\n", resource.ServerID, resource.DeviceID, resource.Name, resource.UUID, resource.Enabled, resource.InUse)
+	}
+	return w.Flush()
+}
+
+func resourcesEnable(ctx context.Context, c *client.Client, args []string) error {
+	return setResourceEnabled(ctx, c, args, true)
+}
+
+func resourcesDisable(ctx context.Context, c *client.Client, args []string) error {
+	return setResourceEnabled(ctx, c, args, false)
+}
+
+func setResourceEnabled(ctx context.Context, c *client.Client, args []string, enabled bool) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected GPU UUID")
+	}
+
+	resource, err := c.UpdateResource(ctx, args[0], api.ResourceUpdate{Enabled: &enabled})
+	if err != nil {
+		return err
+	}
+
+	state := "disabled"
+	if resource.Enabled {
+		state = "enabled"
+	}
+	fmt.Printf("%s %s\n", resource.UUID, state)
+	return nil
+}
+
+func maintenanceList(ctx context.Context, c *client.Client, args []string) error {
+	windows, err := c.MaintenanceWindows(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := table()
+	fmt.Fprintln(w, "ID\tSERVER\tSTART\tEND\tREASON")
+	for _, window := range windows {
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\n", window.ID, window.ServerID, window.Start.Local().Format(time.RFC3339), window.End.Local().Format(time.RFC3339), window.Reason)
+	}
+	return w.Flush()
+}
+
+func maintenanceAdd(ctx context.Context, c *client.Client, args []string) error {
+	var request api.MaintenanceRequest
+	var start, end string
+
+	flags := flag.NewFlagSet("maintenance add", flag.ContinueOnError)
+	flags.IntVar(&request.ServerID, "server", 0, "ID of the server")
+	flags.StringVar(&start, "start", "", "Start of the window")
+	flags.StringVar(&end, "end", "", "End of the window")
+	flags.StringVar(&request.Reason, "reason", "", "What the maintenance is for")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var err error
+	if request.Start, err = time.Parse(time.RFC3339, start); err != nil {
+		return fmt.Errorf("invalid start %q", start)
+	}
+	if request.End, err = time.Parse(time.RFC3339, end); err != nil {
+		return fmt.Errorf("invalid end %q", end)
+	}
+
+	window, err := c.AddMaintenance(ctx, request)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Scheduled maintenance window %d\n", window.ID)
+	return nil
+}
+
+func maintenanceRemove(ctx context.Context, c *client.Client, args []string) error {
+	id, err := argID(args, "maintenance window ID")
+	if err != nil {
+		return err
+	}
+	return c.DeleteMaintenance(ctx, id)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/LCLS/GPUManager/client"
+	"golang.org/x/term"
+)
+
+// login creates an API token with a user name and password and prints it
+// for the shell to export
+func login(ctx context.Context, c *client.Client, args []string) error {
+	var username string
+
+	flags := flag.NewFlagSet("login", flag.ContinueOnError)
+	flags.StringVar(&username, "user", os.Getenv("USER"), "User to log in as")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Password for %s: ", username)
+	password, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return err
+	}
+
+	if _, err := c.Login(ctx, username, string(password)); err != nil {
+		return err
+	}
+
+	hostname, _ := os.Hostname()
+	token, err := c.CreateToken(ctx, fmt.Sprintf("gpumanagerctl on %s", hostname))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("export GPUMANAGER_TOKEN=%s\n", token.Secret)
+	return nil
+}
+
+func tokensList(ctx context.Context, c *client.Client, args []string) error {
+	tokens, err := c.Tokens(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := table()
+	fmt.Fprintln(w, "ID\tNAME\tCREATED\tLAST USED")
+	for _, token := range tokens {
+		lastUsed := "never"
+		if token.LastUsed != nil {
+			lastUsed = token.LastUsed.Format(time.DateTime)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", token.ID, token.Name, token.Created.Format(time.DateTime), lastUsed)
+	}
+	return w.Flush()
+}
+
+func tokensCreate(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected token name")
+	}
+
+	token, err := c.CreateToken(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(token.Secret)
+	return nil
+}
+
+func tokensRemove(ctx context.Context, c *client.Client, args []string) error {
+	id, err := argID(args, "token ID")
+	if err != nil {
+		return err
+	}
+	return c.DeleteToken(ctx, id)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/LCLS/GPUManager/client"
+)
+
+func modelsList(ctx context.Context, c *client.Client, args []string) error {
+	models, err := c.Models(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := table()
+	fmt.Fprintln(w, "ID\tNAME\tREVISION\tFILES")
+	for _, model := range models {
+		fmt.Fprintf(w, "%d\t%s\t%d\t%s\n", model.ID, model.Name, model.Revision, strings.Join(model.Files, ", "))
+	}
+	return w.Flush()
+}
+
+// modelsUpload uploads every file in a local directory as a model
+func modelsUpload(ctx context.Context, c *client.Client, args []string) error {
+	var project string
+
+	flags := flag.NewFlagSet("models upload", flag.ContinueOnError)
+	flags.StringVar(&project, "project", "", "Project the model belongs to")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	args = flags.Args()
+	if len(args) != 2 {
+		return fmt.Errorf("expected model name and directory")
+	}
+
+	entries, err := os.ReadDir(args[1])
+	if err != nil {
+		return err
+	}
+
+	files := make(map[string]io.Reader)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		file, err := os.Open(filepath.Join(args[1], entry.Name()))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		files[entry.Name()] = file
+	}
+
+	if len(files) == 0 {
+		return fmt.Errorf("no files in %s", args[1])
+	}
+
+	model, err := c.CreateModel(ctx, args[0], project, files)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Added model %d revision %d with %d files\n", model.ID, model.Revision, len(model.Files))
+	return nil
+}
+
+func templatesList(ctx context.Context, c *client.Client, args []string) error {
+	templates, err := c.Templates(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := table()
+	fmt.Fprintln(w, "ID\tNAME\tREVISION\tEXECUTABLE\tCONTAINER")
+	for _, template := range templates {
+		fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%s\n", template.ID, template.Name, template.Revision, template.Executable, template.Container)
+	}
+	return w.Flush()
+}
+
+func templatesUpload(ctx context.Context, c *client.Client, args []string) error {
+	var project, container string
+
+	flags := flag.NewFlagSet("templates upload", flag.ContinueOnError)
+	flags.StringVar(&project, "project", "", "Project the template belongs to")
+	flags.StringVar(&container, "container", "", "Container image to run the template in, a SIF file or a reference such as docker://IMAGE")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	args = flags.Args()
+	if len(args) != 2 {
+		return fmt.Errorf("expected template name and file")
+	}
+
+	file, err := os.Open(args[1])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	template, err := c.CreateTemplate(ctx, args[0], project, container, filepath.Base(args[1]), file)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Added template %d revision %d\n", template.ID, template.Revision)
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/LCLS/GPUManager/api"
+)
+
+// Number of events a subscriber may fall behind by before it is dropped
+const eventBuffer = 256
+
+// Broker fans the events of the manager out to the subscribers of the event
+// stream. Publishing never blocks, so it is safe with the manager lock held.
+type Broker struct {
+	mu          sync.Mutex
+	next        int64
+	closed      bool
+	subscribers map[*Subscription]struct{}
+}
+
+// Subscription receives the events for a job or server, or every event if
+// both are zero. C is closed if the subscriber falls too far behind or the
+// broker is closed; events are not replayed, so it should reload its state
+// after subscribing again.
+type Subscription struct {
+	C <-chan api.Event
+
+	c           chan api.Event
+	job, server int
+}
+
+func NewBroker() *Broker {
+	return &Broker{subscribers: make(map[*Subscription]struct{})}
+}
+
+func (s *Subscription) matches(event api.Event) bool {
+	return (s.job == 0 || event.JobID == s.job) && (s.server == 0 || event.ServerID == s.server)
+}
+
+func (b *Broker) Subscribe(job, server int) *Subscription {
+	c := make(chan api.Event, eventBuffer)
+	sub := &Subscription{C: c, c: c, job: job, server: server}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		close(c)
+		return sub
+	}
+	b.subscribers[sub] = struct{}{}
+	return sub
+}
+
+func (b *Broker) Unsubscribe(sub *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subscribers[sub]; ok {
+		delete(b.subscribers, sub)
+		close(sub.c)
+	}
+}
+
+// Publish sends an event to every subscriber it matches
+func (b *Broker) Publish(eventType string, job, server int, data interface{}) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		log.Println("[Events] Unable to encode", eventType, ":", err)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.next += 1
+	event := api.Event{ID: b.next, Type: eventType, JobID: job, ServerID: server, Data: encoded}
+	for sub := range b.subscribers {
+		if !sub.matches(event) {
+			continue
+		}
+
+		select {
+		case sub.c <- event:
+		default:
+			delete(b.subscribers, sub)
+			close(sub.c)
+		}
+	}
+}
+
+// Close ends every subscription so that the streams serving them finish
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for sub := range b.subscribers {
+		delete(b.subscribers, sub)
+		close(sub.c)
+	}
+}
+
+// The publish methods below send the current state of what changed. They
+// must be called with the manager lock held.
+
+func (m *Manager) publishInstance(instance *JobInstance) {
+	state := instance.API()
+	m.events.Publish(api.EventInstance, state.JobID, state.ServerID, state)
+}
+
+func (m *Manager) publishJob(job *Job) {
+	m.events.Publish(api.EventJob, job.ID, 0, job.API())
+}
+
+// publishResource also publishes its server, whose count of GPUs in use
+// has changed with it
+func (m *Manager) publishResource(r *Resource) {
+	m.events.Publish(api.EventResource, 0, r.Parent.ID, r.API())
+	m.publishServer(r.Parent)
+}
+
+func (m *Manager) publishServer(server *Server) {
+	m.events.Publish(api.EventServer, 0, server.ID, server.API())
+}
+
+// apiEvents streams events as Server-Sent Events until the client goes
+// away or the manager shuts down
+func (m *Manager) apiEvents(w http.ResponseWriter, r *http.Request) {
+	job, err := queryID(r, "job")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	server, err := queryID(r, "server")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	sub := m.events.Subscribe(job, server)
+	defer m.events.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	flusher := http.NewResponseController(w)
+	fmt.Fprint(w, ": connected\n\n")
+	if err := flusher.Flush(); err != nil {
+		return
+	}
+
+	// Comments keep proxies from closing an idle stream
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case event, ok := <-sub.C:
+			if !ok {
+				return
+			}
+
+			data, err := json.Marshal(event)
+			if err != nil {
+				log.Println("[Events] Error:", err)
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+
+		if err := flusher.Flush(); err != nil {
+			return
+		}
+	}
+}
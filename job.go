@@ -2,35 +2,126 @@ package main
 
 import (
 	"database/sql"
-	"encoding/json"
+	"fmt"
+	"log"
 	"net/http"
-	"strconv"
-	"text/template"
+	"strings"
+
+	"github.com/LCLS/GPUManager/api"
+	"gopkg.in/yaml.v3"
 )
 
 type Job struct {
 	ID        int
 	Name      string
+	Owner     string
+	Project   string
 	Model     Model
 	Template  Template
-	Instances []JobInstance
+	Instances []*JobInstance
+
+	// Spec is the job specification exactly as it was submitted, and Config
+	// is what was read from it. Both are empty for jobs created without one.
+	Spec   string
+	Config api.JobSpec
 }
 
-func (j *Job) Complete() int {
-	retVal := 0
-	for _, instance := range j.Instances {
-		if instance.Completed {
-			retVal += 1
+// Container returns the image instances of the job are run in, if any. The
+// job specification may name one instead of that of the template.
+func (j *Job) Container() string {
+	if j.Config.Container != "" {
+		return j.Config.Container
+	}
+	return j.Template.Container
+}
+
+// RemapDevices reports whether the instance only sees its own GPU, which
+// templates are given as device 0. Otherwise it sees every GPU of the server,
+// in the order of their indexes there, and templates are given the index of
+// its GPU there.
+func (j *Job) RemapDevices() bool {
+	return j.Config.RemapDevices == nil || *j.Config.RemapDevices
+}
+
+// MaxAttempts returns the number of times an instance of the job is tried
+// before it is marked as failed
+func (j *Job) MaxAttempts() int {
+	if j.Config.Retry.Attempts > 0 {
+		return j.Config.Retry.Attempts
+	}
+	return MaxAttempts
+}
+
+// Accepts reports whether the constraints of the job allow its instances to
+// run on the resource
+func (j *Job) Accepts(r *Resource) bool {
+	constraints := j.Config.Constraints
+	if constraints.GPU != "" && !strings.Contains(strings.ToLower(r.Name), strings.ToLower(constraints.GPU)) {
+		return false
+	}
+
+	if len(constraints.Servers) == 0 {
+		return true
+	}
+	for _, url := range constraints.Servers {
+		if url == r.Parent.URL {
+			return true
 		}
 	}
-	return retVal
+	return false
+}
+
+// UsesArchive reports whether results of the job are copied to the archive
+func (j *Job) UsesArchive(archive *Archive) bool {
+	if len(j.Config.Archives) == 0 {
+		return true
+	}
+	for _, url := range j.Config.Archives {
+		if url == archive.URL {
+			return true
+		}
+	}
+	return false
+}
+
+// Copy returns a copy of the job whose instances are not shared with the
+// original
+func (j *Job) Copy() Job {
+	job := *j
+	job.Instances = make([]*JobInstance, len(j.Instances))
+	for i, instance := range j.Instances {
+		copied := *instance
+		job.Instances[i] = &copied
+	}
+	return job
 }
 
 type JobInstance struct {
-	ID, PID   int
-	Completed bool
-	Parent    *Job      `json:"-"`
-	Resource  *Resource `json:"-"`
+	ID, PID           int
+	Completed, Failed bool
+	Cancelled         bool
+	Archived          bool
+	Attempts          int
+	Error             string
+	ImageDigest       string
+	Parent            *Job      `json:"-"`
+	Resource          *Resource `json:"-"`
+}
+
+// Save writes the state of the instance back to the database
+func (i *JobInstance) Save() error {
+	resource := ""
+	if i.Resource != nil {
+		resource = i.Resource.UUID
+	}
+
+	_, err := DB.Exec("update job_instance set pid = ?, resource_id = ?, completed = ?, archived = ?, attempts = ?, failed = ?, error = ?, cancelled = ?, image_digest = ? where id = ?", i.PID, resource, i.Completed, i.Archived, i.Attempts, i.Failed, i.Error, i.Cancelled, i.ImageDigest, i.ID)
+	return err
+}
+
+// Directory returns the path of the instance relative to the job directory
+func (i *JobInstance) Directory() string {
+	return strings.ToLower(fmt.Sprintf("%s/%d", i.Parent.Name, i.NumberInSequence()))
 }
 
 // Finds which job out of the maximum number this instance is
@@ -38,51 +129,69 @@ func (i *JobInstance) NumberInSequence() int {
 	return i.ID - i.Parent.Instances[0].ID
 }
 
-var Jobs []Job
-
-func FindJob(id int, jobs []Job) *Job {
+func FindJob(id int, jobs []*Job) *Job {
 	for i := 0; i < len(jobs); i++ {
 		if jobs[i].ID == id {
-			return &jobs[i]
+			return jobs[i]
+		}
+	}
+	return nil
+}
+
+func FindInstance(id int, jobs []*Job) *JobInstance {
+	for _, job := range jobs {
+		for _, instance := range job.Instances {
+			if instance.ID == id {
+				return instance
+			}
 		}
 	}
 	return nil
 }
 
-func LoadJobs(db *sql.DB) ([]Job, error) {
-	var jobs []Job
+func LoadJobs(db *sql.DB, models []Model, templates []Template, servers []*Server) ([]*Job, error) {
+	var jobs []*Job
 
-	rows, err := DB.Query("SELECT id, name, model_id, template_id FROM job")
+	rows, err := db.Query("SELECT id, name, owner, project, model_id, template_id, spec FROM job")
 	if err != nil {
 		return nil, err
 	}
 
 	for rows.Next() {
-		var job Job
+		job := &Job{}
 		var model_id, template_id int
-		if err := rows.Scan(&job.ID, &job.Name, &model_id, &template_id); err != nil {
+		if err := rows.Scan(&job.ID, &job.Name, &job.Owner, &job.Project, &model_id, &template_id, &job.Spec); err != nil {
 			return nil, err
 		}
-		job.Model = *FindModel(model_id, Models)
-		job.Template = *FindTemplate(template_id, Templates)
+		if job.Spec != "" {
+			if job.Config, err = api.ParseJobSpec([]byte(job.Spec)); err != nil {
+				log.Println("[Job]", job.ID, "invalid spec:", err)
+			}
+		}
+		if model := FindModel(model_id, models); model != nil {
+			job.Model = *model
+		}
+		if template := FindTemplate(template_id, templates); template != nil {
+			job.Template = *template
+		}
 
 		jobs = append(jobs, job)
 	}
 	rows.Close()
 
 	for i := 0; i < len(jobs); i++ {
-		rows, err := DB.Query("SELECT id, completed, pid, resource_id FROM job_instance WHERE job_id = ?", jobs[i].ID)
+		rows, err := db.Query("SELECT id, completed, pid, resource_id, archived, attempts, failed, error, cancelled, image_digest FROM job_instance WHERE job_id = ?", jobs[i].ID)
 		if err != nil {
 			return nil, err
 		}
 
 		for rows.Next() {
 			var res_id string
-			instance := JobInstance{Parent: &jobs[i]}
-			if err := rows.Scan(&instance.ID, &instance.Completed, &instance.PID, &res_id); err != nil {
+			instance := &JobInstance{Parent: jobs[i]}
+			if err := rows.Scan(&instance.ID, &instance.Completed, &instance.PID, &res_id, &instance.Archived, &instance.Attempts, &instance.Failed, &instance.Error, &instance.Cancelled, &instance.ImageDigest); err != nil {
 				return nil, err
 			}
-			instance.Resource = FindServerResource(res_id, Servers)
+			instance.Resource = FindServerResource(res_id, servers)
 			jobs[i].Instances = append(jobs[i].Instances, instance)
 		}
 		rows.Close()
@@ -91,165 +200,231 @@ func LoadJobs(db *sql.DB) ([]Job, error) {
 	return jobs, nil
 }
 
-func jobHandler(w http.ResponseWriter, r *http.Request) {
-	type JSONResponse struct {
-		Success bool   `json:"success"`
-		Message string `json:"message"`
-	}
-
-	funcMap := template.FuncMap{
-		"count": func(in []JobInstance) int {
-			return len(in)
-		},
-		"complete": func(in Job) int {
-			return in.Complete()
-		},
-		"running": func(in Job) int {
-			running := 0
-			for _, job := range in.Instances {
-				if job.PID != -1 && !job.Completed {
-					running++
-				}
-			}
-			return running
-		},
-		"percent": func(in Job) float32 {
-			return float32((float64(in.Complete()) / float64(len(in.Instances))) * 100.0)
-		},
-		"run_percent": func(in Job) float32 {
-			running := 0
-			for _, job := range in.Instances {
-				if job.PID != -1 && !job.Completed {
-					running++
-				}
-			}
-			return float32((float64(running) / float64(len(in.Instances))) * 100.0)
-		},
+// API returns the representation of the job used by the JSON API. It must be
+// called with the manager lock held or on a copy of the job.
+func (j *Job) API() api.Job {
+	job := api.Job{ID: j.ID, Name: j.Name, Owner: j.Owner, Project: j.Project, ModelID: j.Model.ID, Model: j.Model.Name, ModelRevision: j.Model.Revision, TemplateID: j.Template.ID, Template: j.Template.Name, TemplateRevision: j.Template.Revision, Count: len(j.Instances)}
+	for _, instance := range j.Instances {
+		switch instance.State() {
+		case api.StateQueued:
+			job.Queued += 1
+		case api.StateRunning:
+			job.Running += 1
+		case api.StateCompleted:
+			job.Completed += 1
+		case api.StateFailed:
+			job.Failed += 1
+		case api.StateCancelled:
+			job.Cancelled += 1
+		}
 	}
+	return job
+}
 
-	t, err := template.New("job.html").Funcs(funcMap).ParseFiles("job.html")
-	if err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
-		return
+// State summarises the progress of the instance
+func (i *JobInstance) State() string {
+	switch {
+	case i.Cancelled:
+		return api.StateCancelled
+	case i.Failed:
+		return api.StateFailed
+	case i.Completed:
+		return api.StateCompleted
+	case i.PID != -1:
+		return api.StateRunning
 	}
+	return api.StateQueued
+}
 
-	type JobData struct {
-		Models    []Model
-		Templates []Template
-		Jobs      []Job
+// API returns the representation of the instance used by the JSON API. It
+// must be called with the manager lock held or on a copy of the instance.
+func (i *JobInstance) API() api.Instance {
+	instance := api.Instance{ID: i.ID, JobID: i.Parent.ID, Number: i.NumberInSequence(), State: i.State(), PID: i.PID, Archived: i.Archived, Attempts: i.Attempts, Error: i.Error, ImageDigest: i.ImageDigest}
+	if i.Resource != nil {
+		instance.Resource = i.Resource.UUID
+		instance.ServerID = i.Resource.Parent.ID
 	}
+	return instance
+}
 
-	data := JobData{Models: Models, Templates: Templates, Jobs: Jobs}
-	if err := t.Execute(w, data); err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
-		return
-	}
+func (m *Manager) jobHandler(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, "job.html")
 }
 
-func jobAddHandler(w http.ResponseWriter, r *http.Request) {
-	type JSONResponse struct {
-		Success bool   `json:"success"`
-		Message string `json:"message"`
-		Job     Job    `json:"job"`
+// CreateJob records a job and queues its instances
+func (m *Manager) CreateJob(request api.JobRequest, user User) (*Job, error) {
+	if request.Name == "" || request.Count <= 0 {
+		return nil, ErrMissingData
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	project, err := m.ResolveProject(user, request.Project)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.checkJobProject(project, request.Count); err != nil {
+		return nil, err
+	}
 
-	name := r.FormValue("name")
+	model, ok := m.FindModel(request.ModelID)
+	if !ok {
+		return nil, &RequestError{http.StatusBadRequest, "Unknown Model"}
+	}
 
-	model_id, err := strconv.Atoi(r.FormValue("model"))
-	if err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
-		return
+	template, ok := m.FindTemplate(request.TemplateID)
+	if !ok {
+		return nil, &RequestError{http.StatusBadRequest, "Unknown Template"}
 	}
 
-	template_id, err := strconv.Atoi(r.FormValue("template"))
+	job := &Job{Name: request.Name, Owner: user.Name, Project: project, Model: model, Template: template}
+	if err := m.insertJob(job, request.Count); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// CreateJobFromSpec validates a YAML or JSON job specification, resolves the
+// model, template and archives it names, and creates the job it describes.
+// The specification is stored as it was given.
+func (m *Manager) CreateJobFromSpec(spec []byte, user User) (*Job, error) {
+	config, err := api.ParseJobSpec(spec)
 	if err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
-		return
+		return nil, &RequestError{http.StatusBadRequest, "Invalid Spec: " + err.Error()}
 	}
 
-	count, err := strconv.Atoi(r.FormValue("count"))
+	project, err := m.ResolveProject(user, config.Project)
 	if err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
-		return
+		return nil, err
+	}
+	if err := m.checkJobProject(project, config.Count); err != nil {
+		return nil, err
 	}
 
-	if name == "" || count <= 0 {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: "Missing Data"})
-		return
+	model, ok := m.FindModelRevision(config.Model.Name, config.Model.Revision)
+	if !ok {
+		return nil, &RequestError{http.StatusBadRequest, "Unknown Model " + config.Model.String()}
 	}
 
-	var model string
-	if err := DB.QueryRow("SELECT name FROM model WHERE id = ?", model_id).Scan(&model); err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: "Model Name Find: " + err.Error()})
-		return
+	template, ok := m.FindTemplateRevision(config.Template.Name, config.Template.Revision)
+	if !ok {
+		return nil, &RequestError{http.StatusBadRequest, "Unknown Template " + config.Template.String()}
 	}
 
-	job := Job{Name: name, Model: *FindModel(model_id, Models), Template: *FindTemplate(template_id, Templates)}
+	for _, url := range config.Archives {
+		found := false
+		for _, archive := range m.Archives() {
+			if archive.URL == url {
+				found = true
+			}
+		}
+		if !found {
+			return nil, &RequestError{http.StatusBadRequest, "Unknown Archive " + url}
+		}
+	}
 
-	res, err := DB.Exec("insert into job(name, model_id, template_id, count) values (?,?,?,?)", job.Name, model_id, template_id, count)
+	job := &Job{Name: config.Name, Owner: user.Name, Project: project, Model: model, Template: template, Spec: string(spec), Config: config}
+	if err := m.insertJob(job, config.Count); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// insertJob records a job with count instances and queues them
+func (m *Manager) insertJob(job *Job, count int) error {
+	res, err := DB.Exec("insert into job(name, owner, project, model_id, template_id, count, spec) values (?,?,?,?,?,?,?)", job.Name, job.Owner, job.Project, job.Model.ID, job.Template.ID, count, job.Spec)
 	if err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
-		return
+		return err
 	}
 
 	id, err := res.LastInsertId()
 	if err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
-		return
+		return err
 	}
 	job.ID = int(id)
 
 	for i := 0; i < count; i++ {
 		res, err := DB.Exec("insert into job_instance(job_id) values (?)", id)
 		if err != nil {
-			json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
-			return
+			return err
 		}
 
 		iid, err := res.LastInsertId()
 		if err != nil {
-			json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
-			return
+			return err
 		}
-		job.Instances = append(job.Instances, JobInstance{ID: int(iid), Completed: false, Parent: &job, PID: -1})
+		job.Instances = append(job.Instances, &JobInstance{ID: int(iid), Completed: false, Parent: job, PID: -1})
 	}
 
-	Jobs = append(Jobs, job)
+	m.AddJob(job)
+	return nil
+}
 
-	go func(job *Job) {
-		for i := 0; i < len(job.Instances); i++ {
-			JobQueue <- &job.Instances[i]
+// ExportSpec returns the specification of a job and its content type. Jobs
+// created from a specification return it verbatim, and for others one is
+// written that reproduces the job.
+func (j *Job) ExportSpec() ([]byte, string, error) {
+	if j.Spec != "" {
+		if strings.HasPrefix(strings.TrimSpace(j.Spec), "{") {
+			return []byte(j.Spec), "application/json", nil
 		}
-	}(&job)
+		return []byte(j.Spec), "application/yaml", nil
+	}
+
+	spec := api.JobSpec{
+		Name:     j.Name,
+		Project:  j.Project,
+		Model:    api.Ref{Name: j.Model.Name, Revision: j.Model.Revision},
+		Template: api.Ref{Name: j.Template.Name, Revision: j.Template.Revision},
+		Count:    len(j.Instances),
+	}
 
-	json.NewEncoder(w).Encode(JSONResponse{Success: true, Message: "", Job: job})
+	data, err := yaml.Marshal(spec)
+	return data, "application/yaml", err
 }
 
-func jobRemoveHandler(w http.ResponseWriter, r *http.Request) {
-	type JSONResponse struct {
-		Success bool   `json:"success"`
-		Message string `json:"message"`
+// DeleteJob removes a job and its instances. Instances that are already
+// running are left to finish.
+func (m *Manager) DeleteJob(id int) error {
+	res, err := DB.Exec("DELETE FROM job WHERE id = ?", id)
+	if err != nil {
+		return err
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-
-	id := r.FormValue("id")
-	if id == "" {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: "Missing Data"})
-		return
+	if count, err := res.RowsAffected(); err == nil && count == 0 {
+		return ErrNotFound
 	}
 
 	if _, err := DB.Exec("DELETE FROM job_instance WHERE job_id = ?", id); err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
-		return
+		return err
 	}
 
-	if _, err := DB.Exec("DELETE FROM job WHERE id = ?", id); err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
-		return
+	m.RemoveJob(id)
+	return nil
+}
+
+// CancelJob stops a job. Instances that have not started are dropped from
+// the queue, and running ones are killed by their resource at its next check
+// and then archived as usual.
+func (m *Manager) CancelJob(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job := FindJob(id, m.jobs)
+	if job == nil {
+		return ErrNotFound
+	}
+
+	for _, instance := range job.Instances {
+		if instance.Completed || instance.Failed || instance.Cancelled {
+			continue
+		}
+
+		instance.Cancelled = true
+		if err := instance.Save(); err != nil {
+			return err
+		}
+		m.publishInstance(instance)
 	}
 
-	json.NewEncoder(w).Encode(JSONResponse{Success: true})
+	m.publishJob(job)
+	return nil
 }
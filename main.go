@@ -1,21 +1,36 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/LCLS/GPUManager/api"
 	_ "github.com/mattn/go-sqlite3"
 )
 
 var DB *sql.DB
-var JobQueue chan *JobInstance
 
 func main() {
 	log.SetFlags(log.Lshortfile | log.LstdFlags)
 	port := flag.Int("port", 8080, "HTTP Server Port")
+	shutdown := flag.Duration("shutdown", 5*time.Minute, "Time to wait for transfers to finish when shutting down")
+	httpShutdown := flag.Duration("http-shutdown", 30*time.Second, "Time to wait for API requests to finish when shutting down")
+	flag.IntVar(&MaxAttempts, "attempts", MaxAttempts, "Number of attempts before an instance is marked as failed")
+	flag.DurationVar(&TelemetryInterval, "telemetry", TelemetryInterval, "Time between GPU telemetry samples")
+	flag.DurationVar(&MaintenanceLead, "maintenance-lead", MaintenanceLead, "How long before a maintenance window its server starts draining")
+	flag.IntVar(&ExternalMemoryPercent, "external-memory", ExternalMemoryPercent, "Percent of the memory of an idle GPU in use by others above which it is treated as occupied")
+	flag.IntVar(&ProbeMinDiskGB, "probe-min-disk", ProbeMinDiskGB, "Free space in GB the working directory of a server needs to pass its probe")
+	flag.Int64Var(&LogMaxBytes, "log-max", LogMaxBytes, "Most bytes of an instance log returned at once")
+	flag.DurationVar(&TelemetryRetention, "telemetry-retention", TelemetryRetention, "Time GPU telemetry is kept for")
 	flag.Parse()
 
 	var err error
@@ -28,92 +43,105 @@ func main() {
 	http.Handle("/fonts/", http.StripPrefix("/fonts/", http.FileServer(http.Dir("./fonts/"))))
 	http.Handle("/css/", http.StripPrefix("/css/", http.FileServer(http.Dir("./css/"))))
 
-	http.HandleFunc("/", indexHandler)
-	http.HandleFunc("/server/add", serverAddHandker)
-	http.HandleFunc("/server/remove", serverRemoveHandler)
-	http.HandleFunc("/server/toggle", serverToggleHandler)
+	manager := NewManager()
 
-	http.HandleFunc("/job", jobHandler)
-	http.HandleFunc("/job/add", jobAddHandler)
-	http.HandleFunc("/job/remove", jobRemoveHandler)
+	http.HandleFunc("/", Require(api.RoleViewer, manager.indexHandler))
+	http.HandleFunc("/job", Require(api.RoleViewer, manager.jobHandler))
+	http.HandleFunc("/model", Require(api.RoleViewer, manager.modelHandler))
+	http.HandleFunc("/template", Require(api.RoleViewer, manager.templateHandler))
+	http.HandleFunc("/archive", Require(api.RoleViewer, manager.archiveHandler))
+	http.HandleFunc("/account", Require(api.RoleViewer, manager.accountHandler))
+	http.HandleFunc("/audit", Require(api.RoleAdmin, manager.auditHandler))
+	http.HandleFunc("/login", manager.loginHandler)
+	http.HandleFunc("/metrics", Require(api.RoleViewer, manager.metricsHandler))
 
-	http.HandleFunc("/model", modelHandler)
-	http.HandleFunc("/model/add", modelAddHandler)
-	http.HandleFunc("/model/remove", modelRemoveHandler)
+	manager.RegisterAPI(http.DefaultServeMux)
 
-	http.HandleFunc("/template", templateHandler)
-	http.HandleFunc("/template/add", templateAddHandler)
-	http.HandleFunc("/template/remove", templateRemoveHandler)
-
-	http.HandleFunc("/archive", archiveHandler)
-	http.HandleFunc("/archive/add", archiveAddHandler)
-
-	// Load Servers
-	servers, err := LoadServers(DB)
-	if err != nil {
-		log.Fatalln(err)
+	if err := EnsureAdmin(); err != nil {
+		log.Fatalln("[Auth] Error:", err)
 	}
-	Servers = servers
 
-	resources := 0
-	for _, server := range servers {
-		resources += len(server.Resources)
-	}
-	JobQueue = make(chan *JobInstance, resources)
-
-	// Load Archives
-	archives, err := LoadArchives(DB)
-	if err != nil {
+	// Load Servers, Archives, Models, Templates and Jobs
+	if err := manager.Load(DB); err != nil {
 		log.Fatalln(err)
 	}
-	Archives = archives
-
-	for i := 0; i < len(Archives); i++ {
-		Archives[i].Connect()
-	}
 
-	// Load Models
-	models, err := LoadModels(DB)
-	if err != nil {
-		log.Fatalln(err)
+	// Connect to everything at once, so that a host that cannot be reached
+	// only holds up startup for one timeout
+	var connecting sync.WaitGroup
+	for _, archive := range manager.Archives() {
+		connecting.Add(1)
+		go func() {
+			defer connecting.Done()
+			archive.Connect()
+		}()
 	}
-	Models = models
 
-	// Load Templates
-	templates, err := LoadTemplates(DB)
-	if err != nil {
-		log.Fatalln(err)
+	for _, server := range manager.Servers() {
+		connecting.Add(1)
+		go func() {
+			defer connecting.Done()
+			server.Connect()
+		}()
+		for _, resource := range server.Resources {
+			log.Println(server.URL, resource.Name, resource.UUID)
+		}
 	}
-	Templates = templates
+	connecting.Wait()
 
-	// Load Job Instances
-	jobs, err := LoadJobs(DB)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	Jobs = jobs
+	// Work out what happened to unfinished instances while we were stopped
+	manager.Reconcile()
+	manager.Start()
 
+	srv := &http.Server{Addr: fmt.Sprintf(":%d", *port), Handler: RequireLogin(http.DefaultServeMux)}
+	srv.RegisterOnShutdown(manager.events.Close)
 	go func() {
-		for _, job := range Jobs {
-			for i := 0; i < len(job.Instances); i++ {
-				if !job.Instances[i].Completed {
-					if job.Instances[i].Resource == nil {
-						JobQueue <- &job.Instances[i]
-					} else {
-						job.Instances[i].Resource.JobQueue <- &job.Instances[i]
-					}
-				}
-			}
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalln("[HTTP] Error:", err)
 		}
 	}()
 
-	for i := 0; i < len(Servers); i++ {
-		Servers[i].Connect()
-		for j := 0; j < len(Servers[i].Resources); j++ {
-			log.Println(Servers[i].URL, Servers[i].Resources[j])
-			go Servers[i].Resources[j].Handle()
-		}
+	// Wait for a signal to shut down
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	log.Println("[Shutdown] Received", <-signals)
+
+	go func() {
+		log.Fatalln("[Shutdown] Forced by", <-signals)
+	}()
+
+	gracefulShutdown(srv, manager, *httpShutdown, *shutdown)
+
+	for _, server := range manager.Servers() {
+		server.Disconnect()
+	}
+	for _, archive := range manager.Archives() {
+		archive.Disconnect()
 	}
+	DB.Close()
 
-	http.ListenAndServe(fmt.Sprintf(":%d", *port), nil)
+	log.Println("[Shutdown] Complete")
+}
+
+// gracefulShutdown stops dispatch first, so that nothing new starts while
+// requests finish and the logs being followed end. Requests are then given
+// httpTimeout to finish before their connections are closed, and transfers
+// are given timeout from when shutdown began.
+func gracefulShutdown(srv *http.Server, manager *Manager, httpTimeout, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	manager.Stop()
+
+	httpCtx, httpCancel := context.WithTimeout(context.Background(), httpTimeout)
+	defer httpCancel()
+
+	if err := srv.Shutdown(httpCtx); err != nil {
+		log.Println("[HTTP] Shutdown Error:", err)
+		srv.Close()
+	}
+
+	if err := manager.Shutdown(ctx); err != nil {
+		log.Println("[Shutdown] Error:", err)
+	}
 }
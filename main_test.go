@@ -0,0 +1,354 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/LCLS/GPUManager/api"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// newTestDB points DB at a new database in a temporary directory with every
+// migration applied, and restores it when the test ends. It must be called
+// before the test changes directory.
+func newTestDB(t *testing.T) {
+	t.Helper()
+	migrate(t, openTestDB(t), testMigrations(t))
+}
+
+// openTestDB points DB at a new, empty database in a temporary directory,
+// and restores it when the test ends
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "simulation.db")+"?cache=shared&mode=rwc&_busy_timeout=5000&_synchronous=OFF")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := DB
+	DB = db
+	t.Cleanup(func() {
+		DB = previous
+		db.Close()
+	})
+	return db
+}
+
+// testMigrations lists the migrations in the order they are applied
+func testMigrations(t *testing.T) []string {
+	t.Helper()
+
+	migrations, err := filepath.Glob("assets/db/migrations/*.sql")
+	if err != nil || len(migrations) == 0 {
+		t.Fatal("no migrations found", err)
+	}
+	sort.Strings(migrations)
+	return migrations
+}
+
+// migrate applies the Up section of each migration to db
+func migrate(t *testing.T, db *sql.DB, migrations []string) {
+	t.Helper()
+
+	for _, migration := range migrations {
+		data, err := os.ReadFile(migration)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, up, _ := strings.Cut(string(data), "-- +goose Up")
+		up, _, _ = strings.Cut(up, "-- +goose Down")
+		if _, err := db.Exec(up); err != nil {
+			t.Fatalf("%s: %s", filepath.Base(migration), err)
+		}
+	}
+}
+
+// newTestJob adds a job of count instances that run script, to the database
+// and the manager, and queues them. Its template is data/sim.py and its model
+// data/lysozyme.
+func newTestJob(t *testing.T, m *Manager, id int, name, script string, count int) *Job {
+	t.Helper()
+
+	job := &Job{ID: id, Name: name, Owner: "admin", Model: Model{ID: 1, Name: "lysozyme", Revision: 1, Files: []string{"input.pdb"}}, Template: Template{ID: 1, Name: "sim", Revision: 1, File: "data/sim.py"}}
+	job.Config.Parameters = map[string]interface{}{"script": script}
+
+	if _, err := DB.Exec("insert into job(id, name, model_id, template_id, count) values (?, ?, 1, 1, ?)", job.ID, job.Name, count); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < count; i++ {
+		instance := id*1000 + i
+		if _, err := DB.Exec("insert into job_instance(id, job_id) values (?, ?)", instance, job.ID); err != nil {
+			t.Fatal(err)
+		}
+		job.Instances = append(job.Instances, &JobInstance{ID: instance, PID: -1, Parent: job})
+	}
+
+	m.AddJob(job)
+	return job
+}
+
+// TestGracefulShutdown checks that a log being followed and a stream of
+// events do not hold up shutdown
+func TestGracefulShutdown(t *testing.T) {
+	f := newTestFarm(t)
+	_, tokens := testUsers(t, map[string]string{"admin": api.RoleAdmin})
+
+	job := f.addJob(t, "followed", "echo done", 1)
+	instance := job.Instances[0]
+	f.m.mu.Lock()
+	instance.PID = 1
+	instance.Resource = f.resource
+	f.m.mu.Unlock()
+	directory := filepath.Join(f.server.WorkingDirectory, "job", instance.Directory())
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(directory, "log.txt"), []byte("step 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	f.m.RegisterAPI(mux)
+	ts := httptest.NewServer(RequireLogin(mux))
+	ts.Config.RegisterOnShutdown(f.m.events.Close)
+	defer ts.Close()
+
+	var streams sync.WaitGroup
+	for _, path := range []string{fmt.Sprintf("/instances/%d/log?follow=true", instance.ID), "/events"} {
+		request, err := http.NewRequest("GET", ts.URL+api.Version+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("Authorization", "Bearer "+tokens["admin"])
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status %d", path, response.StatusCode)
+		}
+
+		streams.Add(1)
+		go func() {
+			defer streams.Done()
+			io.Copy(io.Discard, response.Body)
+			response.Body.Close()
+		}()
+	}
+
+	start := time.Now()
+	gracefulShutdown(ts.Config, f.m, 10*time.Second, 10*time.Second)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("shutdown took %s", elapsed)
+	}
+	streams.Wait()
+}
+
+// testServer is an SSH server on localhost that stands in for a compute
+// server or archive. Commands are run with bash on this machine and SFTP is
+// served from its file system. Failures are injected by naming commands
+// that should fail, or by refusing SFTP, and SFTP can be slowed down.
+type testServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+
+	// Added to the environment of every command
+	env []string
+
+	mu         sync.Mutex
+	failing    []string
+	refuseSFTP bool
+	sftpDelay  time.Duration
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	ts := &testServer{listener: listener, config: config}
+	go ts.serve()
+	return ts
+}
+
+// fail makes every command containing one of the fragments fail
+func (ts *testServer) fail(fragments ...string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.failing = fragments
+}
+
+func (ts *testServer) setRefuseSFTP(refuse bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.refuseSFTP = refuse
+}
+
+// setSFTPDelay pauses every read of a new SFTP session for delay
+func (ts *testServer) setSFTPDelay(delay time.Duration) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.sftpDelay = delay
+}
+
+// slowChannel pauses before every read
+type slowChannel struct {
+	ssh.Channel
+	delay time.Duration
+}
+
+func (c slowChannel) Read(p []byte) (int, error) {
+	time.Sleep(c.delay)
+	return c.Channel.Read(p)
+}
+
+// dial opens a client connection to the server
+func (ts *testServer) dial(t *testing.T) *ssh.Client {
+	t.Helper()
+
+	client, err := ssh.Dial("tcp", ts.listener.Addr().String(), &ssh.ClientConfig{User: "test", HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func (ts *testServer) serve() {
+	for {
+		conn, err := ts.listener.Accept()
+		if err != nil {
+			return
+		}
+		go ts.handle(conn)
+	}
+}
+
+func (ts *testServer) handle(conn net.Conn) {
+	_, channels, requests, err := ssh.NewServerConn(conn, ts.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go ts.session(channel, requests)
+	}
+}
+
+func (ts *testServer) session(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	for request := range requests {
+		switch request.Type {
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(request.Payload, &payload); err != nil {
+				request.Reply(false, nil)
+				continue
+			}
+			request.Reply(true, nil)
+			go ssh.DiscardRequests(requests)
+
+			status := ts.exec(channel, payload.Command)
+			channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+			return
+		case "subsystem":
+			var payload struct{ Name string }
+			ts.mu.Lock()
+			refuse, delay := ts.refuseSFTP, ts.sftpDelay
+			ts.mu.Unlock()
+			if err := ssh.Unmarshal(request.Payload, &payload); err != nil || payload.Name != "sftp" || refuse {
+				request.Reply(false, nil)
+				continue
+			}
+			request.Reply(true, nil)
+			go ssh.DiscardRequests(requests)
+
+			var rwc io.ReadWriteCloser = channel
+			if delay > 0 {
+				rwc = slowChannel{channel, delay}
+			}
+			server, err := sftp.NewServer(rwc)
+			if err != nil {
+				return
+			}
+			server.Serve()
+			server.Close()
+			return
+		default:
+			if request.WantReply {
+				request.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// exec runs a command and returns its exit status
+func (ts *testServer) exec(channel ssh.Channel, command string) int {
+	ts.mu.Lock()
+	for _, fragment := range ts.failing {
+		if strings.Contains(command, fragment) {
+			ts.mu.Unlock()
+			fmt.Fprintln(channel.Stderr(), "injected failure")
+			return 1
+		}
+	}
+	ts.mu.Unlock()
+
+	cmd := exec.Command("bash", "-c", command)
+	cmd.Env = append(os.Environ(), ts.env...)
+	cmd.Stdin = channel
+	cmd.Stdout = channel
+	cmd.Stderr = channel.Stderr()
+	if err := cmd.Run(); err != nil {
+		if exit, ok := err.(*exec.ExitError); ok {
+			return exit.ExitCode()
+		}
+		return 255
+	}
+	return 0
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/LCLS/GPUManager/api"
+)
+
+// How long before a maintenance window its server starts draining
+var MaintenanceLead = 6 * time.Hour
+
+// MaintenanceWindow is a time a server is taken down for maintenance
+type MaintenanceWindow struct {
+	ID, ServerID int
+	Start, End   time.Time
+	Reason       string
+}
+
+func (w *MaintenanceWindow) API() api.MaintenanceWindow {
+	return api.MaintenanceWindow{ID: w.ID, ServerID: w.ServerID, Start: w.Start, End: w.End, Reason: w.Reason}
+}
+
+// LoadMaintenance attaches the maintenance windows that have not ended to
+// their servers
+func LoadMaintenance(db *sql.DB, servers []*Server) error {
+	rows, err := db.Query("SELECT id, server_id, start, end, reason FROM maintenance_window WHERE end > ? ORDER BY start", time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		window := &MaintenanceWindow{}
+		if err := rows.Scan(&window.ID, &window.ServerID, &window.Start, &window.End, &window.Reason); err != nil {
+			return err
+		}
+
+		if server := FindServer(window.ServerID, servers); server != nil {
+			server.Maintenance = append(server.Maintenance, window)
+		}
+	}
+	return rows.Err()
+}
+
+// IsDraining reports whether the server should start no new instances,
+// because an admin is draining it or one of its maintenance windows is less
+// than MaintenanceLead away. It must be called with the manager lock held.
+func (s *Server) IsDraining(now time.Time) bool {
+	if s.Draining {
+		return true
+	}
+	for _, window := range s.Maintenance {
+		if now.After(window.Start.Add(-MaintenanceLead)) && now.Before(window.End) {
+			return true
+		}
+	}
+	return false
+}
+
+// maintenanceState returns the progress of the server towards maintenance,
+// or "" if it is not draining. It must be called with the manager lock held.
+func (s *Server) maintenanceState(now time.Time) string {
+	if !s.IsDraining(now) {
+		return ""
+	}
+	for _, resource := range s.Resources {
+		if resource.InUse {
+			return api.MaintenanceDraining
+		}
+	}
+	return api.MaintenanceReady
+}
+
+// checkMaintenance drops the maintenance windows that have ended by now, and
+// logs and publishes the servers whose progress towards maintenance has
+// changed since the last check
+func (m *Manager) checkMaintenance(now time.Time) {
+	// Changes are audited once the lock is released, so that readers are
+	// not held up by the database
+	type change struct {
+		target, outcome string
+	}
+	var changes []change
+	defer func() {
+		for _, c := range changes {
+			Audit(SchedulerActor, "maintenance", c.target, nil, 0, c.outcome)
+		}
+	}()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, server := range m.servers {
+		var windows []*MaintenanceWindow
+		for _, window := range server.Maintenance {
+			if window.End.After(now) {
+				windows = append(windows, window)
+			}
+		}
+		server.Maintenance = windows
+
+		state := server.maintenanceState(now)
+		if state == server.lastMaintenance {
+			continue
+		}
+		server.lastMaintenance = state
+
+		outcome := state
+		if outcome == "" {
+			outcome = "active"
+		}
+		log.Println("[Maintenance]", server.URL, outcome)
+		changes = append(changes, change{fmt.Sprintf("/servers/%d", server.ID), outcome})
+		m.publishServer(server)
+	}
+}
+
+// MaintenanceWindows returns the windows of every server that have not ended,
+// soonest first
+func (m *Manager) MaintenanceWindows() []api.MaintenanceWindow {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	windows := []api.MaintenanceWindow{}
+	for _, server := range m.servers {
+		for _, window := range server.Maintenance {
+			windows = append(windows, window.API())
+		}
+	}
+	sort.Slice(windows, func(i, j int) bool { return windows[i].Start.Before(windows[j].Start) })
+	return windows
+}
+
+// AddMaintenance schedules a maintenance window for a server
+func (m *Manager) AddMaintenance(request api.MaintenanceRequest) (api.MaintenanceWindow, error) {
+	if request.Start.IsZero() || request.End.IsZero() {
+		return api.MaintenanceWindow{}, ErrMissingData
+	}
+	if !request.End.After(request.Start) || !request.End.After(time.Now()) {
+		return api.MaintenanceWindow{}, &RequestError{http.StatusBadRequest, "A maintenance window must end after it starts, and in the future"}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	server := FindServer(request.ServerID, m.servers)
+	if server == nil {
+		return api.MaintenanceWindow{}, &RequestError{http.StatusBadRequest, "Unknown server"}
+	}
+
+	window := &MaintenanceWindow{ServerID: server.ID, Start: request.Start.UTC(), End: request.End.UTC(), Reason: request.Reason}
+	res, err := DB.Exec("insert into maintenance_window(server_id, start, end, reason) values (?,?,?,?)", window.ServerID, window.Start, window.End, window.Reason)
+	if err != nil {
+		return api.MaintenanceWindow{}, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return api.MaintenanceWindow{}, err
+	}
+	window.ID = int(id)
+
+	server.Maintenance = append(server.Maintenance, window)
+	sort.Slice(server.Maintenance, func(i, j int) bool { return server.Maintenance[i].Start.Before(server.Maintenance[j].Start) })
+	m.publishServer(server)
+	return window.API(), nil
+}
+
+// RemoveMaintenance cancels a maintenance window
+func (m *Manager) RemoveMaintenance(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, server := range m.servers {
+		for i, window := range server.Maintenance {
+			if window.ID != id {
+				continue
+			}
+
+			if _, err := DB.Exec("DELETE FROM maintenance_window WHERE id = ?", id); err != nil {
+				return err
+			}
+
+			server.Maintenance = append(server.Maintenance[:i], server.Maintenance[i+1:]...)
+			m.publishServer(server)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
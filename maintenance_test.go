@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/LCLS/GPUManager/api"
+)
+
+// TestMaintenance steps a server with one busy GPU through a maintenance
+// window, checking at each time how far it is towards maintenance and
+// whether its free GPU is given an instance
+func TestMaintenance(t *testing.T) {
+	start := time.Date(2026, 11, 2, 8, 0, 0, 0, time.UTC)
+	end := start.Add(4 * time.Hour)
+
+	tests := []struct {
+		name       string
+		at         time.Time
+		release    bool
+		state      string
+		dispatched bool
+	}{
+		{name: "before the lead", at: start.Add(-MaintenanceLead - time.Minute), dispatched: true},
+		{name: "within the lead", at: start.Add(-MaintenanceLead + time.Minute), state: api.MaintenanceDraining},
+		{name: "instances finished", at: start.Add(-time.Hour), release: true, state: api.MaintenanceReady},
+		{name: "during the window", at: start.Add(time.Hour), state: api.MaintenanceReady},
+		{name: "after the window", at: end.Add(time.Minute), dispatched: true},
+	}
+
+	newTestDB(t)
+	m := NewManager()
+	server := &Server{ID: 1, URL: "gpu01", Enabled: true, Maintenance: []*MaintenanceWindow{{ID: 1, ServerID: 1, Start: start, End: end}}}
+	busy := &Resource{UUID: "GPU-busy", Enabled: true, InUse: true, Parent: server}
+	free := &Resource{UUID: "GPU-free", Enabled: true, Parent: server}
+	server.Resources = []*Resource{busy, free}
+	m.servers = []*Server{server}
+	newTestJob(t, m, 1, "queued", "echo done", len(tests))
+
+	for _, test := range tests {
+		m.mu.Lock()
+		if test.release {
+			m.release(busy, test.at)
+		}
+		m.mu.Unlock()
+
+		m.checkMaintenance(test.at)
+
+		m.mu.Lock()
+		if server.lastMaintenance != test.state {
+			t.Errorf("%s: expected state %q, got %q", test.name, test.state, server.lastMaintenance)
+		}
+		instance, _, _ := m.next(free, test.at)
+		if dispatched := instance != nil; dispatched != test.dispatched {
+			t.Errorf("%s: expected dispatched %v, got %v", test.name, test.dispatched, dispatched)
+		}
+		m.release(free, test.at)
+		m.mu.Unlock()
+	}
+
+	if len(server.Maintenance) != 0 {
+		t.Error("ended window was kept")
+	}
+
+	entries, err := AuditEntries(api.AuditFilter{Action: "maintenance"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Newest first
+	expected := []string{"active", api.MaintenanceReady, api.MaintenanceDraining}
+	if len(entries) != len(expected) {
+		t.Fatalf("expected %d changes audited, got %+v", len(expected), entries)
+	}
+	for i, outcome := range expected {
+		if entries[i].Outcome != outcome {
+			t.Errorf("audit entry %d: expected %q, got %q", i, outcome, entries[i].Outcome)
+		}
+	}
+}
+
+// TestNextDisabled checks that a disabled GPU is given no new instances, but
+// still resumes the one it holds
+func TestNextDisabled(t *testing.T) {
+	tests := []struct {
+		name     string
+		enabled  bool
+		pinned   bool
+		resource int
+		expected bool
+	}{
+		{name: "enabled", enabled: true, expected: true},
+		{name: "disabled", enabled: false},
+		{name: "disabled skipped for another", enabled: false, resource: 1, expected: true},
+		{name: "disabled resumes pinned", enabled: false, pinned: true, expected: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			newTestDB(t)
+			m := NewManager()
+			server := &Server{ID: 1, URL: "gpu01", Enabled: true}
+			server.Resources = []*Resource{
+				{UUID: "GPU-0", Enabled: test.enabled, Parent: server},
+				{UUID: "GPU-1", Enabled: true, Parent: server},
+			}
+			m.servers = []*Server{server}
+			job := newTestJob(t, m, 1, "queued", "echo done", 1)
+
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			if test.pinned {
+				job.Instances[0].PID = 1234
+				job.Instances[0].Resource = server.Resources[0]
+			}
+
+			instance, _, _ := m.next(server.Resources[test.resource], time.Now())
+			if got := instance != nil; got != test.expected {
+				t.Errorf("expected an instance %v, got %v", test.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,603 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/LCLS/GPUManager/api"
+)
+
+// RequestError is caused by the request rather than by the manager, and is
+// reported to the client with the given HTTP status
+type RequestError struct {
+	Status  int
+	Message string
+}
+
+func (e *RequestError) Error() string {
+	return e.Message
+}
+
+var ErrNotFound = &RequestError{http.StatusNotFound, "Not Found"}
+var ErrMissingData = &RequestError{http.StatusBadRequest, "Missing Data"}
+var ErrShutdown = errors.New("Shutting down")
+var ErrRemoved = errors.New("Server removed")
+
+// Manager owns the in-memory state of the farm. HTTP handlers and resource
+// goroutines share it, so every read or write of the collections below, and
+// of the mutable fields of the items in them (Server.Enabled and Draining,
+// server health and maintenance, Resource.InUse and Enabled, project usage
+// and the JobInstance state), happens with mu held. Changes to them are
+// published on events.
+type Manager struct {
+	mu sync.RWMutex
+
+	servers   []*Server
+	removed   []*Server
+	archives  []*Archive
+	models    []Model
+	templates []Template
+	jobs      []*Job
+	projects  []*Project
+
+	events  *Broker
+	metrics *Metrics
+
+	// Instances waiting to run, oldest first. An instance with a Resource
+	// set is pinned to it and is only handed to that resource.
+	queue []*JobInstance
+
+	// Shutdown state. stop is closed once dispatch has stopped, and abort is
+	// cancelled when transfers that have not finished in time must roll back.
+	stopping  bool
+	stop      chan struct{}
+	abort     context.Context
+	cancel    context.CancelFunc
+	transfers sync.WaitGroup
+	handlers  sync.WaitGroup
+}
+
+func NewManager() *Manager {
+	abort, cancel := context.WithCancel(context.Background())
+	return &Manager{events: NewBroker(), metrics: NewMetrics(), stop: make(chan struct{}), abort: abort, cancel: cancel}
+}
+
+// Load reads the full state of the farm from the database
+func (m *Manager) Load(db *sql.DB) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	servers, removed, err := LoadServers(db)
+	if err != nil {
+		return err
+	}
+	m.servers, m.removed = servers, removed
+
+	archives, err := LoadArchives(db)
+	if err != nil {
+		return err
+	}
+	m.archives = archives
+
+	projects, err := LoadProjects(db)
+	if err != nil {
+		return err
+	}
+	m.projects = projects
+
+	models, err := LoadModels(db)
+	if err != nil {
+		return err
+	}
+	m.models = models
+
+	templates, err := LoadTemplates(db)
+	if err != nil {
+		return err
+	}
+	m.templates = templates
+
+	// Instances that ran on removed servers still refer to their GPUs
+	jobs, err := LoadJobs(db, m.models, m.templates, append(append([]*Server(nil), m.servers...), m.removed...))
+	if err != nil {
+		return err
+	}
+	m.jobs = jobs
+
+	return nil
+}
+
+// Servers returns a copy of the server list. The servers themselves are
+// shared, so their mutable fields must still be read with the lock held.
+func (m *Manager) Servers() []*Server {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]*Server(nil), m.servers...)
+}
+
+// Archives returns a copy of the archive list
+func (m *Manager) Archives() []*Archive {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]*Archive(nil), m.archives...)
+}
+
+// EnabledArchives returns the archives the results of a job should be
+// copied to
+func (m *Manager) EnabledArchives(job *Job) []*Archive {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var archives []*Archive
+	for _, archive := range m.archives {
+		if archive.Enabled && job.UsesArchive(archive) {
+			archives = append(archives, archive)
+		}
+	}
+	return archives
+}
+
+// Jobs returns a deep copy of every job that is safe to read without the lock
+func (m *Manager) Jobs() []Job {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	jobs := make([]Job, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		jobs = append(jobs, job.Copy())
+	}
+	return jobs
+}
+
+// Projects returns the projects with their current usage
+func (m *Manager) Projects() []api.Project {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	projects := []api.Project{}
+	for _, project := range m.projects {
+		projects = append(projects, project.API())
+	}
+	return projects
+}
+
+// Models returns a copy of the model list
+func (m *Manager) Models() []Model {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]Model(nil), m.models...)
+}
+
+// Templates returns a copy of the template list
+func (m *Manager) Templates() []Template {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]Template(nil), m.templates...)
+}
+
+func (m *Manager) AddServer(server *Server) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.servers = append(m.servers, server)
+	m.publishServer(server)
+}
+
+func (m *Manager) AddArchive(archive *Archive) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.archives = append(m.archives, archive)
+}
+
+func (m *Manager) AddModel(model Model) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.models = append(m.models, model)
+}
+
+func (m *Manager) RemoveModel(id int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := 0; i < len(m.models); i++ {
+		if m.models[i].ID == id {
+			m.models = append(m.models[:i], m.models[i+1:]...)
+			return
+		}
+	}
+}
+
+// FindModel returns a copy of the model with the given id
+func (m *Manager) FindModel(id int) (Model, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if model := FindModel(id, m.models); model != nil {
+		return *model, true
+	}
+	return Model{}, false
+}
+
+// FindModelRevision returns a copy of a revision of the named model, or of
+// its latest revision if revision is 0
+func (m *Manager) FindModelRevision(name string, revision int) (Model, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var found *Model
+	for i := 0; i < len(m.models); i++ {
+		model := &m.models[i]
+		if model.Name != name {
+			continue
+		}
+		if revision == 0 && (found == nil || model.Revision > found.Revision) || model.Revision == revision {
+			found = model
+		}
+	}
+
+	if found == nil {
+		return Model{}, false
+	}
+	return *found, true
+}
+
+func (m *Manager) AddTemplate(template Template) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.templates = append(m.templates, template)
+}
+
+func (m *Manager) RemoveTemplate(id int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := 0; i < len(m.templates); i++ {
+		if m.templates[i].ID == id {
+			m.templates = append(m.templates[:i], m.templates[i+1:]...)
+			return
+		}
+	}
+}
+
+// FindTemplate returns a copy of the template with the given id
+func (m *Manager) FindTemplate(id int) (Template, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if template := FindTemplate(id, m.templates); template != nil {
+		return *template, true
+	}
+	return Template{}, false
+}
+
+// FindTemplateRevision returns a copy of a revision of the named template,
+// or of its latest revision if revision is 0
+func (m *Manager) FindTemplateRevision(name string, revision int) (Template, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var found *Template
+	for i := 0; i < len(m.templates); i++ {
+		template := &m.templates[i]
+		if template.Name != name {
+			continue
+		}
+		if revision == 0 && (found == nil || template.Revision > found.Revision) || template.Revision == revision {
+			found = template
+		}
+	}
+
+	if found == nil {
+		return Template{}, false
+	}
+	return *found, true
+}
+
+// AddJob takes ownership of the job and queues all of its instances
+func (m *Manager) AddJob(job *Job) {
+	m.mu.Lock()
+	m.jobs = append(m.jobs, job)
+	m.publishJob(job)
+	m.mu.Unlock()
+
+	for _, instance := range job.Instances {
+		m.Enqueue(instance)
+	}
+}
+
+func (m *Manager) RemoveJob(id int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := 0; i < len(m.jobs); i++ {
+		if m.jobs[i].ID == id {
+			m.events.Publish(api.EventJobRemoved, id, 0, m.jobs[i].API())
+			m.jobs = append(m.jobs[:i], m.jobs[i+1:]...)
+			return
+		}
+	}
+}
+
+// Enqueue queues an instance on the resource it is pinned to, or for any
+// resource if it has not been started yet
+func (m *Manager) Enqueue(instance *JobInstance) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, queued := range m.queue {
+		if queued == instance {
+			return
+		}
+	}
+	m.queue = append(m.queue, instance)
+}
+
+// Requeue puts an instance that was handed out but not started back at the
+// front of the queue
+func (m *Manager) Requeue(instance *JobInstance) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.queue = append([]*JobInstance{instance}, m.queue...)
+}
+
+// Next claims the resource and returns the next instance it should run, or
+// nil if the resource is unavailable or there is nothing to do. Instances
+// pinned to the resource take priority over unpinned ones, which are only
+// taken if the GPU is enabled and not occupied by someone else, its server is
+// not draining, the constraints of their job allow the resource and the
+// project of the job is within its quota. Pinned instances already hold
+// their GPU, so they are resumed regardless.
+func (m *Manager) Next(r *Resource) *JobInstance {
+	m.mu.Lock()
+	instance, action, parameters := m.next(r, time.Now())
+	m.mu.Unlock()
+
+	// The decision is audited once the lock is released, so that readers
+	// are not held up by the database
+	if instance != nil {
+		Audit(SchedulerActor, action, instanceTarget(instance), parameters, 0, "ok")
+	}
+	return instance
+}
+
+// next claims the resource and takes its next instance from the queue at
+// now, returning how it was handed out for the audit log. It must be called
+// with the lock held.
+func (m *Manager) next(r *Resource, now time.Time) (*JobInstance, string, map[string]interface{}) {
+	if m.stopping || !r.Parent.Enabled || r.Parent.Removed() || r.InUse || !r.Retired.IsZero() {
+		return nil, "", nil
+	}
+
+	available := r.Enabled && r.external == "" && !r.Parent.IsDraining(now)
+	index := -1
+	for i := 0; i < len(m.queue); i++ {
+		// Instances of jobs that have since been removed are dropped, as
+		// are cancelled ones that have no process left to stop
+		if FindJob(m.queue[i].Parent.ID, m.jobs) == nil || (m.queue[i].Cancelled && m.queue[i].PID == -1) {
+			m.queue = append(m.queue[:i], m.queue[i+1:]...)
+			i--
+			continue
+		}
+
+		if m.queue[i].Resource == r {
+			index = i
+			break
+		}
+
+		if m.queue[i].Resource == nil && index == -1 && available && m.queue[i].Parent.Accepts(r) {
+			if project := FindProject(m.queue[i].Parent.Project, m.projects); project == nil || project.Allows(now) {
+				index = i
+			}
+		}
+	}
+
+	if index == -1 {
+		return nil, "", nil
+	}
+
+	instance := m.queue[index]
+	m.queue = append(m.queue[:index], m.queue[index+1:]...)
+
+	action := "dispatch"
+	if instance.Resource == r {
+		action = "resume"
+	}
+	parameters := map[string]interface{}{"server": r.Parent.URL, "resource": r.UUID, "project": instance.Parent.Project}
+
+	r.InUse = true
+	if project := FindProject(instance.Parent.Project, m.projects); project != nil {
+		project.claim(r, now)
+		r.project = project
+	}
+	m.publishResource(r)
+	return instance, action, parameters
+}
+
+// Release marks the resource as free for the next instance and records its
+// use against the project of the instance it ran
+func (m *Manager) Release(r *Resource) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.release(r, time.Now())
+}
+
+// release frees the resource at now. It must be called with the lock held.
+func (m *Manager) release(r *Resource, now time.Time) {
+	r.InUse = false
+	if r.project != nil {
+		r.project.release(r, now)
+		r.project = nil
+	}
+	m.publishResource(r)
+}
+
+// Instance returns a copy of the current state of an instance
+func (m *Manager) Instance(instance *JobInstance) JobInstance {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return *instance
+}
+
+// UpdateInstance applies fn to a copy of the instance, saves it and
+// publishes it. The instance only takes the new state once it is saved.
+func (m *Manager) UpdateInstance(instance *JobInstance, fn func(*JobInstance)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	updated := *instance
+	fn(&updated)
+	if err := updated.Save(); err != nil {
+		return err
+	}
+	*instance = updated
+
+	m.publishInstance(instance)
+	m.publishJob(instance.Parent)
+	return nil
+}
+
+// Start runs the handler of every loaded resource and begins checking the
+// health of the servers and collecting GPU telemetry
+func (m *Manager) Start() {
+	for _, server := range m.Servers() {
+		m.StartServer(server)
+	}
+	go m.monitor()
+	go m.collectTelemetry()
+}
+
+// StartServer runs a handler for each resource of the server
+func (m *Manager) StartServer(server *Server) {
+	for _, resource := range server.Resources {
+		m.StartResource(resource)
+	}
+}
+
+// StartResource runs the handler of a single resource, unless it still has
+// one
+func (m *Manager) StartResource(resource *Resource) {
+	m.mu.Lock()
+	handled := resource.handled
+	resource.handled = true
+	m.mu.Unlock()
+
+	if handled {
+		return
+	}
+
+	m.handlers.Add(1)
+	resource.Parent.handlers.Add(1)
+	go func() {
+		defer m.handlers.Done()
+		defer resource.Parent.handlers.Done()
+		resource.Handle(m)
+	}()
+}
+
+// Retiring reports whether the handler of a GPU should stop because a rescan
+// found the GPU gone. Once it has, the GPU is given a new handler if it comes
+// back.
+func (m *Manager) Retiring(r *Resource) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if r.Retired.IsZero() {
+		return false
+	}
+	r.handled = false
+	return true
+}
+
+// Stopping reports whether the manager has begun shutting down
+func (m *Manager) Stopping() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.stopping
+}
+
+// BeginTransfer registers an upload or archive copy that shutdown should
+// wait for. It returns false once shutdown has begun.
+func (m *Manager) BeginTransfer() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stopping {
+		return false
+	}
+	m.transfers.Add(1)
+	return true
+}
+
+func (m *Manager) EndTransfer() {
+	m.transfers.Done()
+}
+
+// Stop stops dispatching new instances and starting transfers, and ends
+// the logs being followed
+func (m *Manager) Stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.stopping {
+		m.stopping = true
+		close(m.stop)
+	}
+}
+
+// Shutdown stops the manager and waits for in-progress transfers to finish.
+// Transfers still running when ctx expires are aborted and rolled back. The
+// state of every instance is then written to the database so that the next
+// start resumes from it.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		m.transfers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Println("[Shutdown] Rolling back unfinished transfers")
+		m.cancel()
+		<-done
+	}
+
+	// Handlers that are only polling a remote process exit at their next
+	// check; there is no need to hold up shutdown for them.
+	handlers := make(chan struct{})
+	go func() {
+		m.handlers.Wait()
+		close(handlers)
+	}()
+
+	select {
+	case <-handlers:
+	case <-ctx.Done():
+	}
+
+	return m.Persist()
+}
+
+// Persist writes the state of every instance to the database
+func (m *Manager) Persist() error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, job := range m.jobs {
+		for _, instance := range job.Instances {
+			if err := instance.Save(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
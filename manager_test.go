@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/LCLS/GPUManager/api"
+)
+
+// TestManagerConcurrency hammers dispatch, release and instance updates from
+// a goroutine per GPU while jobs are added, servers drain and readers take
+// snapshots. Run it with -race.
+func TestManagerConcurrency(t *testing.T) {
+	newTestDB(t)
+	m := NewManager()
+
+	var resources []*Resource
+	for i := 1; i <= 4; i++ {
+		server := &Server{ID: i, URL: fmt.Sprintf("gpu%02d", i), Enabled: true}
+		for j := 0; j < 2; j++ {
+			resource := &Resource{UUID: fmt.Sprintf("GPU-%d-%d", i, j), Name: "Test GPU", DeviceID: j, Enabled: true, Parent: server}
+			server.Resources = append(server.Resources, resource)
+			resources = append(resources, resource)
+		}
+		m.servers = append(m.servers, server)
+	}
+
+	const jobs, count = 6, 20
+	var added []*Job
+	var addedMu sync.Mutex
+	addJob := func(id int) {
+		job := newTestJob(t, m, id, fmt.Sprintf("job%d", id), "echo done", count)
+		addedMu.Lock()
+		added = append(added, job)
+		addedMu.Unlock()
+	}
+	addJob(1)
+
+	sub := m.events.Subscribe(0, 0)
+	defer m.events.Unsubscribe(sub)
+
+	stop := make(chan struct{})
+	var background sync.WaitGroup
+
+	// Events are drained as a client of the stream would
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		for {
+			select {
+			case <-sub.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	// Readers take snapshots of the state the API serves
+	for i := 0; i < 2; i++ {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				for _, job := range m.Jobs() {
+					_ = job.API()
+				}
+				m.mu.RLock()
+				for _, server := range m.servers {
+					_ = server.API()
+				}
+				m.mu.RUnlock()
+			}
+		}()
+	}
+
+	// An admin drains servers and brings them back
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			id := i%4 + 1
+			if err := m.SetServerDraining(id, true); err != nil {
+				t.Error(err)
+			}
+			time.Sleep(time.Millisecond)
+			if err := m.SetServerDraining(id, false); err != nil {
+				t.Error(err)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+
+	// Jobs keep arriving while instances run, moving the job list
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		for id := 2; id <= jobs; id++ {
+			addJob(id)
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+
+	var running sync.Map
+	var completed, retried atomic.Int64
+	var workers sync.WaitGroup
+	for _, resource := range resources {
+		workers.Add(1)
+		go func(r *Resource) {
+			defer workers.Done()
+			deadline := time.Now().Add(30 * time.Second)
+			for completed.Load() < jobs*count && time.Now().Before(deadline) {
+				instance := m.Next(r)
+				if instance == nil {
+					time.Sleep(time.Millisecond)
+					continue
+				}
+
+				if other, loaded := running.LoadOrStore(instance, r); loaded {
+					t.Errorf("instance %d handed to %s while running on %s", instance.ID, r.UUID, other.(*Resource).UUID)
+				}
+
+				if err := m.UpdateInstance(instance, func(i *JobInstance) {
+					i.PID = 100 + instance.ID
+					i.Resource = r
+				}); err != nil {
+					t.Error(err)
+				}
+
+				// Every third first attempt fails and is queued again
+				state := m.Instance(instance)
+				if state.Attempts == 0 && instance.ID%3 == 0 {
+					if err := m.UpdateInstance(instance, func(i *JobInstance) {
+						i.Attempts++
+						i.PID = -1
+						i.Resource = nil
+					}); err != nil {
+						t.Error(err)
+					}
+					running.Delete(instance)
+					m.Enqueue(instance)
+					retried.Add(1)
+				} else {
+					if err := m.UpdateInstance(instance, func(i *JobInstance) {
+						i.Completed = true
+						i.Archived = true
+					}); err != nil {
+						t.Error(err)
+					}
+					running.Delete(instance)
+					completed.Add(1)
+				}
+				m.Release(r)
+			}
+		}(resource)
+	}
+
+	workers.Wait()
+	close(stop)
+	background.Wait()
+
+	if got := completed.Load(); got != jobs*count {
+		t.Fatalf("completed %d instances, expected %d", got, jobs*count)
+	}
+	if retried.Load() == 0 {
+		t.Error("no instance was retried")
+	}
+
+	for _, job := range added {
+		for _, instance := range job.Instances {
+			if state := m.Instance(instance); !state.Completed {
+				t.Errorf("instance %d not completed: %+v", instance.ID, state)
+			}
+		}
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.queue) != 0 {
+		t.Errorf("%d instances left on the queue", len(m.queue))
+	}
+	for _, r := range resources {
+		if r.InUse {
+			t.Errorf("%s still in use", r.UUID)
+		}
+	}
+}
+
+// TestNextPinned checks that an instance pinned to a GPU is only handed to
+// that GPU, and is resumed even while its server drains
+func TestNextPinned(t *testing.T) {
+	newTestDB(t)
+	m := NewManager()
+
+	server := &Server{ID: 1, URL: "gpu01", Enabled: true}
+	first := &Resource{UUID: "GPU-1", Enabled: true, Parent: server}
+	second := &Resource{UUID: "GPU-2", Enabled: true, Parent: server}
+	server.Resources = []*Resource{first, second}
+	m.servers = []*Server{server}
+
+	job := newTestJob(t, m, 1, "pinned", "echo done", 2)
+	m.mu.Lock()
+	job.Instances[0].PID = 1234
+	job.Instances[0].Resource = second
+	server.Draining = true
+	m.mu.Unlock()
+
+	if instance := m.Next(first); instance != nil {
+		t.Fatalf("draining server was given instance %d", instance.ID)
+	}
+	if instance := m.Next(second); instance != job.Instances[0] {
+		t.Fatalf("pinned instance not resumed, got %v", instance)
+	}
+	if instance := m.Next(second); instance != nil {
+		t.Fatal("resource in use was given another instance")
+	}
+
+	entries, err := AuditEntries(api.AuditFilter{Action: "resume"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected the resume to be audited once, got %d entries", len(entries))
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/LCLS/GPUManager/api"
+)
+
+// Histogram counts observations in cumulative buckets of seconds, as
+// Prometheus expects
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func NewHistogram(buckets ...float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	seconds := d.Seconds()
+	for i, bound := range h.buckets {
+		if seconds <= bound {
+			h.counts[i] += 1
+		}
+	}
+	h.sum += seconds
+	h.count += 1
+}
+
+func (h *Histogram) write(w io.Writer, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", name, h.sum, name, h.count)
+}
+
+// Metrics counts what the resource handlers have done since the manager
+// started. Gauges are read from the state of the manager when scraped.
+type Metrics struct {
+	Started, Succeeded, Failed, Retried atomic.Uint64
+
+	Upload, Run, Archive *Histogram
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		Upload:  NewHistogram(1, 5, 15, 60, 300, 900, 3600),
+		Run:     NewHistogram(60, 300, 900, 1800, 3600, 7200, 14400, 28800, 86400, 172800, 604800),
+		Archive: NewHistogram(1, 5, 15, 60, 300, 900, 3600, 7200),
+	}
+}
+
+// labels formats label pairs, escaping their values
+func labels(pairs ...string) string {
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+	var parts []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=\"%s\"", pairs[i], escape.Replace(pairs[i+1])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// gauge writes a gauge with a value for each label set, in a stable order
+func gauge(w io.Writer, name, help string, values map[string]int) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %d\n", name, key, values[key])
+	}
+}
+
+func counter(w io.Writer, name, help string, value uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+}
+
+// metricsHandler serves the metrics of the farm in the Prometheus text
+// exposition format
+func (m *Manager) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	gpus := make(map[string]int)
+	queue := make(map[string]int)
+	instances := make(map[string]int)
+
+	now := time.Now()
+	m.mu.RLock()
+	for _, server := range m.servers {
+		for _, resource := range server.Resources {
+			// Every state is written for every server and model so that
+			// their series do not disappear when they reach zero
+			for _, state := range []string{"busy", "disabled", "draining", "external", "idle"} {
+				gpus[labels("server", server.URL, "model", resource.Name, "state", state)] += 0
+			}
+
+			state := "idle"
+			switch {
+			case resource.InUse:
+				state = "busy"
+			case !resource.Enabled:
+				state = "disabled"
+			case server.IsDraining(now):
+				state = "draining"
+			case resource.external != "":
+				state = "external"
+			}
+			gpus[labels("server", server.URL, "model", resource.Name, "state", state)] += 1
+		}
+	}
+
+	// Jobs have no priority of their own. The queue is served oldest first,
+	// except that instances waiting to resume on their GPU go ahead of new
+	// ones, so those are the two priorities its depth is broken down by.
+	for _, instance := range m.queue {
+		priority := "new"
+		if instance.Resource != nil {
+			priority = "resume"
+		}
+		queue[labels("project", instance.Parent.Project, "priority", priority)] += 1
+	}
+
+	for _, state := range []string{api.StateQueued, api.StateRunning, api.StateCompleted, api.StateFailed, api.StateCancelled} {
+		instances[labels("state", state)] = 0
+	}
+	for _, job := range m.jobs {
+		for _, instance := range job.Instances {
+			instances[labels("state", instance.State())] += 1
+		}
+	}
+	m.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	gauge(w, "gpumanager_gpus", "GPUs by server, model and whether they are running an instance, disabled, on a draining server, occupied by someone else or idle.", gpus)
+	gauge(w, "gpumanager_queue_depth", "Instances waiting for a GPU by project and priority: resume for those waiting to resume on their GPU, which go first, and new for the rest.", queue)
+	gauge(w, "gpumanager_instances", "Instances of every job by state.", instances)
+
+	counter(w, "gpumanager_instances_started_total", "Instances launched on a GPU.", m.metrics.Started.Load())
+	counter(w, "gpumanager_instances_succeeded_total", "Instances that completed successfully.", m.metrics.Succeeded.Load())
+	counter(w, "gpumanager_instances_failed_total", "Instances marked as failed after using up their attempts.", m.metrics.Failed.Load())
+	counter(w, "gpumanager_instances_retried_total", "Failed attempts that were queued to be retried.", m.metrics.Retried.Load())
+
+	m.metrics.Upload.write(w, "gpumanager_upload_seconds", "Time taken to upload the model and template of an instance.")
+	m.metrics.Run.write(w, "gpumanager_run_seconds", "Time simulations launched by this manager ran for.")
+	m.metrics.Archive.write(w, "gpumanager_archive_seconds", "Time taken to copy the results of an instance to its archives.")
+}
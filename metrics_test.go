@@ -0,0 +1,149 @@
+package main
+
+import (
+	"log"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var metricSample = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{[a-zA-Z_]\w*="(?:[^"\\]|\\.)*"(?:,[a-zA-Z_]\w*="(?:[^"\\]|\\.)*")*\})? (\S+)$`)
+
+// scrapeMetrics serves /metrics and checks that it is in the text exposition
+// format, returning its samples by name and labels
+func scrapeMetrics(t *testing.T, m *Manager) map[string]float64 {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	m.metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	if contentType := w.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %q", contentType)
+	}
+
+	types := make(map[string]string)
+	samples := make(map[string]float64)
+	family := ""
+	for _, line := range strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n") {
+		if strings.HasPrefix(line, "#") {
+			fields := strings.SplitN(line, " ", 4)
+			if len(fields) != 4 || (fields[1] != "HELP" && fields[1] != "TYPE") {
+				t.Errorf("invalid comment %q", line)
+				continue
+			}
+			if fields[1] == "TYPE" {
+				if _, ok := types[fields[2]]; ok {
+					t.Errorf("%s declared twice", fields[2])
+				}
+				if fields[3] != "counter" && fields[3] != "gauge" && fields[3] != "histogram" {
+					t.Errorf("%s has unknown type %s", fields[2], fields[3])
+				}
+				types[fields[2]], family = fields[3], fields[2]
+			}
+			continue
+		}
+
+		match := metricSample.FindStringSubmatch(line)
+		if match == nil {
+			t.Errorf("invalid sample %q", line)
+			continue
+		}
+
+		// A sample must follow the declaration of its family
+		name := match[1]
+		if types[family] == "histogram" {
+			for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+				name = strings.TrimSuffix(name, suffix)
+			}
+		}
+		if name != family {
+			t.Errorf("sample %q outside its family", line)
+		}
+
+		value, err := strconv.ParseFloat(match[3], 64)
+		if err != nil {
+			t.Errorf("invalid value in %q", line)
+		}
+		if _, ok := samples[match[1]+match[2]]; ok {
+			t.Errorf("sample %q repeated", line)
+		}
+		samples[match[1]+match[2]] = value
+	}
+	return samples
+}
+
+// TestMetrics scrapes the metrics before and after running an instance that
+// succeeds and one that fails twice, checking the counters and histograms
+// moved and the queue is broken down by priority
+func TestMetrics(t *testing.T) {
+	f := newTestFarm(t)
+	good := f.addJob(t, "good", "echo done", 1)
+	broken := f.addJob(t, "broken", "exit 3", 1)
+	broken.Config.Retry.Attempts = 2
+	waiting := f.addJob(t, "waiting", "echo done", 1)
+
+	// Waiting to resume on a GPU of its own, so never taken here. Its process
+	// has not exited, so it is counted as running.
+	f.m.mu.Lock()
+	broken.Project = "lab"
+	waiting.Instances[0].PID, waiting.Instances[0].Resource = 1234, &Resource{UUID: "GPU-other", Parent: f.server}
+	f.m.mu.Unlock()
+
+	before := scrapeMetrics(t, f.m)
+	for sample, expected := range map[string]float64{
+		`gpumanager_queue_depth{project="",priority="new"}`:                 1,
+		`gpumanager_queue_depth{project="lab",priority="new"}`:              1,
+		`gpumanager_queue_depth{project="",priority="resume"}`:              1,
+		`gpumanager_instances{state="queued"}`:                              2,
+		`gpumanager_instances{state="running"}`:                             1,
+		`gpumanager_gpus{server="127.0.0.1",model="Test GPU",state="idle"}`: 1,
+		`gpumanager_instances_started_total`:                                0,
+		`gpumanager_upload_seconds_count`:                                   0,
+	} {
+		if value, ok := before[sample]; !ok || value != expected {
+			t.Errorf("expected %s %g before running, got %g", sample, expected, value)
+		}
+	}
+
+	Log := log.New(os.Stderr, "metrics ", log.Lshortfile)
+	for i := 0; i < 3; i++ {
+		instance := f.m.Next(f.resource)
+		if instance == nil {
+			t.Fatal("nothing dispatched")
+		}
+		if err := f.resource.Run(f.m, Log, instance); err != nil {
+			f.resource.Fail(f.m, Log, instance, err)
+		}
+		f.m.Release(f.resource)
+	}
+
+	after := scrapeMetrics(t, f.m)
+	for sample, expected := range map[string]float64{
+		`gpumanager_queue_depth{project="",priority="resume"}`: 1,
+		`gpumanager_instances{state="queued"}`:                 0,
+		`gpumanager_instances{state="running"}`:                1,
+		`gpumanager_instances{state="completed"}`:              1,
+		`gpumanager_instances{state="failed"}`:                 1,
+		`gpumanager_instances_started_total`:                   3,
+		`gpumanager_instances_succeeded_total`:                 1,
+		`gpumanager_instances_retried_total`:                   1,
+		`gpumanager_instances_failed_total`:                    1,
+		`gpumanager_upload_seconds_count`:                      3,
+		`gpumanager_upload_seconds_bucket{le="+Inf"}`:          3,
+		`gpumanager_run_seconds_count`:                         3,
+		`gpumanager_run_seconds_bucket{le="60"}`:               3,
+		`gpumanager_archive_seconds_count`:                     3,
+	} {
+		if value, ok := after[sample]; !ok || value != expected {
+			t.Errorf("expected %s %g after running, got %g", sample, expected, value)
+		}
+	}
+	if !f.m.Instance(good.Instances[0]).Completed || !f.m.Instance(broken.Instances[0]).Failed {
+		t.Fatal("instances did not run as expected")
+	}
+	if _, ok := after[`gpumanager_queue_depth{project="lab",priority="new"}`]; ok {
+		t.Error("queue depth of an empty queue still reported")
+	}
+}
@@ -2,22 +2,34 @@ package main
 
 import (
 	"database/sql"
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
-	"text/template"
+
+	"github.com/LCLS/GPUManager/api"
 )
 
 type Model struct {
-	ID    int
-	Name  string
-	Files []string
+	ID       int
+	Name     string
+	Revision int
+	Owner    string
+	Project  string
+	Files    []string
 }
 
-var Models []Model
+// Directory returns the name of the directory the files of the model are
+// kept in, both under data/ and on the servers
+func (model *Model) Directory() string {
+	if model.Revision <= 1 {
+		return model.Name
+	}
+	return fmt.Sprintf("%s@%d", model.Name, model.Revision)
+}
 
 func FindModel(id int, models []Model) *Model {
 	for i := 0; i < len(models); i++ {
@@ -29,19 +41,19 @@ func FindModel(id int, models []Model) *Model {
 }
 
 func LoadModels(db *sql.DB) ([]Model, error) {
-	rows, err := db.Query("SELECT id, name FROM model")
+	rows, err := db.Query("SELECT id, name, revision, owner, project FROM model")
 	if err != nil {
 		return nil, err
 	}
 
 	var models []Model
 	for rows.Next() {
-		var id int
-		var name string
-		if err := rows.Scan(&id, &name); err != nil {
+		var id, revision int
+		var name, owner, project string
+		if err := rows.Scan(&id, &name, &revision, &owner, &project); err != nil {
 			return nil, err
 		}
-		models = append(models, Model{ID: id, Name: name})
+		models = append(models, Model{ID: id, Name: name, Revision: revision, Owner: owner, Project: project})
 	}
 	rows.Close()
 
@@ -64,119 +76,110 @@ func LoadModels(db *sql.DB) ([]Model, error) {
 	return models, nil
 }
 
-func modelHandler(w http.ResponseWriter, r *http.Request) {
-	type JSONResponse struct {
-		Success bool   `json:"success"`
-		Message string `json:"message"`
-	}
-
-	funcMap := template.FuncMap{
-		"join": func(in []string) string {
-			return strings.Join(in, ", ")
-		},
+// API returns the representation of the model used by the JSON API
+func (model *Model) API() api.Model {
+	files := model.Files
+	if files == nil {
+		files = []string{}
 	}
+	return api.Model{ID: model.ID, Name: model.Name, Revision: model.Revision, Owner: model.Owner, Project: model.Project, Files: files}
+}
 
-	t, err := template.New("model.html").Funcs(funcMap).ParseFiles("model.html")
-	if err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
-		return
-	}
+func (m *Manager) modelHandler(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, "model.html")
+}
 
-	if err := t.Execute(w, Models); err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
-		return
+// CreateModel stores the uploaded files of a model under data/. Uploading a
+// model with the name of an existing one adds a new revision of it.
+func (m *Manager) CreateModel(name, project string, user User, files map[string][]*multipart.FileHeader) (Model, error) {
+	if name == "" {
+		return Model{}, &RequestError{http.StatusBadRequest, "Missing Name"}
 	}
-}
 
-func modelAddHandler(w http.ResponseWriter, r *http.Request) {
-	type JSONResponse struct {
-		Success bool   `json:"success"`
-		Message string `json:"message"`
-		Model   *Model `json:"model"`
+	if strings.ContainsAny(name, "/\\@") || name == "." || name == ".." {
+		return Model{}, &RequestError{http.StatusBadRequest, "Invalid Name"}
 	}
 
-	if err := r.ParseMultipartForm(1 * 1024 * 1024); err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: "Unable to parse form", Model: nil})
-		return
+	project, err := m.ResolveProject(user, project)
+	if err != nil {
+		return Model{}, err
 	}
 
-	name := r.FormValue("name")
-	if name == "" {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: "Missing Name", Model: nil})
-		return
+	model := Model{Name: name, Revision: 1, Owner: user.Name, Project: project}
+	if latest, ok := m.FindModelRevision(name, 0); ok {
+		model.Revision = latest.Revision + 1
 	}
 
-	if err := os.Mkdir("data/"+name, 0755); err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: "Unable to create folder", Model: nil})
-		return
+	if err := os.Mkdir("data/"+model.Directory(), 0755); err != nil {
+		if os.IsExist(err) {
+			return Model{}, &RequestError{http.StatusConflict, "Model Exists"}
+		}
+		return Model{}, &RequestError{http.StatusInternalServerError, "Unable to create folder"}
 	}
 
-	model := Model{Name: name}
-	res, err := DB.Exec("insert into model(name) values (?)", model.Name)
+	res, err := DB.Exec("insert into model(name, revision, owner, project) values (?,?,?,?)", model.Name, model.Revision, model.Owner, model.Project)
 	if err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
-		return
+		return Model{}, err
 	}
 
 	id, err := res.LastInsertId()
 	if err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
-		return
+		return Model{}, err
 	}
 
 	model.ID = int(id)
 
-	for _, fileHeaders := range r.MultipartForm.File {
+	for _, fileHeaders := range files {
 		for _, fileHeader := range fileHeaders {
-			file, _ := fileHeader.Open()
-			buf, _ := ioutil.ReadAll(file)
-			ioutil.WriteFile(fmt.Sprintf("data/%s/%s", name, fileHeader.Filename), buf, os.ModePerm)
-			model.Files = append(model.Files, fileHeader.Filename)
-
-			if _, err := DB.Exec("insert into model_file(name, model_id) values (?, ?)", fileHeader.Filename, id); err != nil {
-				json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
-				return
+			filename := filepath.Base(fileHeader.Filename)
+
+			file, err := fileHeader.Open()
+			if err != nil {
+				return Model{}, err
+			}
+			buf, err := ioutil.ReadAll(file)
+			file.Close()
+			if err != nil {
+				return Model{}, err
 			}
-		}
-	}
 
-	json.NewEncoder(w).Encode(JSONResponse{Success: true, Message: "", Model: &model})
-}
+			if err := ioutil.WriteFile(fmt.Sprintf("data/%s/%s", model.Directory(), filename), buf, os.ModePerm); err != nil {
+				return Model{}, err
+			}
+			model.Files = append(model.Files, filename)
 
-func modelRemoveHandler(w http.ResponseWriter, r *http.Request) {
-	type JSONResponse struct {
-		Success bool   `json:"success"`
-		Message string `json:"message"`
+			if _, err := DB.Exec("insert into model_file(name, model_id) values (?, ?)", filename, id); err != nil {
+				return Model{}, err
+			}
+		}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-
-	id := r.FormValue("id")
-	if id == "" {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: "Missing Data"})
-		return
-	}
+	m.AddModel(model)
+	return model, nil
+}
 
-	var name string
-	if err := DB.QueryRow("SELECT name FROM model WHERE id = ?", id).Scan(&name); err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
-		return
+// DeleteModel removes a model and its files
+func (m *Manager) DeleteModel(id int) error {
+	model := Model{ID: id}
+	if err := DB.QueryRow("SELECT name, revision FROM model WHERE id = ?", id).Scan(&model.Name, &model.Revision); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrNotFound
+		}
+		return err
 	}
 
-	if err := os.RemoveAll("data/" + name); err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
-		return
+	if err := os.RemoveAll("data/" + model.Directory()); err != nil {
+		return err
 	}
 
 	if _, err := DB.Exec("DELETE FROM model_file WHERE model_id = ?", id); err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
-		return
+		return err
 	}
 
 	if _, err := DB.Exec("DELETE FROM model WHERE id = ?", id); err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
-		return
+		return err
 	}
 
-	json.NewEncoder(w).Encode(JSONResponse{Success: true})
+	m.RemoveModel(id)
+	return nil
 }
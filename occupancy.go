@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/LCLS/GPUManager/api"
+)
+
+// Percent of the memory of an idle GPU that may be in use before it is
+// treated as occupied by someone else
+var ExternalMemoryPercent = 10
+
+// computeAppsCommand lists the processes using each GPU with the fields
+// ParseComputeApps expects, in order
+const computeAppsCommand = "nvidia-smi --query-compute-apps=gpu_uuid,pid,process_name,used_memory --format=csv,noheader,nounits"
+
+// ComputeApp is a process running on a GPU
+type ComputeApp struct {
+	UUID       string
+	PID        int
+	Name       string
+	MemoryUsed int
+}
+
+// ParseComputeApps reads the output of computeAppsCommand. Memory nvidia-smi
+// cannot report is -1.
+func ParseComputeApps(output []byte) ([]ComputeApp, error) {
+	reader := csv.NewReader(bytes.NewReader(output))
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = 4
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var apps []ComputeApp
+	for _, record := range records {
+		pid, err := strconv.Atoi(strings.TrimSpace(record[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid pid %q", record[1])
+		}
+		apps = append(apps, ComputeApp{UUID: strings.TrimSpace(record[0]), PID: pid, Name: strings.TrimSpace(record[2]), MemoryUsed: telemetryInt(record[3])})
+	}
+	return apps, nil
+}
+
+// externalUse describes why a GPU we are not running anything on is
+// occupied by someone else, or returns "" if it is free. It is occupied if
+// any process is using it or, since processes in other containers are not
+// listed, if more than ExternalMemoryPercent of its memory is in use.
+func externalUse(uuid string, apps []ComputeApp, sample *api.Telemetry) string {
+	var processes []string
+	for _, app := range apps {
+		if app.UUID != uuid {
+			continue
+		}
+		if app.MemoryUsed >= 0 {
+			processes = append(processes, fmt.Sprintf("%s (pid %d, %d MiB)", app.Name, app.PID, app.MemoryUsed))
+		} else {
+			processes = append(processes, fmt.Sprintf("%s (pid %d)", app.Name, app.PID))
+		}
+	}
+	if len(processes) > 0 {
+		return "used by " + strings.Join(processes, ", ")
+	}
+
+	if sample != nil && sample.MemoryTotal > 0 && sample.MemoryUsed*100 > ExternalMemoryPercent*sample.MemoryTotal {
+		return fmt.Sprintf("%d of %d MiB of memory in use", sample.MemoryUsed, sample.MemoryTotal)
+	}
+	return ""
+}
+
+// ComputeApps lists the processes using the GPUs of the server
+func (s *Server) ComputeApps() ([]ComputeApp, error) {
+	client, err := s.SSH()
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	output, err := session.CombinedOutput(computeAppsCommand)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s", strings.TrimSpace(string(output)), err)
+	}
+	return ParseComputeApps(output)
+}
+
+// CheckExternal looks at the GPU again just before an instance is launched
+// on it, and returns why it is occupied by someone else, or "" if it is
+// free. The GPU is assumed free if it cannot be checked.
+func (r *Resource) CheckExternal(m *Manager) string {
+	samples, err := r.Parent.Telemetry()
+	if err != nil {
+		return ""
+	}
+
+	apps, err := r.Parent.ComputeApps()
+	if err != nil {
+		return ""
+	}
+	m.recordTelemetry(r.Parent, samples, apps)
+
+	var sample *api.Telemetry
+	for i := range samples {
+		if samples[i].UUID == r.UUID {
+			sample = &samples[i]
+		}
+	}
+	reason := externalUse(r.UUID, apps, sample)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r.external = reason
+	m.publishResource(r)
+	return reason
+}
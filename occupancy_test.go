@@ -0,0 +1,92 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/LCLS/GPUManager/api"
+)
+
+func TestParseComputeApps(t *testing.T) {
+	tests := []struct {
+		name     string
+		output   string
+		expected []ComputeApp
+		invalid  bool
+	}{
+		{
+			name: "processes",
+			output: "GPU-5bd4b1c2-0d83-3b6f-9c3a-8a2f6f0e1d11, 24151, /usr/local/bin/ProtoMol, 10210\n" +
+				"GPU-5bd4b1c2-0d83-3b6f-9c3a-8a2f6f0e1d11, 3311, python3, 812\n" +
+				"GPU-0e7a9c45-2a11-7f0b-1c9e-3d4e5f6a7b8c, 9002, /opt/conda/bin/python, 2048\n",
+			expected: []ComputeApp{
+				{UUID: "GPU-5bd4b1c2-0d83-3b6f-9c3a-8a2f6f0e1d11", PID: 24151, Name: "/usr/local/bin/ProtoMol", MemoryUsed: 10210},
+				{UUID: "GPU-5bd4b1c2-0d83-3b6f-9c3a-8a2f6f0e1d11", PID: 3311, Name: "python3", MemoryUsed: 812},
+				{UUID: "GPU-0e7a9c45-2a11-7f0b-1c9e-3d4e5f6a7b8c", PID: 9002, Name: "/opt/conda/bin/python", MemoryUsed: 2048},
+			},
+		},
+		{
+			name: "memory not reported",
+			output: "GPU-9f1c2d3e-4b5a-6978-8a9b-0c1d2e3f4a5b, 4410, [Not Found], [N/A]\n" +
+				"GPU-1a2b3c4d-5e6f-7081-92a3-b4c5d6e7f809, 4411, gmx, [Not Supported]\n",
+			expected: []ComputeApp{
+				{UUID: "GPU-9f1c2d3e-4b5a-6978-8a9b-0c1d2e3f4a5b", PID: 4410, Name: "[Not Found]", MemoryUsed: -1},
+				{UUID: "GPU-1a2b3c4d-5e6f-7081-92a3-b4c5d6e7f809", PID: 4411, Name: "gmx", MemoryUsed: -1},
+			},
+		},
+		{name: "no processes", output: ""},
+		{name: "pid not reported", output: "GPU-5bd4b1c2-0d83-3b6f-9c3a-8a2f6f0e1d11, [N/A], python3, 812\n", invalid: true},
+		{name: "missing fields", output: "GPU-5bd4b1c2-0d83-3b6f-9c3a-8a2f6f0e1d11, 24151\n", invalid: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			apps, err := ParseComputeApps([]byte(test.output))
+			if test.invalid {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", apps)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(apps, test.expected) {
+				t.Errorf("expected %+v, got %+v", test.expected, apps)
+			}
+		})
+	}
+}
+
+func TestExternalUse(t *testing.T) {
+	defer func(percent int) { ExternalMemoryPercent = percent }(ExternalMemoryPercent)
+	ExternalMemoryPercent = 10
+
+	const uuid = "GPU-5bd4b1c2-0d83-3b6f-9c3a-8a2f6f0e1d11"
+	apps := []ComputeApp{
+		{UUID: uuid, PID: 3311, Name: "python3", MemoryUsed: 812},
+		{UUID: uuid, PID: 4410, Name: "gmx", MemoryUsed: -1},
+		{UUID: "GPU-0e7a9c45-2a11-7f0b-1c9e-3d4e5f6a7b8c", PID: 9002, Name: "python", MemoryUsed: 2048},
+	}
+
+	tests := []struct {
+		name     string
+		apps     []ComputeApp
+		sample   *api.Telemetry
+		expected string
+	}{
+		{name: "processes", apps: apps, expected: "used by python3 (pid 3311, 812 MiB), gmx (pid 4410)"},
+		{name: "memory in use", sample: &api.Telemetry{MemoryUsed: 4096, MemoryTotal: 16384}, expected: "4096 of 16384 MiB of memory in use"},
+		{name: "driver memory", sample: &api.Telemetry{MemoryUsed: 300, MemoryTotal: 16384}},
+		{name: "memory not reported", sample: &api.Telemetry{MemoryUsed: -1, MemoryTotal: -1}},
+		{name: "idle", apps: apps[2:]},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := externalUse(uuid, test.apps, test.sample); got != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, got)
+			}
+		})
+	}
+}
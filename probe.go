@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LCLS/GPUManager/api"
+	"golang.org/x/crypto/ssh"
+)
+
+// Free space in GB the working directory of a server must have to pass its
+// probe
+var ProbeMinDiskGB = 10
+
+// ProbeError refuses a server that failed its probe. The report is returned
+// with the error.
+type ProbeError struct {
+	Probe api.Probe
+}
+
+func (e *ProbeError) Error() string {
+	var failed []string
+	for _, check := range e.Probe.Checks {
+		if !check.Passed && !check.Optional {
+			failed = append(failed, check.Name+": "+check.Error)
+		}
+	}
+	return "Server failed its checks, " + strings.Join(failed, "; ")
+}
+
+// probeCheck runs a command on the server and passes it to parse, which
+// returns the value found. A command that fails fails the check with
+// failure.
+func probeCheck(client *ssh.Client, name, command, failure string, parse func(output string) (string, error)) api.ProbeCheck {
+	check := api.ProbeCheck{Name: name}
+
+	session, err := client.NewSession()
+	if err != nil {
+		check.Error = "Unable to create session"
+		return check
+	}
+	defer session.Close()
+
+	output, err := session.Output(command)
+	if err != nil {
+		check.Error = failure
+		return check
+	}
+
+	if check.Value, err = parse(strings.TrimSpace(string(output))); err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	check.Passed = true
+	return check
+}
+
+// firstLine returns the output as the value if there is any
+func firstLine(output string) (string, error) {
+	line, _, _ := strings.Cut(output, "\n")
+	if line == "" {
+		return "", fmt.Errorf("no output")
+	}
+	return line, nil
+}
+
+// afterSetup runs the command after the setup of a server, hiding what the
+// setup prints. The group starts with a no-op, as it may otherwise hold only
+// comments.
+func afterSetup(setup, command string) string {
+	return "{\n:\n" + setup + "} > /dev/null 2>&1\n" + command
+}
+
+// probeServer checks that the server has what instances need: a writable
+// working directory, ProtoMol and Python on the PATH after the setup of the
+// server, a CUDA driver, free disk space and access to /proc to follow
+// processes. A server with a container runtime may run every template in a
+// container, so it is not required to have ProtoMol or Python itself.
+func probeServer(client *ssh.Client, wdir, setup string) api.Probe {
+	cd := ""
+	dir := "."
+	if wdir != "" {
+		cd = "cd " + wdir + " && "
+		dir = wdir
+	}
+
+	probe := api.Probe{Time: time.Now().UTC(), Passed: true}
+	probe.Checks = []api.ProbeCheck{
+		probeCheck(client, api.ProbeWorkingDirectory, cd+"touch .gpumanager-probe && rm .gpumanager-probe && pwd", fmt.Sprintf("%s does not exist or is not writable", dir), firstLine),
+		probeCheck(client, api.ProbeContainers, afterSetup(setup, "command -v apptainer || command -v singularity || command -v docker"), "No container runtime on the PATH", firstLine),
+		probeCheck(client, api.ProbeProtoMol, afterSetup(setup, "command -v ProtoMol"), "ProtoMol is not on the PATH", firstLine),
+		probeCheck(client, api.ProbePython, afterSetup(setup, "command -v python && python --version 2>&1"), "python is not on the PATH", func(output string) (string, error) {
+			return strings.Join(strings.Fields(output), " "), nil
+		}),
+		probeCheck(client, api.ProbeCUDADriver, "nvidia-smi --query-gpu=driver_version --format=csv,noheader | head -1 && nvidia-smi | grep -o 'CUDA Version: [0-9.]*'", "Unable to read the driver version from nvidia-smi", func(output string) (string, error) {
+			driver, cuda, _ := strings.Cut(output, "\n")
+			return fmt.Sprintf("%s (%s)", driver, strings.TrimSpace(cuda)), nil
+		}),
+		probeCheck(client, api.ProbeDiskSpace, "df -Pk "+dir+" | tail -1", "Unable to read the free space of "+dir, func(output string) (string, error) {
+			fields := strings.Fields(output)
+			if len(fields) < 4 {
+				return "", fmt.Errorf("Unable to read the free space of %s", dir)
+			}
+			available, err := strconv.ParseUint(fields[3], 10, 64)
+			if err != nil {
+				return "", err
+			}
+
+			value := fmt.Sprintf("%.1f GB free", float64(available)/(1024*1024))
+			if available < uint64(ProbeMinDiskGB)*1024*1024 {
+				return value, fmt.Errorf("%s, at least %d GB are needed", value, ProbeMinDiskGB)
+			}
+			return value, nil
+		}),
+		probeCheck(client, api.ProbeProc, "cat /proc/self/status > /dev/null && tr '\\0' ' ' < /proc/$$/cmdline > /dev/null && readlink /proc/$$/cwd", "Unable to read process state from /proc", firstLine),
+	}
+
+	containers := false
+	for _, check := range probe.Checks {
+		containers = containers || check.Name == api.ProbeContainers && check.Passed
+	}
+	for i := range probe.Checks {
+		switch probe.Checks[i].Name {
+		case api.ProbeContainers:
+			probe.Checks[i].Optional = true
+		case api.ProbeProtoMol, api.ProbePython:
+			probe.Checks[i].Optional = containers
+		}
+		probe.Passed = probe.Passed && (probe.Checks[i].Passed || probe.Checks[i].Optional)
+	}
+	return probe
+}
+
+// saveProbe stores the report of the last probe of a server
+func saveProbe(id int, probe api.Probe) error {
+	data, err := json.Marshal(probe)
+	if err != nil {
+		return err
+	}
+
+	_, err = DB.Exec("update server set probe = ? where id = ?", string(data), id)
+	return err
+}
+
+// ProbeServer checks a server again and stores the report. A server that
+// fails is not disabled, but the report shows what it is missing.
+func (m *Manager) ProbeServer(id int) (api.Probe, error) {
+	m.mu.RLock()
+	server := FindServer(id, m.servers)
+	m.mu.RUnlock()
+
+	if server == nil {
+		return api.Probe{}, ErrNotFound
+	}
+
+	client, err := server.SSH()
+	if err != nil {
+		return api.Probe{}, &RequestError{http.StatusBadGateway, fmt.Sprintf("Error connecting to %s", server.URL)}
+	}
+
+	m.mu.RLock()
+	wdir := server.WorkingDirectory
+	setup := setupScript(server, nil)
+	m.mu.RUnlock()
+
+	probe := probeServer(client, wdir, setup)
+	if err := saveProbe(id, probe); err != nil {
+		return probe, err
+	}
+
+	if !probe.Passed {
+		log.Println("[Probe]", server.URL, (&ProbeError{probe}).Error())
+	}
+
+	m.mu.Lock()
+	server.probe = &probe
+	m.publishServer(server)
+	m.mu.Unlock()
+
+	return probe, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/LCLS/GPUManager/api"
+)
+
+// probeTools is a directory holding the tools the probe uses and the named
+// stubs, to serve as the whole PATH of a test server
+func probeTools(t *testing.T, stubs map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for _, tool := range []string{"bash", "touch", "rm", "df", "tail", "head", "grep", "cat", "tr", "readlink"} {
+		path, err := exec.LookPath(tool)
+		if err != nil {
+			t.Skip(tool, "not found")
+		}
+		if err := os.Symlink(path, filepath.Join(dir, tool)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, script := range stubs {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/bash\n"+script+"\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// nvidiaSMI answers the two queries of the CUDA driver check
+const nvidiaSMI = `if [ "$1" = "--query-gpu=driver_version" ]; then echo 535.104.05; else echo "| NVIDIA-SMI 535.104.05   Driver Version: 535.104.05   CUDA Version: 12.2 |"; fi`
+
+func TestProbeServer(t *testing.T) {
+	tests := []struct {
+		name   string
+		stubs  map[string]string
+		passed bool
+		failed []string
+	}{
+		{name: "native", stubs: map[string]string{"nvidia-smi": nvidiaSMI, "ProtoMol": "", "python": "echo Python 3.11.4"}, passed: true, failed: []string{api.ProbeContainers}},
+		{name: "containers only", stubs: map[string]string{"nvidia-smi": nvidiaSMI, "apptainer": ""}, passed: true, failed: []string{api.ProbeProtoMol, api.ProbePython}},
+		{name: "neither", stubs: map[string]string{"nvidia-smi": nvidiaSMI, "python": "echo Python 3.11.4"}, passed: false, failed: []string{api.ProbeContainers, api.ProbeProtoMol}},
+		{name: "no driver", stubs: map[string]string{"docker": ""}, passed: false, failed: []string{api.ProbeProtoMol, api.ProbePython, api.ProbeCUDADriver}},
+	}
+
+	defer func(min int) { ProbeMinDiskGB = min }(ProbeMinDiskGB)
+	ProbeMinDiskGB = 0
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			ts.env = []string{"PATH=" + probeTools(t, test.stubs)}
+
+			probe := probeServer(ts.dial(t), t.TempDir(), "")
+			if probe.Passed != test.passed {
+				t.Errorf("expected passed %t, got %+v", test.passed, probe)
+			}
+
+			failed := map[string]bool{}
+			for _, check := range probe.Checks {
+				if !check.Passed {
+					failed[check.Name] = true
+				}
+			}
+			for _, name := range test.failed {
+				if !failed[name] {
+					t.Errorf("expected %s to fail, got %+v", name, probe.Checks)
+				}
+				delete(failed, name)
+			}
+			for name := range failed {
+				t.Errorf("unexpected failure of %s: %+v", name, probe.Checks)
+			}
+		})
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/LCLS/GPUManager/api"
+)
+
+// Project is a research group that owns jobs, models and templates, and whose
+// use of the farm is limited. A limit of zero means no limit.
+type Project struct {
+	ID           int
+	Name         string
+	Members      []string
+	MaxGPUs      int
+	MaxGPUHours  float64
+	MaxInstances int
+
+	// GPU-hours used by finished runs this month, and the start of the
+	// resources running instances of the project. Both are guarded by the
+	// manager lock.
+	used    float64
+	month   time.Time
+	running map[*Resource]time.Time
+}
+
+// monthStart returns the start of the month t is in, which is when GPU-hour
+// quotas are reset
+func monthStart(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+}
+
+// GPUHours returns the GPU-hours used this month, including the time so far
+// of runs that have not finished
+func (p *Project) GPUHours(now time.Time) float64 {
+	start := monthStart(now)
+
+	hours := 0.0
+	if p.month.Equal(start) {
+		hours = p.used
+	}
+	for _, started := range p.running {
+		if started.Before(start) {
+			started = start
+		}
+		hours += now.Sub(started).Hours()
+	}
+	return hours
+}
+
+// Allows reports whether the project may start another instance
+func (p *Project) Allows(now time.Time) bool {
+	if p.MaxGPUs > 0 && len(p.running) >= p.MaxGPUs {
+		return false
+	}
+	return p.MaxGPUHours <= 0 || p.GPUHours(now) < p.MaxGPUHours
+}
+
+// HasMember reports whether the user belongs to the project
+func (p *Project) HasMember(name string) bool {
+	for _, member := range p.Members {
+		if member == name {
+			return true
+		}
+	}
+	return false
+}
+
+// claim records that the resource has started running an instance of the
+// project
+func (p *Project) claim(r *Resource, now time.Time) {
+	p.running[r] = now
+}
+
+// release records the use of a resource once it has finished running an
+// instance of the project
+func (p *Project) release(r *Resource, now time.Time) {
+	started, ok := p.running[r]
+	if !ok {
+		return
+	}
+	delete(p.running, r)
+
+	if _, err := DB.Exec("insert into gpu_usage(project_id, resource, start, end) values (?,?,?,?)", p.ID, r.UUID, started, now); err != nil {
+		log.Println("[Project] Unable to record usage of", p.Name, ":", err)
+	}
+
+	start := monthStart(now)
+	if started.Before(start) {
+		started = start
+	}
+	if !p.month.Equal(start) {
+		p.used = 0
+		p.month = start
+	}
+	p.used += now.Sub(started).Hours()
+}
+
+// API returns the representation of the project used by the JSON API. It
+// must be called with the manager lock held.
+func (p *Project) API() api.Project {
+	members := p.Members
+	if members == nil {
+		members = []string{}
+	}
+	return api.Project{ID: p.ID, Name: p.Name, Members: members, MaxGPUs: p.MaxGPUs, MaxGPUHours: p.MaxGPUHours, MaxInstances: p.MaxInstances, GPUsInUse: len(p.running), GPUHoursUsed: p.GPUHours(time.Now())}
+}
+
+func FindProject(name string, projects []*Project) *Project {
+	for _, project := range projects {
+		if project.Name == name {
+			return project
+		}
+	}
+	return nil
+}
+
+func FindProjectByID(id int, projects []*Project) *Project {
+	for _, project := range projects {
+		if project.ID == id {
+			return project
+		}
+	}
+	return nil
+}
+
+func LoadProjects(db *sql.DB) ([]*Project, error) {
+	rows, err := db.Query("SELECT id, name, max_gpus, max_gpu_hours, max_instances FROM project")
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var projects []*Project
+	for rows.Next() {
+		project := &Project{month: monthStart(now), running: make(map[*Resource]time.Time)}
+		if err := rows.Scan(&project.ID, &project.Name, &project.MaxGPUs, &project.MaxGPUHours, &project.MaxInstances); err != nil {
+			return nil, err
+		}
+		projects = append(projects, project)
+	}
+	rows.Close()
+
+	for _, project := range projects {
+		rows, err := db.Query("SELECT user FROM project_member WHERE project_id = ? ORDER BY user", project.ID)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var user string
+			if err := rows.Scan(&user); err != nil {
+				return nil, err
+			}
+			project.Members = append(project.Members, user)
+		}
+		rows.Close()
+
+		rows, err = db.Query("SELECT start, end FROM gpu_usage WHERE project_id = ? AND end >= ?", project.ID, project.month)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var start, end time.Time
+			if err := rows.Scan(&start, &end); err != nil {
+				return nil, err
+			}
+			if start.Before(project.month) {
+				start = project.month
+			}
+			project.used += end.Sub(start).Hours()
+		}
+		rows.Close()
+	}
+	return projects, nil
+}
+
+func saveMembers(id int, members []string) error {
+	if _, err := DB.Exec("DELETE FROM project_member WHERE project_id = ?", id); err != nil {
+		return err
+	}
+	for _, member := range members {
+		if _, err := DB.Exec("insert into project_member(project_id, user) values (?,?)", id, member); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanMembers drops empty and repeated names
+func cleanMembers(members []string) []string {
+	var clean []string
+	for _, member := range members {
+		member = strings.TrimSpace(member)
+		if member == "" {
+			continue
+		}
+		duplicate := false
+		for _, c := range clean {
+			duplicate = duplicate || c == member
+		}
+		if !duplicate {
+			clean = append(clean, member)
+		}
+	}
+	return clean
+}
+
+func validLimits(gpus int, hours float64, instances int) bool {
+	return gpus >= 0 && hours >= 0 && instances >= 0
+}
+
+func (m *Manager) CreateProject(request api.ProjectRequest) (*Project, error) {
+	if request.Name == "" {
+		return nil, &RequestError{http.StatusBadRequest, "Missing Name"}
+	}
+	if !validLimits(request.MaxGPUs, request.MaxGPUHours, request.MaxInstances) {
+		return nil, &RequestError{http.StatusBadRequest, "Invalid Limits"}
+	}
+
+	m.mu.RLock()
+	exists := FindProject(request.Name, m.projects) != nil
+	m.mu.RUnlock()
+	if exists {
+		return nil, &RequestError{http.StatusConflict, "Project Exists"}
+	}
+
+	res, err := DB.Exec("insert into project(name, max_gpus, max_gpu_hours, max_instances) values (?,?,?,?)", request.Name, request.MaxGPUs, request.MaxGPUHours, request.MaxInstances)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	project := &Project{ID: int(id), Name: request.Name, Members: cleanMembers(request.Members), MaxGPUs: request.MaxGPUs, MaxGPUHours: request.MaxGPUHours, MaxInstances: request.MaxInstances, month: monthStart(now), running: make(map[*Resource]time.Time)}
+	if err := saveMembers(project.ID, project.Members); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	m.projects = append(m.projects, project)
+	m.mu.Unlock()
+	return project, nil
+}
+
+// UpdateProject changes the limits and members of a project that are set.
+// Lowering a limit does not stop instances that are already running.
+func (m *Manager) UpdateProject(id int, update api.ProjectUpdate) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	project := FindProjectByID(id, m.projects)
+	if project == nil {
+		return ErrNotFound
+	}
+
+	gpus, hours, instances := project.MaxGPUs, project.MaxGPUHours, project.MaxInstances
+	if update.MaxGPUs != nil {
+		gpus = *update.MaxGPUs
+	}
+	if update.MaxGPUHours != nil {
+		hours = *update.MaxGPUHours
+	}
+	if update.MaxInstances != nil {
+		instances = *update.MaxInstances
+	}
+	if !validLimits(gpus, hours, instances) {
+		return &RequestError{http.StatusBadRequest, "Invalid Limits"}
+	}
+
+	if _, err := DB.Exec("update project set max_gpus = ?, max_gpu_hours = ?, max_instances = ? where id = ?", gpus, hours, instances, id); err != nil {
+		return err
+	}
+	project.MaxGPUs, project.MaxGPUHours, project.MaxInstances = gpus, hours, instances
+
+	if update.Members != nil {
+		members := cleanMembers(*update.Members)
+		if err := saveMembers(id, members); err != nil {
+			return err
+		}
+		project.Members = members
+	}
+	return nil
+}
+
+// DeleteProject removes a project that nothing belongs to any more
+func (m *Manager) DeleteProject(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	project := FindProjectByID(id, m.projects)
+	if project == nil {
+		return ErrNotFound
+	}
+
+	inUse := false
+	for _, job := range m.jobs {
+		inUse = inUse || job.Project == project.Name
+	}
+	for _, model := range m.models {
+		inUse = inUse || model.Project == project.Name
+	}
+	for _, template := range m.templates {
+		inUse = inUse || template.Project == project.Name
+	}
+	if inUse {
+		return &RequestError{http.StatusConflict, "Project In Use"}
+	}
+
+	if _, err := DB.Exec("DELETE FROM project_member WHERE project_id = ?", id); err != nil {
+		return err
+	}
+	if _, err := DB.Exec("DELETE FROM gpu_usage WHERE project_id = ?", id); err != nil {
+		return err
+	}
+	if _, err := DB.Exec("DELETE FROM project WHERE id = ?", id); err != nil {
+		return err
+	}
+
+	for i := 0; i < len(m.projects); i++ {
+		if m.projects[i].ID == id {
+			m.projects = append(m.projects[:i], m.projects[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// ResolveProject returns the project something created by the user belongs
+// to. Users must be members of the project they name. If they name none and
+// belong to exactly one, that is used.
+func (m *Manager) ResolveProject(user User, name string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if name != "" {
+		project := FindProject(name, m.projects)
+		if project == nil {
+			return "", &RequestError{http.StatusBadRequest, "Unknown Project " + name}
+		}
+		if !project.HasMember(user.Name) && !user.Can(api.RoleAdmin) {
+			return "", &RequestError{http.StatusForbidden, "Not a member of project " + name}
+		}
+		return name, nil
+	}
+
+	var member []string
+	for _, project := range m.projects {
+		if project.HasMember(user.Name) {
+			member = append(member, project.Name)
+		}
+	}
+
+	switch len(member) {
+	case 0:
+		return "", nil
+	case 1:
+		return member[0], nil
+	}
+	return "", &RequestError{http.StatusBadRequest, "Missing Project, you belong to " + strings.Join(member, ", ")}
+}
+
+// checkJobProject refuses jobs with more instances than their project
+// allows, and jobs in no project once there are projects, as their limits
+// would not apply
+func (m *Manager) checkJobProject(project string, count int) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if project == "" && len(m.projects) > 0 {
+		return &RequestError{http.StatusBadRequest, "Missing Project, jobs must belong to a project"}
+	}
+	if p := FindProject(project, m.projects); p != nil && p.MaxInstances > 0 && count > p.MaxInstances {
+		return &RequestError{http.StatusBadRequest, fmt.Sprintf("Project %s allows at most %d instances per job", project, p.MaxInstances)}
+	}
+	return nil
+}
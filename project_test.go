@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/LCLS/GPUManager/api"
+)
+
+// TestJobProject checks the project a job is put in, and that it cannot
+// escape the limits of the projects by belonging to none
+func TestJobProject(t *testing.T) {
+	alice := User{Name: "alice", Role: api.RoleUser}
+	bob := User{Name: "bob", Role: api.RoleUser}
+	admin := User{Name: "admin", Role: api.RoleAdmin}
+	structure := &Project{ID: 1, Name: "structure", Members: []string{"alice"}, MaxInstances: 2}
+
+	tests := []struct {
+		name     string
+		projects []*Project
+		user     User
+		project  string
+		count    int
+		expected string
+		invalid  bool
+	}{
+		{name: "named", projects: []*Project{structure}, user: alice, project: "structure", count: 2, expected: "structure"},
+		{name: "only membership", projects: []*Project{structure}, user: alice, count: 1, expected: "structure"},
+		{name: "too many instances", projects: []*Project{structure}, user: alice, count: 3, invalid: true},
+		{name: "not a member", projects: []*Project{structure}, user: bob, project: "structure", count: 1, invalid: true},
+		{name: "no membership", projects: []*Project{structure}, user: bob, count: 1, invalid: true},
+		{name: "admin without a project", projects: []*Project{structure}, user: admin, count: 1, invalid: true},
+		{name: "admin in any project", projects: []*Project{structure}, user: admin, project: "structure", count: 1, expected: "structure"},
+		{name: "no projects", user: bob, count: 5},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := NewManager()
+			m.projects = test.projects
+
+			project, err := m.ResolveProject(test.user, test.project)
+			if err == nil {
+				err = m.checkJobProject(project, test.count)
+			}
+			if test.invalid {
+				if err == nil {
+					t.Fatalf("expected an error, got project %q", project)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if project != test.expected {
+				t.Errorf("expected project %q, got %q", test.expected, project)
+			}
+		})
+	}
+}
+
+// TestGPUHours checks that GPU-hours are counted from the start of the
+// month, and that runs finished in an earlier month are not
+func TestGPUHours(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	month := monthStart(now)
+	resource := &Resource{UUID: "GPU-1"}
+
+	tests := []struct {
+		name     string
+		month    time.Time
+		used     float64
+		started  time.Time
+		expected float64
+	}{
+		{name: "unused", month: month},
+		{name: "finished this month", month: month, used: 2, expected: 2},
+		{name: "finished last month", month: monthStart(month.Add(-time.Hour)), used: 2},
+		{name: "running", month: month, used: 2, started: now.Add(-3 * time.Hour), expected: 5},
+		{name: "running since last month", month: month, started: month.Add(-24 * time.Hour), expected: now.Sub(month).Hours()},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			project := &Project{Name: "structure", used: test.used, month: test.month, running: map[*Resource]time.Time{}}
+			if !test.started.IsZero() {
+				project.running[resource] = test.started
+			}
+			if hours := project.GPUHours(now); math.Abs(hours-test.expected) > 1e-9 {
+				t.Errorf("expected %g GPU-hours, got %g", test.expected, hours)
+			}
+		})
+	}
+}
+
+// TestRelease checks that a run finishing in a new month only counts from
+// the start of that month, and that the whole run is recorded
+func TestRelease(t *testing.T) {
+	newTestDB(t)
+	if _, err := DB.Exec("insert into project(id, name) values (1, 'structure')"); err != nil {
+		t.Fatal(err)
+	}
+
+	september := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	october := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	resource := &Resource{UUID: "GPU-1"}
+	project := &Project{ID: 1, Name: "structure", used: 5, month: september, running: map[*Resource]time.Time{}}
+
+	project.claim(resource, october.Add(-2*time.Hour))
+	project.release(resource, october.Add(time.Hour))
+
+	if !project.month.Equal(october) || project.used != 1 {
+		t.Errorf("expected 1 GPU-hour in October, got %g from %s", project.used, project.month)
+	}
+	if len(project.running) != 0 {
+		t.Error("resource still running")
+	}
+
+	var hours float64
+	if err := DB.QueryRow("SELECT (julianday(end) - julianday(start)) * 24 FROM gpu_usage WHERE project_id = 1").Scan(&hours); err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(hours-3) > 1e-6 {
+		t.Errorf("expected 3 GPU-hours recorded, got %g", hours)
+	}
+}
+
+// TestNextQuota checks that instances of a project are only dispatched
+// while it has GPUs and GPU-hours left, at the times of each step
+func TestNextQuota(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	nextMonth := time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)
+
+	type step struct {
+		at         time.Time
+		release    bool
+		resource   int
+		dispatched bool
+	}
+	tests := []struct {
+		name    string
+		project Project
+		steps   []step
+	}{
+		{name: "gpus", project: Project{MaxGPUs: 2}, steps: []step{
+			{at: now, resource: 0, dispatched: true},
+			{at: now, resource: 1, dispatched: true},
+			{at: now, resource: 2},
+			{at: now.Add(time.Hour), release: true, resource: 0},
+			{at: now.Add(time.Hour), resource: 2, dispatched: true},
+		}},
+		{name: "gpu hours", project: Project{MaxGPUHours: 2}, steps: []step{
+			{at: now, resource: 0, dispatched: true},
+			{at: now.Add(90 * time.Minute), resource: 1, dispatched: true},
+			{at: now.Add(2 * time.Hour), resource: 2},
+			{at: now.Add(2 * time.Hour), release: true, resource: 0},
+			{at: now.Add(2 * time.Hour), release: true, resource: 1},
+			{at: now.Add(3 * time.Hour), resource: 2},
+			{at: nextMonth, resource: 2, dispatched: true},
+		}},
+		{name: "gpu hours across months", project: Project{MaxGPUHours: 2}, steps: []step{
+			{at: nextMonth.Add(-3 * time.Hour), resource: 0, dispatched: true},
+			{at: nextMonth.Add(90 * time.Minute), resource: 1, dispatched: true},
+			{at: nextMonth.Add(2 * time.Hour), resource: 2},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			newTestDB(t)
+			if _, err := DB.Exec("insert into project(id, name) values (1, 'structure')"); err != nil {
+				t.Fatal(err)
+			}
+
+			m := NewManager()
+			project := test.project
+			project.ID, project.Name, project.month, project.running = 1, "structure", monthStart(test.steps[0].at), map[*Resource]time.Time{}
+			m.projects = []*Project{&project}
+
+			server := &Server{ID: 1, URL: "gpu01", Enabled: true}
+			for i := 0; i < 3; i++ {
+				server.Resources = append(server.Resources, &Resource{UUID: fmt.Sprintf("GPU-%d", i), Enabled: true, Parent: server})
+			}
+			m.servers = []*Server{server}
+
+			job := newTestJob(t, m, 1, "quota", "echo done", 3)
+			job.Project = "structure"
+
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			for i, step := range test.steps {
+				resource := server.Resources[step.resource]
+				if step.release {
+					m.release(resource, step.at)
+					continue
+				}
+				instance, _, _ := m.next(resource, step.at)
+				if dispatched := instance != nil; dispatched != step.dispatched {
+					t.Errorf("step %d: expected dispatched %v on %s at %s, got %v with %g GPU-hours used", i, step.dispatched, resource.UUID, step.at, dispatched, project.GPUHours(step.at))
+				}
+			}
+		})
+	}
+}
+
+// TestLoadProjectsUsage checks that the GPU-hours used this month are
+// reloaded from what was recorded
+func TestLoadProjectsUsage(t *testing.T) {
+	newTestDB(t)
+	month := monthStart(time.Now())
+
+	if _, err := DB.Exec("insert into project(id, name, max_gpu_hours) values (1, 'structure', 10), (2, 'docking', 0)"); err != nil {
+		t.Fatal(err)
+	}
+	usage := []struct {
+		project    int
+		start, end time.Time
+	}{
+		{1, month.Add(-48 * time.Hour), month.Add(-24 * time.Hour)},
+		{1, month.Add(-time.Hour), month.Add(time.Hour)},
+		{1, month.Add(2 * time.Hour), month.Add(5 * time.Hour)},
+		{2, month.Add(2 * time.Hour), month.Add(9 * time.Hour)},
+	}
+	for _, u := range usage {
+		if _, err := DB.Exec("insert into gpu_usage(project_id, resource, start, end) values (?, 'GPU-1', ?, ?)", u.project, u.start, u.end); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	projects, err := LoadProjects(DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]float64{"structure": 4, "docking": 7} {
+		project := FindProject(name, projects)
+		if project == nil {
+			t.Fatalf("%s not loaded", name)
+		}
+		if hours := project.GPUHours(month.Add(6 * time.Hour)); math.Abs(hours-expected) > 1e-9 {
+			t.Errorf("%s: expected %g GPU-hours, got %g", name, expected, hours)
+		}
+	}
+}
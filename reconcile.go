@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RemoteStatus is what the compute server reports about a started instance
+type RemoteStatus struct {
+	// Alive is set if the recorded PID is running and is not a zombie
+	Alive bool
+
+	// Ours is set if the running process is the simulation we started, as
+	// opposed to an unrelated process that has reused the PID, and Command
+	// is its command line
+	Ours    bool
+	Command string
+
+	// Exited is set if the instance wrote its exit status
+	Exited   bool
+	ExitCode int
+}
+
+// statusCommand builds the shell script that reports the RemoteStatus of an
+// instance. Every line of output is a key followed by its value.
+func statusCommand(wdir, directory string, pid int) string {
+	command := ""
+	if wdir != "" {
+		command += "cd " + wdir + "\n"
+	}
+	command += "cd job/" + directory + " || exit 0\n"
+	command += "if [ -f exit-status ]; then echo \"exit $(cat exit-status)\"; fi\n"
+	command += "if [ -f pidfile ]; then echo \"pidfile $(cat pidfile)\"; fi\n"
+	command += fmt.Sprintf("if [[ -d /proc/%d && -z `grep zombie /proc/%d/status` ]]; then\n", pid, pid)
+	command += "  echo alive\n"
+	command += fmt.Sprintf("  echo \"cmdline $(tr '\\0' ' ' < /proc/%d/cmdline)\"\n", pid)
+	command += fmt.Sprintf("  echo \"cwd $(readlink /proc/%d/cwd)\"\n", pid)
+	command += "fi\n"
+	return command
+}
+
+// ParseRemoteStatus interprets the output of statusCommand for an instance
+// that was started with the given PID, in the given directory relative to
+// the job directory. The process is ours if the instance recorded its PID
+// and it runs in the directory of the instance. Its executable is not
+// checked, as a simulation run in a container is an apptainer, singularity
+// or docker process.
+func ParseRemoteStatus(output string, pid int, directory string) (RemoteStatus, error) {
+	var status RemoteStatus
+	var pidfile, cwd string
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		parts := strings.SplitN(strings.TrimSpace(scanner.Text()), " ", 2)
+		value := ""
+		if len(parts) == 2 {
+			value = strings.TrimSpace(parts[1])
+		}
+
+		switch parts[0] {
+		case "exit":
+			code, err := strconv.Atoi(value)
+			if err != nil {
+				return status, fmt.Errorf("invalid exit status %q", value)
+			}
+			status.Exited = true
+			status.ExitCode = code
+		case "pidfile":
+			pidfile = value
+		case "alive":
+			status.Alive = true
+		case "cmdline":
+			status.Command = value
+		case "cwd":
+			cwd = value
+		}
+	}
+
+	if status.Alive {
+		status.Ours = pidfile == strconv.Itoa(pid) && strings.HasSuffix(cwd, "/job/"+directory)
+	}
+
+	return status, nil
+}
+
+// RemoteStatus asks the server the instance was started on what happened to
+// it
+func (r *Resource) RemoteStatus(jobInstance *JobInstance, pid int) (RemoteStatus, error) {
+	client, err := r.Parent.SSH()
+	if err != nil {
+		return RemoteStatus{}, err
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return RemoteStatus{}, err
+	}
+	defer session.Close()
+
+	output, err := session.CombinedOutput(statusCommand(r.Parent.WorkingDirectory, jobInstance.Directory(), pid))
+	if err != nil {
+		return RemoteStatus{}, fmt.Errorf("%s %s", strings.TrimSpace(string(output)), err)
+	}
+
+	return ParseRemoteStatus(string(output), pid, jobInstance.Directory())
+}
+
+// Reconcile runs once at startup. It compares every unfinished instance with
+// what is actually on its compute server and queues it accordingly:
+//
+//   - not started: queued for any resource
+//   - archived and exited: marked completed, or failed if it exited non-zero
+//   - exited but not archived: pinned to its resource to be archived
+//   - still running and ours: pinned to its resource to be waited on
+//   - gone without an exit status, or the PID belongs to someone else:
+//     queued to be run again from the start
+//   - server unreachable: pinned to its resource, which retries the check
+//
+// The servers are asked about their instances first, all at once, and the
+// instances then queued in order.
+func (m *Manager) Reconcile() {
+	m.mu.RLock()
+	var pending []*JobInstance
+	for _, job := range m.jobs {
+		for _, instance := range job.Instances {
+			// Cancelled instances only need attention if their process
+			// may still be running or their results are not yet archived
+			if instance.Cancelled && (instance.PID == -1 || instance.Archived) {
+				continue
+			}
+			if !instance.Completed && !instance.Failed {
+				pending = append(pending, instance)
+			}
+		}
+	}
+	m.mu.RUnlock()
+
+	checks := m.checkRemote(pending)
+	for _, instance := range pending {
+		if err := m.reconcile(instance, checks[instance]); err != nil {
+			log.Println("[Reconcile] Instance", instance.ID, "error:", err)
+		}
+	}
+}
+
+// remoteCheck is what the server of an instance reported about it, or why it
+// could not be asked
+type remoteCheck struct {
+	status RemoteStatus
+	err    error
+}
+
+// needsCheck reports whether the server an instance was started on has to be
+// asked what happened to it
+func needsCheck(state JobInstance) bool {
+	return state.PID != -1 && state.Resource != nil && state.Resource.Retired.IsZero() && !state.Resource.Parent.Removed()
+}
+
+// checkRemote asks each server about the instances started on it, over one
+// connection. Servers are asked at once and are dialled at most once, so one
+// that cannot be reached holds up neither the others nor each of its
+// instances in turn.
+func (m *Manager) checkRemote(pending []*JobInstance) map[*JobInstance]remoteCheck {
+	servers := make(map[*Server][]*JobInstance)
+	for _, instance := range pending {
+		if state := m.Instance(instance); needsCheck(state) {
+			servers[state.Resource.Parent] = append(servers[state.Resource.Parent], instance)
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	checks := make(map[*JobInstance]remoteCheck)
+	for server, instances := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, unreachable := server.SSH()
+			for _, instance := range instances {
+				check := remoteCheck{err: unreachable}
+				if unreachable == nil {
+					state := m.Instance(instance)
+					check.status, check.err = state.Resource.RemoteStatus(instance, state.PID)
+				}
+
+				mu.Lock()
+				checks[instance] = check
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return checks
+}
+
+// reconcile decides what to do with an instance, given what its server
+// reported if it had to be asked
+func (m *Manager) reconcile(instance *JobInstance, check remoteCheck) error {
+	state := m.Instance(instance)
+
+	if state.PID == -1 {
+		m.Enqueue(instance)
+		return nil
+	}
+
+	if state.Resource == nil {
+		reconciled(instance, "has no known resource, restarting")
+		return m.restart(instance, "resource no longer exists")
+	}
+
+	if !state.Resource.Retired.IsZero() {
+		reconciled(instance, "was on a retired GPU, restarting")
+		return m.restart(instance, "GPU was removed from the server")
+	}
+
+	if state.Resource.Parent.Removed() {
+		reconciled(instance, "was on a removed server, restarting")
+		return m.restart(instance, "server was removed")
+	}
+
+	status, err := check.status, check.err
+	if err != nil {
+		reconciled(instance, "unable to check", state.Resource.Parent.URL, ":", err)
+		m.Enqueue(instance)
+		return nil
+	}
+
+	switch {
+	case status.Exited && state.Archived:
+		if status.ExitCode != 0 {
+			reconciled(instance, "exited with status", status.ExitCode, ", retrying")
+			return m.retry(instance, fmt.Errorf("exited with status %d", status.ExitCode))
+		}
+
+		reconciled(instance, "already archived, completed")
+		return m.UpdateInstance(instance, func(i *JobInstance) {
+			i.Completed = true
+			i.Error = ""
+		})
+	case status.Exited:
+		reconciled(instance, "exited, archiving on", state.Resource.Parent.URL)
+		m.Enqueue(instance)
+	case status.Alive && status.Ours:
+		reconciled(instance, "still running on", state.Resource.Parent.URL)
+		m.Enqueue(instance)
+	case status.Alive:
+		reconciled(instance, "PID", state.PID, "belongs to another process,", status.Command+", restarting")
+		return m.restart(instance, "process lost while manager was stopped")
+	default:
+		reconciled(instance, "is no longer running, restarting")
+		return m.restart(instance, "process lost while manager was stopped")
+	}
+	return nil
+}
+
+// reconciled logs and audits what was decided about an instance
+func reconciled(instance *JobInstance, outcome ...interface{}) {
+	message := strings.TrimSuffix(fmt.Sprintln(outcome...), "\n")
+	log.Println("[Reconcile] Instance", instance.ID, message)
+	Audit(SchedulerActor, "reconcile", instanceTarget(instance), nil, 0, message)
+}
+
+// restart queues an instance to run again from the start without counting
+// it as a failed attempt
+func (m *Manager) restart(instance *JobInstance, reason string) error {
+	err := m.UpdateInstance(instance, func(i *JobInstance) {
+		i.PID = -1
+		i.Resource = nil
+		i.Archived = false
+		i.Error = reason
+	})
+	m.Enqueue(instance)
+	return err
+}
+
+// retry counts a failed attempt and queues the instance to run again unless
+// it has run out of attempts
+func (m *Manager) retry(instance *JobInstance, reason error) error {
+	var failed bool
+	err := m.UpdateInstance(instance, func(i *JobInstance) {
+		i.PID = -1
+		i.Resource = nil
+		i.Archived = false
+		i.Attempts += 1
+		i.Error = reason.Error()
+		if i.Attempts >= i.Parent.MaxAttempts() {
+			i.Failed = true
+		}
+		failed = i.Failed
+	})
+
+	if !failed {
+		m.Enqueue(instance)
+	}
+	return err
+}
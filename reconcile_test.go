@@ -0,0 +1,172 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/LCLS/GPUManager/api"
+)
+
+func TestParseRemoteStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   RemoteStatus
+	}{
+		{
+			name:   "running",
+			output: "pidfile 4242\nalive\ncmdline ProtoMol sim.conf \ncwd /scratch/gpu/job/lysozyme/3\n",
+			want:   RemoteStatus{Alive: true, Ours: true, Command: "ProtoMol sim.conf"},
+		},
+		{
+			name:   "running in a container",
+			output: "pidfile 4242\nalive\ncmdline Apptainer runtime parent \ncwd /scratch/gpu/job/lysozyme/3\n",
+			want:   RemoteStatus{Alive: true, Ours: true, Command: "Apptainer runtime parent"},
+		},
+		{
+			name:   "running in docker",
+			output: "pidfile 4242\nalive\ncmdline docker run --rm --gpus all sha256:abc python sim.py \ncwd /scratch/gpu/job/lysozyme/3\n",
+			want:   RemoteStatus{Alive: true, Ours: true, Command: "docker run --rm --gpus all sha256:abc python sim.py"},
+		},
+		{
+			name:   "PID reused",
+			output: "pidfile 4242\nalive\ncmdline sshd: alice \ncwd /\n",
+			want:   RemoteStatus{Alive: true, Command: "sshd: alice"},
+		},
+		{
+			name:   "another instance",
+			output: "pidfile 4242\nalive\ncmdline ProtoMol sim.conf \ncwd /scratch/gpu/job/lysozyme/13\n",
+			want:   RemoteStatus{Alive: true, Command: "ProtoMol sim.conf"},
+		},
+		{
+			name:   "restarted since",
+			output: "pidfile 5151\nalive\ncmdline ProtoMol sim.conf \ncwd /scratch/gpu/job/lysozyme/3\n",
+			want:   RemoteStatus{Alive: true, Command: "ProtoMol sim.conf"},
+		},
+		{
+			name:   "exited",
+			output: "exit 2\npidfile 4242\n",
+			want:   RemoteStatus{Exited: true, ExitCode: 2},
+		},
+		{
+			name:   "never started",
+			output: "",
+			want:   RemoteStatus{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseRemoteStatus(test.output, 4242, "lysozyme/3")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+
+	if _, err := ParseRemoteStatus("exit \n", 4242, "lysozyme/3"); err == nil {
+		t.Error("expected an error for an empty exit status")
+	}
+}
+
+// TestReconcile checks the instances found at startup on a server that can be
+// reached and on one that cannot, and that they are queued in order
+func TestReconcile(t *testing.T) {
+	f := newTestFarm(t)
+
+	away := &Server{ID: 2, URL: "127.0.0.1", WorkingDirectory: t.TempDir(), Enabled: true}
+	awayGPU := &Resource{UUID: "GPU-away", Enabled: true, Parent: away}
+	away.Resources = []*Resource{awayGPU}
+	f.m.servers = append(f.m.servers, away)
+
+	job := f.addJob(t, "found", "echo done", 4)
+	other := f.addJob(t, "away", "echo done", 2)
+	f.m.mu.Lock()
+	f.m.queue = nil
+	f.m.mu.Unlock()
+
+	// writeFile writes a file in the directory of an instance on the server
+	writeFile := func(instance *JobInstance, name, data string) string {
+		directory := filepath.Join(f.server.WorkingDirectory, "job", instance.Directory())
+		if err := os.MkdirAll(directory, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(directory, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return directory
+	}
+
+	notStarted, archived, running, lost := job.Instances[0], job.Instances[1], job.Instances[2], job.Instances[3]
+
+	writeFile(archived, "exit-status", "0\n")
+
+	sleep := exec.Command("sleep", "30")
+	sleep.Dir = writeFile(running, "log.txt", "")
+	if err := sleep.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer sleep.Wait()
+	defer sleep.Process.Kill()
+	writeFile(running, "pidfile", strconv.Itoa(sleep.Process.Pid)+"\n")
+
+	f.m.mu.Lock()
+	archived.PID, archived.Resource, archived.Archived = 1001, f.resource, true
+	running.PID, running.Resource = sleep.Process.Pid, f.resource
+	lost.PID, lost.Resource = 1003, f.resource
+	for _, instance := range other.Instances {
+		instance.PID, instance.Resource = 2000, awayGPU
+	}
+	f.m.mu.Unlock()
+
+	f.m.Reconcile()
+
+	f.m.mu.RLock()
+	queue := append([]*JobInstance(nil), f.m.queue...)
+	f.m.mu.RUnlock()
+
+	expected := []*JobInstance{notStarted, running, lost, other.Instances[0], other.Instances[1]}
+	if len(queue) != len(expected) {
+		t.Fatalf("expected %d instances queued, got %d", len(expected), len(queue))
+	}
+	for i := range expected {
+		if queue[i] != expected[i] {
+			t.Errorf("expected instance %d at %d in the queue, got %d", expected[i].ID, i, queue[i].ID)
+		}
+	}
+
+	if state := f.m.Instance(archived); !state.Completed {
+		t.Errorf("archived instance not completed: %+v", state)
+	}
+	if state := f.m.Instance(running); state.PID != sleep.Process.Pid || state.Resource != f.resource {
+		t.Errorf("running instance not pinned: %+v", state)
+	}
+	if state := f.m.Instance(lost); state.PID != -1 || state.Resource != nil {
+		t.Errorf("lost instance not restarted: %+v", state)
+	}
+	for _, instance := range other.Instances {
+		if state := f.m.Instance(instance); state.PID != 2000 || state.Resource != awayGPU {
+			t.Errorf("instance on an unreachable server not pinned: %+v", state)
+		}
+	}
+
+	entries, err := AuditEntries(api.AuditFilter{Action: "reconcile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unchecked := 0
+	for _, entry := range entries {
+		if entry.Target == instanceTarget(other.Instances[0]) || entry.Target == instanceTarget(other.Instances[1]) {
+			unchecked++
+		}
+	}
+	if unchecked != 2 {
+		t.Errorf("expected both instances on the unreachable server to be recorded, got %d", unchecked)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/LCLS/GPUManager/api"
+	"github.com/pkg/sftp"
+)
+
+// instanceFiles opens the directory holding the files of an instance. Once
+// an instance has been archived its files are read from the first enabled
+// archive of its job that has them, otherwise, or if none can be reached,
+// from the server it ran on. The caller must close the returned client.
+func (m *Manager) instanceFiles(id int) (*sftp.Client, string, error) {
+	m.mu.RLock()
+	instance := FindInstance(id, m.jobs)
+	if instance == nil {
+		m.mu.RUnlock()
+		return nil, "", ErrNotFound
+	}
+	state := *instance
+	directory := instance.Directory()
+
+	var archives []*Archive
+	for _, a := range m.archives {
+		if a.Enabled && instance.Parent.UsesArchive(a) {
+			archives = append(archives, a)
+		}
+	}
+	m.mu.RUnlock()
+
+	if state.Archived {
+		for _, archive := range archives {
+			if ftp, dir, err := archiveFiles(archive, directory); err == nil {
+				return ftp, dir, nil
+			}
+		}
+	}
+
+	if state.Resource == nil {
+		return nil, "", &RequestError{http.StatusNotFound, "Instance has not been started"}
+	}
+
+	client, err := state.Resource.Parent.SSH()
+	if err != nil {
+		return nil, "", &RequestError{http.StatusBadGateway, err.Error()}
+	}
+
+	ftp, err := sftp.NewClient(client)
+	if err != nil {
+		return nil, "", &RequestError{http.StatusBadGateway, err.Error()}
+	}
+	return ftp, path.Join(state.Resource.Parent.WorkingDirectory, "job", directory), nil
+}
+
+// archiveFiles opens the directory of an instance on an archive, if the
+// archive has it
+func archiveFiles(archive *Archive, directory string) (*sftp.Client, string, error) {
+	client, err := archive.SSH()
+	if err != nil {
+		return nil, "", err
+	}
+
+	ftp, err := sftp.NewClient(client)
+	if err != nil {
+		return nil, "", err
+	}
+
+	dir := path.Join(archive.WorkingDirectory, directory)
+	if _, err := ftp.Stat(dir); err != nil {
+		ftp.Close()
+		return nil, "", err
+	}
+	return ftp, dir, nil
+}
+
+// Most bytes of an instance log read at once. A longer log is cut to its
+// end, starting from its first full line within the limit.
+var LogMaxBytes int64 = 1 << 20
+
+// Time between reads of a log that is being followed
+var LogFollowInterval = 2 * time.Second
+
+// readLog reads a log from offset to its end, at most LogMaxBytes of it, and
+// returns what was read with the offset it ends at
+func readLog(file *sftp.File, offset int64) ([]byte, int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, offset, err
+	}
+
+	size := info.Size()
+	if size < offset {
+		// The log was truncated, so it is read again from the start
+		offset = 0
+	}
+
+	skipped := size-offset > LogMaxBytes
+	if skipped {
+		offset = size - LogMaxBytes
+	}
+
+	data := make([]byte, size-offset)
+	n, err := file.ReadAt(data, offset)
+	if err != nil && err != io.EOF {
+		return nil, offset, err
+	}
+	data = data[:n]
+
+	if skipped {
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			data = data[i+1:]
+		}
+	}
+	return data, offset + int64(n), nil
+}
+
+// lastLines returns the last n lines of data
+func lastLines(data []byte, n int) []byte {
+	end := len(data)
+	if end > 0 && data[end-1] == '\n' {
+		end--
+	}
+
+	for i := end - 1; i >= 0; i-- {
+		if data[i] == '\n' {
+			if n--; n == 0 {
+				return data[i+1:]
+			}
+		}
+	}
+	return data
+}
+
+// InstanceLog writes the output the simulation of an instance has written,
+// or its last lines if lines is not 0. With follow, what the simulation
+// writes next is written as it appears, until the instance stops running,
+// ctx is done or the manager shuts down. The start function is called
+// before anything is written, so the caller can still report an error up to
+// that point.
+func (m *Manager) InstanceLog(ctx context.Context, id, lines int, follow bool, start func(), write func([]byte) error) error {
+	m.mu.RLock()
+	var resource *Resource
+	if instance := FindInstance(id, m.jobs); instance != nil {
+		resource = instance.Resource
+	}
+	m.mu.RUnlock()
+
+	ftp, directory, err := m.instanceFiles(id)
+	if err != nil {
+		return err
+	}
+	defer ftp.Close()
+
+	file, err := ftp.Open(path.Join(directory, "log.txt"))
+	if err != nil {
+		return &RequestError{http.StatusNotFound, "No log for instance"}
+	}
+	defer file.Close()
+
+	data, offset, err := readLog(file, 0)
+	if err != nil {
+		return &RequestError{http.StatusBadGateway, err.Error()}
+	}
+	start()
+
+	if lines > 0 {
+		data = lastLines(data, lines)
+	}
+	if err := write(data); err != nil || !follow {
+		return err
+	}
+
+	ticker := time.NewTicker(LogFollowInterval)
+	defer ticker.Stop()
+
+	for {
+		// The log is read once more after the instance stops, so that
+		// nothing it wrote last is missed
+		m.mu.RLock()
+		instance := FindInstance(id, m.jobs)
+		running := instance != nil && instance.State() == api.StateRunning && instance.Resource == resource && !instance.Archived
+		m.mu.RUnlock()
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		case <-m.stop:
+			return nil
+		}
+
+		if data, offset, err = readLog(file, offset); err != nil {
+			return err
+		}
+		if len(data) > 0 {
+			if err := write(data); err != nil {
+				return err
+			}
+		}
+
+		if !running {
+			return nil
+		}
+	}
+}
+
+// WriteResults writes the files of an instance to w as a gzipped tar
+// archive. The start function is called before anything is written, so the
+// caller can still report an error up to that point.
+func (m *Manager) WriteResults(id int, w io.Writer, start func()) error {
+	ftp, directory, err := m.instanceFiles(id)
+	if err != nil {
+		return err
+	}
+	defer ftp.Close()
+
+	files, err := ftp.ReadDir(directory)
+	if err != nil {
+		return &RequestError{http.StatusNotFound, "No results for instance"}
+	}
+	start()
+
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+	for _, info := range files {
+		if info.IsDir() {
+			continue
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+
+		file, err := ftp.Open(path.Join(directory, info.Name()))
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(archive, file, info.Size())
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
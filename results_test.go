@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestInstanceFiles checks which copy of the files of an archived instance
+// is read
+func TestInstanceFiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		archives []string
+		setup    func(f *testFarm, other *Archive)
+		expected string
+	}{
+		{name: "any archive", expected: "first"},
+		{name: "archive of the job", archives: []string{"127.0.0.3"}, expected: "second"},
+		{name: "first disabled", setup: func(f *testFarm, other *Archive) { f.archive.Enabled = false }, expected: "second"},
+		{name: "missing from the archive", archives: []string{"127.0.0.3"}, setup: func(f *testFarm, other *Archive) {
+			os.RemoveAll(other.WorkingDirectory)
+		}, expected: "server"},
+		{name: "archive unreachable", archives: []string{"127.0.0.2"}, setup: func(f *testFarm, other *Archive) {
+			f.store.setRefuseSFTP(true)
+		}, expected: "server"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newTestFarm(t)
+			store := newTestServer(t)
+			other := &Archive{ID: 2, URL: "127.0.0.3", WorkingDirectory: filepath.Join(f.archive.WorkingDirectory, "..", "other"), Enabled: true, Client: store.dial(t)}
+			f.m.archives = append(f.m.archives, other)
+
+			job := f.addJob(t, "archived", "echo done", 1)
+			job.Config.Archives = test.archives
+			instance := job.Instances[0]
+			f.m.mu.Lock()
+			instance.Resource = f.resource
+			instance.Completed, instance.Archived = true, true
+			f.m.mu.Unlock()
+
+			for holder, directory := range map[string]string{
+				"server": filepath.Join(f.server.WorkingDirectory, "job"),
+				"first":  f.archive.WorkingDirectory,
+				"second": other.WorkingDirectory,
+			} {
+				directory = filepath.Join(directory, instance.Directory())
+				if err := os.MkdirAll(directory, 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(directory, "log.txt"), []byte(holder), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.setup != nil {
+				test.setup(f, other)
+			}
+
+			var log string
+			err := f.m.InstanceLog(context.Background(), instance.ID, 0, false, func() {}, func(data []byte) error {
+				log += string(data)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if log != test.expected {
+				t.Errorf("expected the %s copy, got %s", test.expected, log)
+			}
+		})
+	}
+}
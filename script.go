@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// DefaultSetup is the setup of servers added without one
+const DefaultSetup = "source ~/.bash_profile"
+
+// RunScript is the file the run script of an instance is written to, in the
+// directory of the instance
+const RunScript = "run.sh"
+
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// checkEnv refuses environment variables that cannot be exported
+func checkEnv(env map[string]string) error {
+	for name := range env {
+		if !envName.MatchString(name) {
+			return &RequestError{http.StatusBadRequest, fmt.Sprintf("Invalid environment variable name %q", name)}
+		}
+	}
+	return nil
+}
+
+// shellQuote quotes a value so that the shell takes it literally
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// exports sets environment variables in name order
+func exports(env map[string]string) string {
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var script string
+	for _, name := range names {
+		script += "export " + name + "=" + shellQuote(env[name]) + "\n"
+	}
+	return script
+}
+
+// setupScript returns the setup of the server followed by its environment,
+// then the setup and environment of the job, if there is one, so that a job
+// can override what its server sets. It must be called with the manager lock
+// held.
+func setupScript(server *Server, job *Job) string {
+	script := "# Setup of " + server.URL + "\n"
+	if server.Setup != "" {
+		script += strings.TrimRight(server.Setup, "\n") + "\n"
+	}
+	script += exports(server.Env)
+
+	if job != nil && (len(job.Config.Setup) > 0 || len(job.Config.Env) > 0) {
+		script += "# Setup of job " + job.Name + "\n"
+		for _, line := range job.Config.Setup {
+			script += line + "\n"
+		}
+		script += exports(job.Config.Env)
+	}
+	return script
+}
+
+// runScript renders the script that runs an instance of the job on a GPU of
+// the server. It is run from the directory of the instance, and execs the
+// simulation so that it keeps the PID the script was started with. The GPUs
+// the instance sees are exported as CUDA_VISIBLE_DEVICES after the setup, so
+// that neither the server nor the job can change them. It must be called
+// with the manager lock held.
+func runScript(server *Server, job *Job, resource *Resource) string {
+	script := "#!/bin/bash\n"
+	script += "# Generated by GPUManager for job " + job.Name + "\n"
+	script += setupScript(server, job)
+
+	gpu := make(map[string]string)
+	if resource != nil {
+		var uuids []string
+		for _, visible := range visibleGPUs(job, resource) {
+			uuids = append(uuids, visible.UUID)
+		}
+		gpu["CUDA_VISIBLE_DEVICES"] = strings.Join(uuids, ",")
+		script += fmt.Sprintf("# GPU %d, %s\n", resource.DeviceID, resource.Name)
+	}
+	script += exports(gpu)
+	script += "cd \"$(dirname \"$0\")\"\n"
+
+	command := job.Template.Executable() + " " + job.Template.Configuration()
+	if image := job.Container(); image != "" {
+		return script + containerScript(image, command, server.Env, job.Config.Env, gpu)
+	}
+	return script + "exec " + command + "\n"
+}
+
+// visibleGPUs returns the GPUs an instance on the resource sees: only its
+// own, or, if the job does not remap devices, every GPU of the server in the
+// order of their indexes there. Listing them all, rather than leaving
+// CUDA_VISIBLE_DEVICES unset, keeps CUDA from numbering them in another
+// order than nvidia-smi. It must be called with the manager lock held.
+func visibleGPUs(job *Job, resource *Resource) []*Resource {
+	if job.RemapDevices() {
+		return []*Resource{resource}
+	}
+
+	visible := []*Resource{resource}
+	for _, other := range resource.Parent.Resources {
+		if other != resource {
+			visible = append(visible, other)
+		}
+	}
+	sort.SliceStable(visible, func(i, j int) bool { return visible[i].DeviceID < visible[j].DeviceID })
+	return visible
+}
+
+// templateDevice returns the index templates are given for the GPU, which is
+// its index among the GPUs the instance sees: 0 when devices are remapped,
+// otherwise its index on the server. It must be called with the manager
+// lock held.
+func templateDevice(job *Job, resource *Resource) int {
+	for i, visible := range visibleGPUs(job, resource) {
+		if visible == resource {
+			return i
+		}
+	}
+	return 0
+}
+
+// ImageDigest is the file the run script records the digest of the container
+// image in, in the directory of the instance
+const ImageDigest = "image-digest"
+
+// containerScript runs the command in the image with Apptainer or
+// Singularity, or else Docker, with the GPUs passed through and the working
+// directory of the server bound in at the same path, so that the model and
+// job directories are where the template expects them. Remote images are
+// pulled once per server into a SIF file for Apptainer, and the digest of
+// the image that is run is written to ImageDigest.
+func containerScript(image, command string, envs ...map[string]string) string {
+	// Docker does not pass the environment through, so the variables of the
+	// server and job are named
+	names := make(map[string]bool)
+	for _, env := range envs {
+		for name := range env {
+			names[name] = true
+		}
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	var passEnv string
+	for _, name := range sorted {
+		passEnv += " -e " + name
+	}
+
+	script := "root=\"$(cd ../../.. && pwd)\"\n"
+	script += "image=" + shellQuote(image) + "\n"
+	script += `if runtime=$(command -v apptainer || command -v singularity); then
+  case "$image" in
+    *://*)
+      mkdir -p "$root/containers"
+      sif="$root/containers/$(printf %s "$image" | tr -c 'A-Za-z0-9._-' '_').sif"
+      if [ ! -f "$sif" ]; then
+        "$runtime" pull "$sif.$$" "$image" && mv "$sif.$$" "$sif" || exit 1
+      fi
+      ;;
+    *)
+      sif="$image"
+      ;;
+  esac
+  echo "sha256:$(sha256sum "$sif" | cut -d' ' -f1)" > ` + ImageDigest + `
+  exec "$runtime" exec --nv --bind "$root" --pwd "$PWD" "$sif" ` + command + `
+elif command -v docker > /dev/null; then
+  image="${image#docker://}"
+  docker image inspect "$image" > /dev/null 2>&1 || docker pull "$image" > /dev/null || exit 1
+  digest=$(docker image inspect --format '{{if .RepoDigests}}{{index .RepoDigests 0}}{{else}}{{.Id}}{{end}}' "$image") || exit 1
+  echo "$digest" > ` + ImageDigest + `
+  exec docker run --rm --gpus all -u "$(id -u):$(id -g)" -v "$root:$root" -w "$PWD"` + passEnv + ` "$digest" ` + command + `
+else
+  echo "No container runtime found, install apptainer, singularity or docker" >&2
+  exit 127
+fi
+`
+	return script
+}
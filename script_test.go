@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestDevices checks which GPUs an instance sees and the device indexes its
+// template is given, with and without remapping
+func TestDevices(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.Mkdir("data", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("data/devices.py", []byte("{{.DeviceID}} {{.ServerDeviceID}}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The GPUs of the server are not kept in the order of their indexes
+	server := &Server{ID: 1, URL: "gpu01"}
+	resource := &Resource{UUID: "GPU-5bd4b1c2-0d83-3b6f-9c3a-8a2f6f0e1d11", Name: "Tesla V100", DeviceID: 2, Parent: server}
+	server.Resources = []*Resource{
+		{UUID: "GPU-1", DeviceID: 1, Parent: server},
+		resource,
+		{UUID: "GPU-3", DeviceID: 3, Parent: server},
+		{UUID: "GPU-0", DeviceID: 0, Parent: server},
+	}
+	remap, keep := true, false
+
+	tests := []struct {
+		name     string
+		remap    *bool
+		visible  string
+		template string
+	}{
+		{name: "default", visible: resource.UUID, template: "0 2"},
+		{name: "remapped", remap: &remap, visible: resource.UUID, template: "0 2"},
+		{name: "server index", remap: &keep, visible: "GPU-0,GPU-1," + resource.UUID + ",GPU-3", template: "2 2"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			job := &Job{Name: "devices", Template: Template{File: "data/devices.py"}}
+			job.Config.RemapDevices = test.remap
+
+			script := runScript(server, job, resource)
+			if !strings.Contains(script, "export CUDA_VISIBLE_DEVICES='"+test.visible+"'\n") {
+				t.Errorf("expected CUDA_VISIBLE_DEVICES %s, script:\n%s", test.visible, script)
+			}
+
+			data, err := job.Template.Process(templateDevice(job, resource), resource.DeviceID, *job)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != test.template {
+				t.Errorf("expected template %q, got %q", test.template, data)
+			}
+		})
+	}
+}
@@ -5,27 +5,74 @@ import (
 	"bytes"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"regexp"
-	"strconv"
-	"text/template"
+	"sync"
 	"time"
 
+	"github.com/LCLS/GPUManager/api"
 	"golang.org/x/crypto/ssh"
 )
 
+// Server is a compute server. Its connection settings are guarded by both the
+// manager lock and clientMu, which is taken second.
 type Server struct {
 	ID                    int
 	URL, WorkingDirectory string
 	Username, Password    string
-	Enabled               bool
-	Resources             []Resource
+	Enabled, Draining     bool
+	Resources             []*Resource
 
-	Client *ssh.Client
+	// Shell commands and environment variables the run script of every
+	// instance starts with, guarded by the manager lock
+	Setup string
+	Env   map[string]string
+
+	// Maintenance windows that have not ended, soonest first, and the
+	// progress towards maintenance last logged. Both are guarded by the
+	// manager lock.
+	Maintenance     []*MaintenanceWindow
+	lastMaintenance string
+
+	// GPUs a rescan found gone, kept for the instances that ran on them
+	Retired []*Resource
+
+	// Result of the last health check, guarded by the manager lock
+	health, healthError string
+
+	// Report of the last probe, guarded by the manager lock
+	probe *api.Probe
+
+	// stop is closed when the server is removed, telling the handlers of its
+	// GPUs to give up their instances, and handlers counts those still
+	// running
+	stop     chan struct{}
+	handlers sync.WaitGroup
+
+	clientMu sync.Mutex
+	Client   *ssh.Client
+}
+
+// Removed reports whether the server has been removed
+func (s *Server) Removed() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
 }
 
 func (s *Server) Connect() error {
+	s.clientMu.Lock()
+	defer s.clientMu.Unlock()
+	return s.connect()
+}
+
+func (s *Server) connect() error {
 	config := &ssh.ClientConfig{
 		User: s.Username,
 		Auth: []ssh.AuthMethod{
@@ -41,175 +88,459 @@ func (s *Server) Connect() error {
 }
 
 func (s *Server) Disconnect() {
-	s.Client.Close()
+	s.clientMu.Lock()
+	defer s.clientMu.Unlock()
+
+	if s.Client != nil {
+		s.Client.Close()
+	}
 	s.Client = nil
 }
 
-var Servers []Server
+// Ping checks that the server can be reached, reconnecting once if the
+// connection has dropped
+func (s *Server) Ping() error {
+	client, err := s.SSH()
+	if err == nil {
+		if _, _, err = client.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+			return nil
+		}
+	}
 
-func FindServer(id int, servers []Server) *Server {
+	s.Disconnect()
+	if client, err = s.SSH(); err != nil {
+		return err
+	}
+	_, _, err = client.SendRequest("keepalive@openssh.com", true, nil)
+	return err
+}
+
+// SSH returns the open connection to the server, dialing it if necessary
+func (s *Server) SSH() (*ssh.Client, error) {
+	s.clientMu.Lock()
+	defer s.clientMu.Unlock()
+
+	if s.Client == nil {
+		if err := s.connect(); err != nil {
+			return nil, err
+		}
+	}
+	return s.Client, nil
+}
+
+func FindServer(id int, servers []*Server) *Server {
 	for i := 0; i < len(servers); i++ {
 		if servers[i].ID == id {
-			return &servers[i]
+			return servers[i]
 		}
 	}
 	return nil
 }
 
-func FindServerResource(uuid string, servers []Server) *Resource {
+// FindServerResource finds a GPU, including one that has been retired
+func FindServerResource(uuid string, servers []*Server) *Resource {
 	for i := 0; i < len(servers); i++ {
 		for j := 0; j < len(servers[i].Resources); j++ {
 			if servers[i].Resources[j].UUID == uuid {
-				return &servers[i].Resources[j]
+				return servers[i].Resources[j]
+			}
+		}
+		for j := 0; j < len(servers[i].Retired); j++ {
+			if servers[i].Retired[j].UUID == uuid {
+				return servers[i].Retired[j]
 			}
 		}
 	}
 	return nil
 }
 
-func LoadServers(db *sql.DB) ([]Server, error) {
-	var servers []Server
+// LoadServers returns the servers in use and those that have been removed,
+// which are kept for the instances that ran on them
+func LoadServers(db *sql.DB) ([]*Server, []*Server, error) {
+	var servers, removedServers []*Server
 
 	// Load Servers
-	rows, err := db.Query("SELECT id, url, wdir, username, password, enabled FROM server")
+	rows, err := db.Query("SELECT id, url, wdir, username, password, enabled, draining, removed, probe, setup, env FROM server")
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	for rows.Next() {
 		var id int
-		var enabled bool
-		var url, wdir, username, password string
-		if err := rows.Scan(&id, &url, &wdir, &username, &password, &enabled); err != nil {
-			return nil, err
+		var enabled, draining bool
+		var url, wdir, username, password, report, setup, env string
+		var removed sql.NullTime
+		if err := rows.Scan(&id, &url, &wdir, &username, &password, &enabled, &draining, &removed, &report, &setup, &env); err != nil {
+			return nil, nil, err
 		}
 
-		servers = append(servers, Server{ID: id, URL: url, WorkingDirectory: wdir, Username: username, Password: password, Enabled: enabled})
+		server := &Server{ID: id, URL: url, WorkingDirectory: wdir, Username: username, Password: password, Enabled: enabled, Draining: draining, Setup: setup, stop: make(chan struct{})}
+		if env != "" {
+			if err := json.Unmarshal([]byte(env), &server.Env); err != nil {
+				return nil, nil, err
+			}
+		}
+		if report != "" {
+			server.probe = &api.Probe{}
+			if err := json.Unmarshal([]byte(report), server.probe); err != nil {
+				return nil, nil, err
+			}
+		}
+		if removed.Valid {
+			close(server.stop)
+			removedServers = append(removedServers, server)
+		} else {
+			servers = append(servers, server)
+		}
 	}
 	rows.Close()
+	all := append(append([]*Server(nil), servers...), removedServers...)
 
 	// Load Resources
-	for i := 0; i < len(servers); i++ {
-		rows, err := db.Query("SELECT inuse, name, uuid, device FROM server_resource WHERE server_id = ?", servers[i].ID)
+	for i := 0; i < len(all); i++ {
+		rows, err := db.Query("SELECT inuse, name, uuid, device, retired, enabled FROM server_resource WHERE server_id = ?", all[i].ID)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		for rows.Next() {
-			var inuse bool
+			var inuse, enabled bool
 			var device_id int
 			var name, uuid string
-			if err := rows.Scan(&inuse, &name, &uuid, &device_id); err != nil {
-				return nil, err
+			var retired sql.NullTime
+			if err := rows.Scan(&inuse, &name, &uuid, &device_id, &retired, &enabled); err != nil {
+				return nil, nil, err
 			}
 
-			servers[i].Resources = append(servers[i].Resources, Resource{Name: name, UUID: uuid, InUse: inuse, DeviceID: device_id, Parent: &servers[i], JobQueue: make(chan *JobInstance, 1)})
+			resource := &Resource{Name: name, UUID: uuid, InUse: inuse, Enabled: enabled, DeviceID: device_id, Parent: all[i]}
+			if retired.Valid {
+				resource.Retired = retired.Time
+				all[i].Retired = append(all[i].Retired, resource)
+			} else {
+				all[i].Resources = append(all[i].Resources, resource)
+			}
 		}
 		rows.Close()
 	}
 
-	return servers, nil
+	if err := LoadMaintenance(db, servers); err != nil {
+		return nil, nil, err
+	}
+
+	return servers, removedServers, nil
 }
 
-func indexHandler(w http.ResponseWriter, r *http.Request) {
-	type JSONResponse struct {
-		Success bool   `json:"success"`
-		Message string `json:"message"`
+// API returns the representation of the server used by the JSON API. It
+// must be called with the manager lock held.
+func (s *Server) API() api.Server {
+	server := api.Server{ID: s.ID, URL: s.URL, WorkingDirectory: s.WorkingDirectory, Username: s.Username, Setup: s.Setup, Env: s.Env, Enabled: s.Enabled, Draining: s.Draining, Maintenance: s.maintenanceState(time.Now()), MaintenanceWindows: []api.MaintenanceWindow{}, Resources: []api.Resource{}, Health: s.health, HealthError: s.healthError}
+	if server.Health == "" {
+		server.Health = api.HealthUnknown
 	}
+	if s.probe != nil {
+		probe := *s.probe
+		server.Probe = &probe
+	}
+	for _, window := range s.Maintenance {
+		server.MaintenanceWindows = append(server.MaintenanceWindows, window.API())
+	}
+	for _, resource := range s.Resources {
+		if resource.InUse {
+			server.InUse += 1
+		}
+		server.Resources = append(server.Resources, resource.API())
+	}
+	return server
+}
+
+func (m *Manager) indexHandler(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, "index.html")
+}
 
-	type ServerInfo struct {
-		ID                    int
-		URL, WorkingDirectory string
-		Enabled               bool
-		InUse, Max            int
-		PercentUsed           float64
+// CreateServer checks that the server can be reached and has what instances
+// need, discovers its GPUs and starts dispatching instances to them. A server
+// that fails its probe is refused with a ProbeError. The output of nvidia-smi
+// is returned along with the server.
+func (m *Manager) CreateServer(request api.ServerRequest) (*Server, string, error) {
+	if request.URL == "" || request.Username == "" || request.Password == "" {
+		return nil, "", ErrMissingData
+	}
+	if err := checkEnv(request.Env); err != nil {
+		return nil, "", err
 	}
 
-	var data []ServerInfo
-	for _, server := range Servers {
-		info := ServerInfo{ID: server.ID, URL: server.URL, WorkingDirectory: server.WorkingDirectory, Enabled: server.Enabled, Max: len(server.Resources)}
-		for _, resource := range server.Resources {
-			if resource.InUse {
-				info.InUse += 1
-			}
-		}
-		info.PercentUsed = (float64(info.InUse) / float64(info.Max)) * 100.0
+	setup := DefaultSetup
+	if request.Setup != nil {
+		setup = *request.Setup
+	}
+	env, err := json.Marshal(request.Env)
+	if err != nil {
+		return nil, "", err
+	}
+
+	server := &Server{URL: request.URL, Username: request.Username, Password: request.Password, WorkingDirectory: request.WorkingDirectory, Setup: setup, Env: request.Env, Enabled: true, stop: make(chan struct{})}
+
+	client, result, err := checkServer(request.URL, request.WorkingDirectory, request.Username, request.Password)
+	if err != nil {
+		return nil, "", err
+	}
+	probe := probeServer(client, request.WorkingDirectory, setupScript(server, nil))
+	client.Close()
 
-		data = append(data, info)
+	if !probe.Passed {
+		return nil, "", &ProbeError{probe}
+	}
+	report, err := json.Marshal(probe)
+	if err != nil {
+		return nil, "", err
 	}
 
-	t, _ := template.ParseFiles("index.html")
-	t.Execute(w, data)
-}
+	resources := ParseGPUs(result)
+	m.mu.RLock()
+	for _, res := range resources {
+		if existing := FindServerResource(res.UUID, m.servers); existing != nil {
+			m.mu.RUnlock()
+			return nil, "", &RequestError{http.StatusConflict, fmt.Sprintf("GPU %s is already on %s", res.UUID, existing.Parent.URL)}
+		}
+	}
+	m.mu.RUnlock()
+
+	server.probe = &probe
 
-func serverAddHandker(w http.ResponseWriter, r *http.Request) {
-	type ServerResponse struct {
-		ID               int
-		WorkingDirectory string `json:"wdir"`
-		URL              string `json:"url"`
-		Resources        int    `json:"resources"`
+	res, err := DB.Exec("insert into server(url, wdir, username, password, probe, setup, env) values (?,?,?,?,?,?,?)", server.URL, server.WorkingDirectory, server.Username, server.Password, string(report), server.Setup, string(env))
+	if err != nil {
+		return nil, "", err
 	}
 
-	type JSONResponse struct {
-		Success bool           `json:"success"`
-		Message string         `json:"message"`
-		Server  ServerResponse `json:"server"`
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, "", err
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	server.ID = int(id)
 
-	if r.FormValue("server_name") == "" || r.FormValue("user_name") == "" || r.FormValue("password") == "" {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: "Missing Data"})
-		return
+	// Find GPUs
+	for _, res := range resources {
+		res.Parent = server
+		server.Resources = append(server.Resources, res)
+
+		if err := insertResource(res, server.ID); err != nil {
+			return nil, "", err
+		}
 	}
 
-	// Test if we can connect
+	m.AddServer(server)
+	m.StartServer(server)
+
+	return server, string(result), nil
+}
+
+// insertResource saves a GPU found on a server. A GPU that was last on a
+// removed server is moved over, so the instances that ran on it keep
+// referring to it.
+func insertResource(res *Resource, serverID int) error {
+	_, err := DB.Exec("insert into server_resource(uuid, name, inuse, device, server_id) values (?,?,?,?,?) on conflict(uuid) do update set name = excluded.name, inuse = excluded.inuse, device = excluded.device, server_id = excluded.server_id, retired = NULL, enabled = 1", res.UUID, res.Name, res.InUse, res.DeviceID, serverID)
+	return err
+}
+
+// checkServer connects to a server with the given settings, checks that its
+// working directory exists and lists its GPUs. The connection is returned
+// open along with the output of nvidia-smi.
+func checkServer(url, wdir, username, password string) (*ssh.Client, []byte, error) {
 	config := &ssh.ClientConfig{
-		User: r.FormValue("user_name"),
+		User: username,
 		Auth: []ssh.AuthMethod{
-			ssh.Password(r.FormValue("password")),
+			ssh.Password(password),
 		},
 	}
 
-	client, err := SSHDialTimeout("tcp", r.FormValue("server_name")+":22", config, 1*time.Minute)
+	client, err := SSHDialTimeout("tcp", url+":22", config, 1*time.Minute)
 	if err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: fmt.Sprintf("Error connecting to %s. Please check the url and username/password.", r.FormValue("server_name"))})
-		return
+		return nil, nil, &RequestError{http.StatusBadGateway, fmt.Sprintf("Error connecting to %s. Please check the url and username/password.", url)}
 	}
 
 	session, err := client.NewSession()
 	if err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: "Unable to create session"})
-		return
+		client.Close()
+		return nil, nil, &RequestError{http.StatusBadGateway, "Unable to create session"}
 	}
 	defer session.Close()
 
-	result, err := session.CombinedOutput("nvidia-smi -L")
+	command := "nvidia-smi -L"
+	if wdir != "" {
+		command = "cd " + wdir + " || exit 3\n" + command
+	}
+
+	result, err := session.CombinedOutput(command)
 	if err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: "Unable to execute command"})
-		return
+		client.Close()
+
+		var exit *ssh.ExitError
+		if errors.As(err, &exit) && exit.ExitStatus() == 3 {
+			return nil, nil, &RequestError{http.StatusBadRequest, fmt.Sprintf("Working directory %s does not exist on %s", wdir, url)}
+		}
+		return nil, nil, &RequestError{http.StatusBadGateway, "Unable to execute command"}
 	}
-	session.Close()
-	client.Close()
+	return client, result, nil
+}
 
-	server := Server{URL: r.FormValue("server_name"), Username: r.FormValue("user_name"), Password: r.FormValue("password"), WorkingDirectory: r.FormValue("root"), Enabled: true}
+// checkServerUpdate refuses an update that could not be applied in full, so
+// that no part of it is applied
+func checkServerUpdate(update api.ServerUpdate) error {
+	for _, field := range []*string{update.URL, update.Username, update.Password} {
+		if field != nil && *field == "" {
+			return ErrMissingData
+		}
+	}
+	return checkEnv(update.Env)
+}
 
-	res, err := DB.Exec("insert into server(url, wdir, username, password) values (?,?,?,?)", server.URL, server.WorkingDirectory, r.FormValue("user_name"), r.FormValue("password"))
-	if err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
-		return
+// UpdateServer changes the settings of a server, saving them all at once.
+// New connection settings are checked by connecting with them before
+// anything is saved, and a new host must have at least one of the GPUs the
+// server is known to have so that its GPUs keep their identity and history.
+// The host and working directory can only change while nothing is running on
+// the server, as running instances depend on them. Instances already running
+// keep the run script they were started with.
+func (m *Manager) UpdateServer(id int, update api.ServerUpdate) error {
+	m.mu.RLock()
+	server := FindServer(id, m.servers)
+	var url, wdir, username, password string
+	var known []string
+	if server != nil {
+		url, wdir, username, password = server.URL, server.WorkingDirectory, server.Username, server.Password
+		for _, resource := range server.Resources {
+			known = append(known, resource.UUID)
+		}
 	}
+	m.mu.RUnlock()
 
-	id, err := res.LastInsertId()
+	if server == nil {
+		return ErrNotFound
+	}
+
+	moved := false
+	if update.URL != nil && *update.URL != url {
+		url, moved = *update.URL, true
+	}
+	if update.WorkingDirectory != nil && *update.WorkingDirectory != wdir {
+		wdir, moved = *update.WorkingDirectory, true
+	}
+	reconnect := moved
+	if update.Username != nil && *update.Username != username {
+		username, reconnect = *update.Username, true
+	}
+	if update.Password != nil && *update.Password != password {
+		password, reconnect = *update.Password, true
+	}
+
+	// Connecting with new settings is all that can still fail, so it is
+	// done first
+	var client *ssh.Client
+	if reconnect {
+		if url == "" || username == "" || password == "" {
+			return ErrMissingData
+		}
+
+		var result []byte
+		var err error
+		if client, result, err = checkServer(url, wdir, username, password); err != nil {
+			return err
+		}
+
+		if url != server.URL && len(known) > 0 && !hasAnyGPU(ParseGPUs(result), known) {
+			client.Close()
+			return &RequestError{http.StatusConflict, fmt.Sprintf("%s has none of the GPUs of the server. Add it as a new server instead.", url)}
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if moved && m.serverBusy(server) {
+		client.Close()
+		return &RequestError{http.StatusConflict, "Drain the server before changing its host or working directory"}
+	}
+
+	enabled, draining, setup, env := server.Enabled, server.Draining, server.Setup, server.Env
+	if update.Enabled != nil {
+		enabled = *update.Enabled
+	}
+	if update.Draining != nil {
+		draining = *update.Draining
+	}
+	if update.Setup != nil {
+		setup = *update.Setup
+	}
+	if update.Env != nil {
+		env = update.Env
+	}
+
+	data, err := json.Marshal(env)
+	if err == nil {
+		_, err = DB.Exec("update server set url = ?, wdir = ?, username = ?, password = ?, enabled = ?, draining = ?, setup = ?, env = ? where id = ?",
+			url, wdir, username, password, enabled, draining, setup, string(data), id)
+	}
 	if err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
-		return
+		if client != nil {
+			client.Close()
+		}
+		return err
 	}
 
-	server.ID = int(id)
+	if reconnect {
+		// The connection settings are also read by connect, under clientMu
+		server.clientMu.Lock()
+		if server.Client != nil {
+			server.Client.Close()
+		}
+		server.URL, server.WorkingDirectory, server.Username, server.Password = url, wdir, username, password
+		server.Client = client
+		server.clientMu.Unlock()
 
-	// Find GPUs
-	scanner := bufio.NewScanner(bytes.NewReader(result))
+		server.health, server.healthError = api.HealthOK, ""
+		log.Println("[Server]", id, "updated,", url, wdir)
+	}
+
+	server.Enabled, server.Draining, server.Setup, server.Env = enabled, draining, setup, env
+	m.publishServer(server)
+	return nil
+}
+
+// hasAnyGPU reports whether any of the resources has one of the UUIDs
+func hasAnyGPU(resources []*Resource, uuids []string) bool {
+	for _, resource := range resources {
+		for _, uuid := range uuids {
+			if resource.UUID == uuid {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serverBusy reports whether any GPU of the server is running an instance or
+// has one waiting to resume on it. It must be called with the manager lock
+// held.
+func (m *Manager) serverBusy(server *Server) bool {
+	for _, resource := range server.Resources {
+		if resource.InUse {
+			return true
+		}
+	}
+	for _, instance := range m.queue {
+		if instance.Resource != nil && instance.Resource.Parent == server {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseGPUs reads the resources listed in the output of nvidia-smi -L
+func ParseGPUs(output []byte) []*Resource {
+	var resources []*Resource
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
 	scanner.Split(bufio.ScanLines)
 
 	device := 0
@@ -217,93 +548,316 @@ func serverAddHandker(w http.ResponseWriter, r *http.Request) {
 	for scanner.Scan() {
 		result := re.FindAllStringSubmatch(scanner.Text(), -1)
 		if len(result) == 1 && len(result[0]) == 3 {
-			res := Resource{Name: result[0][1], UUID: result[0][2], InUse: false, Parent: &server, DeviceID: device, JobQueue: make(chan *JobInstance, 1)}
+			resources = append(resources, &Resource{Name: result[0][1], UUID: result[0][2], DeviceID: device, Enabled: true})
+			device += 1
+		}
+	}
+	return resources
+}
+
+// RescanServer runs nvidia-smi on a server again and reconciles its GPUs by
+// UUID. New GPUs, and retired ones that are back, start receiving instances.
+// GPUs that are gone are retired rather than deleted so that the instances
+// that ran on them keep their history, and instances waiting to resume on
+// them are restarted elsewhere. GPUs whose index has changed are renumbered.
+func (m *Manager) RescanServer(id int) (api.Rescan, error) {
+	rescan := api.Rescan{Added: []api.Resource{}, Retired: []api.Resource{}, Renumbered: []api.DeviceChange{}}
+
+	m.mu.RLock()
+	server := FindServer(id, m.servers)
+	m.mu.RUnlock()
+
+	if server == nil {
+		return rescan, ErrNotFound
+	}
+
+	client, err := server.SSH()
+	if err != nil {
+		return rescan, &RequestError{http.StatusBadGateway, fmt.Sprintf("Error connecting to %s: %s", server.URL, err)}
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return rescan, &RequestError{http.StatusBadGateway, "Unable to create session"}
+	}
+	defer session.Close()
+
+	result, err := session.CombinedOutput("nvidia-smi -L")
+	if err != nil {
+		return rescan, &RequestError{http.StatusBadGateway, "Unable to execute command"}
+	}
+	rescan.Output = string(result)
+
+	found := make(map[string]bool)
+	var started []*Resource
+	var stranded []*JobInstance
+
+	m.mu.Lock()
+	for _, res := range ParseGPUs(result) {
+		found[res.UUID] = true
+
+		existing := FindServerResource(res.UUID, m.servers)
+		switch {
+		case existing == nil:
+			if err := insertResource(res, id); err != nil {
+				m.mu.Unlock()
+				return rescan, err
+			}
+
+			res.Parent = server
 			server.Resources = append(server.Resources, res)
+			started = append(started, res)
+		case existing.Parent != server:
+			log.Println("[Rescan]", server.URL, "found", res.UUID, "which belongs to", existing.Parent.URL)
+		case !existing.Retired.IsZero():
+			if _, err := DB.Exec("update server_resource set retired = NULL, name = ?, device = ? where uuid = ?", res.Name, res.DeviceID, res.UUID); err != nil {
+				m.mu.Unlock()
+				return rescan, err
+			}
 
-			if _, err := DB.Exec("insert into server_resource(uuid, name, inuse, device, server_id) values (?,?,?,?,?)", res.UUID, res.Name, res.InUse, device, id); err != nil {
-				json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
-				return
+			existing.Retired = time.Time{}
+			existing.Name, existing.DeviceID = res.Name, res.DeviceID
+			server.Retired = removeResource(server.Retired, existing)
+			server.Resources = append(server.Resources, existing)
+			started = append(started, existing)
+		case existing.DeviceID != res.DeviceID:
+			if _, err := DB.Exec("update server_resource set device = ? where uuid = ?", res.DeviceID, res.UUID); err != nil {
+				m.mu.Unlock()
+				return rescan, err
 			}
 
-			device += 1
+			log.Println("[Rescan]", server.URL, existing.UUID, "moved from device", existing.DeviceID, "to", res.DeviceID)
+			rescan.Renumbered = append(rescan.Renumbered, api.DeviceChange{UUID: existing.UUID, Name: existing.Name, From: existing.DeviceID, To: res.DeviceID})
+			existing.DeviceID = res.DeviceID
+			m.publishResource(existing)
+		}
+	}
+
+	now := time.Now().UTC()
+	for _, resource := range append([]*Resource(nil), server.Resources...) {
+		if found[resource.UUID] {
+			continue
+		}
+
+		if _, err := DB.Exec("update server_resource set retired = ? where uuid = ?", now, resource.UUID); err != nil {
+			m.mu.Unlock()
+			return rescan, err
+		}
+
+		// A GPU that is running an instance keeps its handler until the
+		// instance ends, which it is likely to do with the GPU gone
+		log.Println("[Rescan]", server.URL, "retired", resource.Name, resource.UUID)
+		resource.Retired = now
+		server.Resources = removeResource(server.Resources, resource)
+		server.Retired = append(server.Retired, resource)
+		rescan.Retired = append(rescan.Retired, resource.API())
+		m.events.Publish(api.EventResourceRetired, 0, server.ID, resource.API())
+
+		for _, instance := range m.queue {
+			if instance.Resource == resource {
+				stranded = append(stranded, instance)
+			}
 		}
 	}
 
-	Servers = append(Servers, server)
-	for i := 0; i < len(server.Resources); i++ {
-		go server.Resources[i].Handle()
+	for _, resource := range started {
+		log.Println("[Rescan]", server.URL, "found", resource.Name, resource.UUID)
+		rescan.Added = append(rescan.Added, resource.API())
+		m.publishResource(resource)
 	}
-	json.NewEncoder(w).Encode(JSONResponse{Success: true, Message: string(result), Server: ServerResponse{server.ID, server.WorkingDirectory, server.URL, len(server.Resources)}})
+	m.publishServer(server)
+	m.mu.Unlock()
+
+	for _, resource := range started {
+		m.StartResource(resource)
+	}
+
+	for _, instance := range stranded {
+		if err := m.restart(instance, "GPU was removed from the server"); err != nil {
+			return rescan, err
+		}
+	}
+
+	m.mu.RLock()
+	rescan.Server = server.API()
+	m.mu.RUnlock()
+	return rescan, nil
 }
 
-func serverToggleHandler(w http.ResponseWriter, r *http.Request) {
-	type JSONResponse struct {
-		Success bool   `json:"success"`
-		Message string `json:"message"`
-		Enabled bool   `json:"enabled"`
+// removeResource returns the resources without the given one
+func removeResource(resources []*Resource, resource *Resource) []*Resource {
+	for i := range resources {
+		if resources[i] == resource {
+			return append(resources[:i], resources[i+1:]...)
+		}
 	}
+	return resources
+}
 
-	w.Header().Set("Content-Type", "application/json")
+// monitor checks the health of every server, and how close it is to
+// maintenance, once a minute until shutdown
+func (m *Manager) monitor() {
+	for {
+		var wg sync.WaitGroup
+		for _, server := range m.Servers() {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				m.setHealth(server, server.Ping())
+			}()
+		}
+		wg.Wait()
+		m.checkMaintenance(time.Now())
 
-	if r.FormValue("id") == "" {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: "Missing Data"})
-		return
+		select {
+		case <-m.stop:
+			return
+		case <-time.After(1 * time.Minute):
+		}
 	}
+}
 
-	id, err := strconv.Atoi(r.FormValue("id"))
+// setHealth records the result of a health check, publishing it if it has
+// changed
+func (m *Manager) setHealth(server *Server, err error) {
+	health, message := api.HealthOK, ""
 	if err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
-		return
+		health, message = api.HealthUnreachable, err.Error()
 	}
 
-	server := FindServer(id, Servers)
-	if _, err := DB.Exec("update server set enabled = ? where id = ?", !server.Enabled, id); err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if server.health == health && server.healthError == message {
 		return
 	}
+	server.health, server.healthError = health, message
+
+	log.Println("[Health]", server.URL, health, message)
+	m.publishServer(server)
+}
+
+// SetServerDraining sets whether an admin is draining a server. A draining
+// server finishes its running instances but is given no new ones.
+func (m *Manager) SetServerDraining(id int, draining bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	server := FindServer(id, m.servers)
+	if server == nil {
+		return ErrNotFound
+	}
 
-	server.Enabled = !server.Enabled
-	json.NewEncoder(w).Encode(JSONResponse{Success: true, Enabled: server.Enabled})
+	if _, err := DB.Exec("update server set draining = ? where id = ?", draining, id); err != nil {
+		return err
+	}
+
+	server.Draining = draining
+	m.publishServer(server)
+	return nil
 }
 
-func serverRemoveHandler(w http.ResponseWriter, r *http.Request) {
-	type JSONResponse struct {
-		Success bool   `json:"success"`
-		Message string `json:"message"`
+// SetResourceEnabled sets whether a GPU is given new instances
+func (m *Manager) SetResourceEnabled(uuid string, enabled bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	resource := FindServerResource(uuid, m.servers)
+	if resource == nil || !resource.Retired.IsZero() {
+		return ErrNotFound
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	if _, err := DB.Exec("update server_resource set enabled = ? where uuid = ?", enabled, uuid); err != nil {
+		return err
+	}
 
-	if r.FormValue("id") == "" {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: "Missing Data"})
-		return
+	resource.Enabled = enabled
+	m.publishResource(resource)
+	return nil
+}
+
+// RemoveTimeout is how long removing a server waits for the handlers of its
+// GPUs to give up their instances
+var RemoveTimeout = 30 * time.Second
+
+// DeleteServer removes a server. A server with instances running or waiting
+// to resume on it must be drained first, unless force is set, in which case
+// its instances are killed and queued to run again from the start, and
+// uploads and archive copies to or from it are rolled back. The
+// handlers of its GPUs are stopped and its connection closed, but the server
+// and its GPUs are kept in the database for the instances that ran on them.
+func (m *Manager) DeleteServer(id int, force bool) error {
+	m.mu.Lock()
+	server := FindServer(id, m.servers)
+	if server == nil {
+		m.mu.Unlock()
+		return ErrNotFound
 	}
 
-	id, err := strconv.Atoi(r.FormValue("id"))
-	if err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
-		return
+	if !force && m.serverBusy(server) {
+		m.mu.Unlock()
+		return &RequestError{http.StatusConflict, "Drain the server before removing it, or force its instances to be requeued"}
 	}
 
-	if _, err := DB.Exec("DELETE FROM server_resource WHERE server_id = ?", id); err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
-		return
+	if _, err := DB.Exec("update server set removed = ? where id = ?", time.Now().UTC(), id); err != nil {
+		m.mu.Unlock()
+		return err
 	}
 
-	if _, err := DB.Exec("DELETE FROM server WHERE id = ?", id); err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
-		return
+	// Instances waiting to resume on the server have no handler left to
+	// resume them
+	var stranded []*JobInstance
+	for i := 0; i < len(m.queue); i++ {
+		if m.queue[i].Resource != nil && m.queue[i].Resource.Parent == server {
+			stranded = append(stranded, m.queue[i])
+			m.queue = append(m.queue[:i], m.queue[i+1:]...)
+			i--
+		}
 	}
 
-	// Remove Servers
-	index := 0
-	for i := 0; i < len(Servers); i++ {
-		if Servers[i].ID == id {
-			index = i
+	close(server.stop)
+	for i := 0; i < len(m.servers); i++ {
+		if m.servers[i] == server {
+			m.servers = append(m.servers[:i], m.servers[i+1:]...)
 			break
 		}
 	}
-	Servers = append(Servers[:index], Servers[index+1:]...)
+	m.removed = append(m.removed, server)
+	m.events.Publish(api.EventServerRemoved, 0, id, server.API())
+	m.mu.Unlock()
+
+	// Handlers kill and requeue the instances they are running. Closing the
+	// connection ends the sessions they may be blocked on, such as a post
+	// step that never finishes, and any still stuck after RemoveTimeout are
+	// abandoned.
+	server.Disconnect()
+	handlers := make(chan struct{})
+	go func() {
+		server.handlers.Wait()
+		close(handlers)
+	}()
+
+	select {
+	case <-handlers:
+	case <-time.After(RemoveTimeout):
+		log.Println("[Remove]", server.URL, "handlers did not stop within", RemoveTimeout)
+	}
 
-	json.NewEncoder(w).Encode(JSONResponse{Success: true})
+	for _, instance := range stranded {
+		state := m.Instance(instance)
+		err := state.Resource.Kill(state.PID)
+		outcome := "ok"
+		if err != nil {
+			outcome = err.Error()
+		}
+		Audit(SchedulerActor, "kill", instanceTarget(instance), map[string]interface{}{"pid": state.PID, "server": server.URL}, 0, outcome)
+
+		if err := m.restart(instance, "server was removed"); err != nil {
+			log.Println("[Remove]", server.URL, "unable to requeue instance", instance.ID, ":", err)
+		}
+	}
+
+	server.Disconnect()
+	log.Println("[Remove]", server.URL, "removed,", len(stranded), "waiting instances requeued")
+	return nil
 }
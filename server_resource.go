@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -9,235 +11,721 @@ import (
 	"strings"
 	"time"
 
+	"github.com/LCLS/GPUManager/api"
 	"github.com/pkg/sftp"
 )
 
+// Number of times an instance is tried before it is marked as failed, unless
+// its job specification sets its own
+var MaxAttempts = 3
+
+// Stages of running a single job instance
+const (
+	StageUpload  = "upload"
+	StageStart   = "start"
+	StageWait    = "wait"
+	StageRun     = "run"
+	StagePost    = "post"
+	StageArchive = "archive"
+	StageUpdate  = "update"
+)
+
+// StageError records which stage of running an instance failed
+type StageError struct {
+	Stage string
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Stage, e.Err)
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
 type Resource struct {
 	DeviceID   int
 	InUse      bool
+	Enabled    bool
 	Name, UUID string
 	Parent     *Server
-	JobQueue   chan *JobInstance
+
+	// When a rescan found the GPU gone from its server, zero while it is
+	// there, and whether a handler is running for it. Both are guarded by
+	// the manager lock.
+	Retired time.Time
+	handled bool
+
+	// The project whose instance is running, which its use is counted
+	// against
+	project *Project
+
+	// The latest telemetry sample, and why the GPU is occupied by someone
+	// else if it is, both guarded by the manager lock
+	telemetry *api.Telemetry
+	external  string
 }
 
-func (r *Resource) Handle() {
+// Handle runs the instances the manager hands the resource until shutdown or
+// the GPU is retired. Instances are only handed out while their project is
+// within its quota, and new ones are put back if someone else has started
+// using the GPU.
+func (r *Resource) Handle(m *Manager) {
 	Log := log.New(os.Stdout, fmt.Sprintf("%s[%d] ", r.Parent.URL, r.DeviceID), log.Ltime|log.Lshortfile)
 
 	for {
-		time.Sleep(1 * time.Second)
+		select {
+		case <-m.stop:
+			return
+		case <-r.Parent.stop:
+			Log.Println("Server removed")
+			return
+		case <-time.After(1 * time.Second):
+		}
 
-		if !r.Parent.Enabled || r.InUse {
+		jobInstance := m.Next(r)
+		if jobInstance == nil {
+			if m.Retiring(r) {
+				Log.Println("Retired")
+				return
+			}
 			continue
 		}
 
-		// Get Job
-		var jobInstance *JobInstance = nil
-		select {
-		case r := <-r.JobQueue:
-			jobInstance = r
-		default:
-
+		if m.Instance(jobInstance).PID == -1 {
+			if reason := r.CheckExternal(m); reason != "" {
+				Log.Println("Occupied externally,", reason)
+				Audit(SchedulerActor, "occupied", "/resources/"+r.UUID, map[string]interface{}{"instance": jobInstance.ID}, 0, reason)
+				m.Requeue(jobInstance)
+				m.Release(r)
+				continue
+			}
 		}
 
-		if jobInstance == nil {
-			select {
-			case a := <-JobQueue:
-				jobInstance = a
-			default:
+		Log.Println("Instance", jobInstance.ID)
+
+		if err := r.Run(m, Log, jobInstance); err != nil {
+			// Work interrupted by shutdown is resumed from the database on
+			// the next start, so it does not count as an attempt.
+			if m.Stopping() && (errors.Is(err, ErrShutdown) || errors.Is(err, context.Canceled)) {
+				Log.Println("Instance", jobInstance.ID, "interrupted by shutdown")
+				m.Release(r)
+				return
+			}
+
+			// Instances stopped by a forced removal start again elsewhere,
+			// including those whose session ended as the connection closed
+			if errors.Is(err, ErrRemoved) || r.Parent.Removed() {
+				Log.Println("Instance", jobInstance.ID, "stopped, server removed")
+				if err := m.restart(jobInstance, "server was removed"); err != nil {
+					Log.Println("Unable to requeue instance", jobInstance.ID, ":", err)
+				}
+				m.Release(r)
+				return
 			}
+
+			Log.Println("Instance", jobInstance.ID, "failed:", err)
+			r.Fail(m, Log, jobInstance, err)
 		}
 
-		if jobInstance == nil {
-			continue
+		m.Release(r)
+	}
+}
+
+// API returns the representation of the resource used by the JSON API. It
+// must be called with the manager lock held.
+func (r *Resource) API() api.Resource {
+	resource := api.Resource{UUID: r.UUID, Name: r.Name, DeviceID: r.DeviceID, ServerID: r.Parent.ID, Enabled: r.Enabled, InUse: r.InUse, External: r.external}
+	if !r.Retired.IsZero() {
+		retired := r.Retired
+		resource.Retired = &retired
+	}
+	if r.telemetry != nil {
+		telemetry := *r.telemetry
+		resource.Telemetry = &telemetry
+	}
+	return resource
+}
+
+// Run takes an instance from upload through to archival. Any error is
+// returned as a StageError so that the caller can decide how to recover.
+func (r *Resource) Run(m *Manager, Log *log.Logger, jobInstance *JobInstance) error {
+	state := m.Instance(jobInstance)
+	if state.Cancelled && state.PID == -1 {
+		return nil
+	}
+
+	// Run time is only known for simulations launched by this process
+	var launched time.Time
+	pid := state.PID
+	if pid == -1 {
+		var err error
+		if pid, err = r.Launch(m, Log, jobInstance); err != nil {
+			return err
 		}
-		r.InUse = true
+		launched = time.Now()
+	}
 
-		Log.Println(jobInstance)
+	Log.Println("Waiting for completion")
+	exitcode, err := r.Wait(m, jobInstance, pid)
+	if err != nil {
+		return &StageError{StageWait, err}
+	}
+	Log.Println("Exit Code:", exitcode)
+	if !launched.IsZero() {
+		m.metrics.Run.Observe(time.Since(launched))
+	}
 
-		if jobInstance.PID == -1 {
-			// Send Model Data
-			Log.Println("Uploading Model")
-			sftp, err := sftp.NewClient(r.Parent.Client)
-			if err != nil {
-				Log.Fatal(err)
+	if jobInstance.Parent.Container() != "" && m.Instance(jobInstance).ImageDigest == "" {
+		digest, err := r.ImageDigest(jobInstance)
+		if err != nil {
+			Log.Println("Unable to read image digest:", err)
+		} else if err := m.UpdateInstance(jobInstance, func(i *JobInstance) {
+			i.ImageDigest = digest
+		}); err != nil {
+			return &StageError{StageUpdate, err}
+		}
+	}
+
+	// Results are archived even on failure so the logs can be inspected
+	if !m.Instance(jobInstance).Archived {
+		if post := jobInstance.Parent.Config.Post; exitcode == 0 && len(post) > 0 && !m.Instance(jobInstance).Cancelled {
+			Log.Println("Post-processing")
+			m.mu.RLock()
+			setup := setupScript(r.Parent, jobInstance.Parent)
+			m.mu.RUnlock()
+			if err := r.PostProcess(jobInstance, setup, post); err != nil {
+				return &StageError{StagePost, err}
 			}
+		}
 
-			sftp.Mkdir(sftp.Join(r.Parent.WorkingDirectory, "model"))
-			sftp.Mkdir(sftp.Join(r.Parent.WorkingDirectory, "model", strings.ToLower(jobInstance.Parent.Model.Name)))
+		if !m.BeginTransfer() {
+			return &StageError{StageArchive, ErrShutdown}
+		}
+		started := time.Now()
+		ctx, cancel := m.transferContext(r)
+		err = r.Archive(ctx, m.EnabledArchives(jobInstance.Parent), jobInstance, func(progress api.ArchiveProgress) {
+			m.events.Publish(api.EventArchive, progress.JobID, r.Parent.ID, progress)
+		})
+		cancel()
+		m.EndTransfer()
+		if err != nil {
+			return &StageError{StageArchive, err}
+		}
+		m.metrics.Archive.Observe(time.Since(started))
 
-			for _, file := range jobInstance.Parent.Model.Files {
-				fIn, err := os.Open(fmt.Sprintf("data/%s/%s", jobInstance.Parent.Model.Name, file))
-				if err != nil {
-					Log.Fatalln(err)
-				}
+		if err := m.UpdateInstance(jobInstance, func(i *JobInstance) {
+			i.Archived = true
+		}); err != nil {
+			return &StageError{StageUpdate, err}
+		}
+	}
 
-				fOut, err := sftp.Create(sftp.Join(r.Parent.WorkingDirectory, "model", strings.ToLower(jobInstance.Parent.Model.Name), file))
-				if err != nil {
-					Log.Fatalln(err)
-				}
+	if m.Instance(jobInstance).Cancelled {
+		Log.Println("Instance", jobInstance.ID, "cancelled")
+		Audit(SchedulerActor, "cancelled", instanceTarget(jobInstance), nil, 0, "ok")
+		return nil
+	}
 
-				io.Copy(fOut, fIn)
+	if exitcode != 0 {
+		return &StageError{StageRun, fmt.Errorf("exited with status %d", exitcode)}
+	}
 
-				fIn.Close()
-				fIn.Close()
-			}
+	if err := m.UpdateInstance(jobInstance, func(i *JobInstance) {
+		i.Completed = true
+		i.Error = ""
+	}); err != nil {
+		return &StageError{StageUpdate, err}
+	}
+	m.metrics.Succeeded.Add(1)
+	Audit(SchedulerActor, "complete", instanceTarget(jobInstance), nil, 0, "ok")
+	return nil
+}
 
-			// Setup Job Type Parameters
-			executable := ""
-			configuration := ""
+// transferContext is cancelled when the transfers of a resource must roll
+// back: when shutdown runs out of time, or with ErrRemoved as its cause when
+// the server is removed
+func (m *Manager) transferContext(r *Resource) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(m.abort)
+	go func() {
+		select {
+		case <-r.Parent.stop:
+			cancel(ErrRemoved)
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() { cancel(context.Canceled) }
+}
 
-			if jobInstance.Parent.Template.IsProtoMol() {
-				executable = "ProtoMol"
-				configuration = "sim.conf"
-			} else {
-				executable = "python"
-				configuration = "sim.py"
-			}
+// Launch uploads and starts an instance, recording its PID. Shutdown waits
+// for this to finish so that a started process is never left unrecorded.
+func (r *Resource) Launch(m *Manager, Log *log.Logger, jobInstance *JobInstance) (int, error) {
+	if !m.BeginTransfer() {
+		return -1, &StageError{StageUpload, ErrShutdown}
+	}
+	defer m.EndTransfer()
+
+	m.mu.RLock()
+	script := runScript(r.Parent, jobInstance.Parent, r)
+	device := templateDevice(jobInstance.Parent, r)
+	m.mu.RUnlock()
+
+	Log.Println("Uploading Model")
+	started := time.Now()
+	ctx, cancel := m.transferContext(r)
+	err := r.Upload(ctx, jobInstance, script, device)
+	cancel()
+	if err != nil {
+		return -1, &StageError{StageUpload, err}
+	}
+	m.metrics.Upload.Observe(time.Since(started))
 
-			// Send Template Data
-			template, err := jobInstance.Parent.Template.Process(r.DeviceID, *jobInstance.Parent)
-			if err != nil {
-				Log.Fatalln(err)
-			}
+	Log.Println("Starting Job")
+	pid, err := r.Start(jobInstance)
+	if err != nil {
+		return -1, &StageError{StageStart, err}
+	}
+	Log.Println("PID:", pid)
+	m.metrics.Started.Add(1)
+
+	if err := m.UpdateInstance(jobInstance, func(i *JobInstance) {
+		i.PID = pid
+		i.Resource = r
+		i.ImageDigest = ""
+	}); err != nil {
+		return pid, &StageError{StageUpdate, err}
+	}
+	return pid, nil
+}
 
-			sftp.Mkdir(sftp.Join(r.Parent.WorkingDirectory, "job"))
-			sftp.Mkdir(sftp.Join(r.Parent.WorkingDirectory, "job", strings.ToLower(jobInstance.Parent.Name)))
-			sftp.Mkdir(sftp.Join(r.Parent.WorkingDirectory, "job", strings.ToLower(jobInstance.Parent.Name), strings.ToLower(fmt.Sprintf("%d", jobInstance.NumberInSequence()))))
+// Fail records an error against an instance and either queues it to be
+// retried or, once it has used up its attempts, marks it as failed.
+func (r *Resource) Fail(m *Manager, Log *log.Logger, jobInstance *JobInstance, err error) {
+	if m.Instance(jobInstance).Cancelled {
+		Log.Println("Instance", jobInstance.ID, "cancelled, not retrying")
+		return
+	}
 
-			fOut, err := sftp.Create(sftp.Join(r.Parent.WorkingDirectory, "job", strings.ToLower(jobInstance.Parent.Name), strings.ToLower(fmt.Sprintf("%d", jobInstance.NumberInSequence())), configuration))
-			if err != nil {
-				Log.Fatalln(err)
-			}
-			fOut.Write(template)
-			fOut.Close()
+	stage := ""
+	if se, ok := err.(*StageError); ok {
+		stage = se.Stage
+	}
 
-			sftp.Close()
+	var state JobInstance
+	if uerr := m.UpdateInstance(jobInstance, func(i *JobInstance) {
+		i.Attempts += 1
+		i.Error = err.Error()
+
+		// Once the process has been started we resume waiting on it rather
+		// than launching a second copy on another resource.
+		resume := i.PID != -1 && (stage == StageWait || stage == StagePost || stage == StageArchive || stage == StageUpdate)
+		if !resume {
+			i.PID = -1
+			i.Resource = nil
+			i.Archived = false
+		}
 
-			// Start job and retrieve PID
-			Log.Println("Starting Job")
-			session, err := r.Parent.Client.NewSession()
-			if err != nil {
-				Log.Fatalln(err)
-			}
+		if i.Attempts >= i.Parent.MaxAttempts() {
+			i.Failed = true
+		}
+		state = *i
+	}); uerr != nil {
+		Log.Println("Unable to record failure of instance", jobInstance.ID, ":", uerr)
+	}
 
-			command := "/bin/bash\n"
-			command += "source ~/.bash_profile\n"
-			if r.Parent.WorkingDirectory != "" {
-				command += "cd " + r.Parent.WorkingDirectory + "\n"
-			}
-			command += strings.ToLower(fmt.Sprintf("cd job/%s/%d\n", jobInstance.Parent.Name, jobInstance.NumberInSequence()))
-			command += "bash -c '(" + executable + " " + configuration + " &> log.txt 2>&1 & echo $! > pidfile); sleep 1; wait $(cat pidfile); echo $? > exit-status' &> /dev/null &\n"
-			command += "sleep 1\n"
-			command += "cat pidfile"
+	if state.Failed {
+		Log.Println("Instance", jobInstance.ID, "failed after", state.Attempts, "attempts")
+		m.metrics.Failed.Add(1)
+		Audit(SchedulerActor, "fail", instanceTarget(jobInstance), map[string]interface{}{"attempts": state.Attempts, "stage": stage}, 0, err.Error())
+		return
+	}
 
-			sPID, err := session.CombinedOutput(command)
-			if err != nil {
-				Log.Fatalln(string(sPID), err)
-			}
-			session.Close()
+	Log.Println("Retrying instance", jobInstance.ID, "attempt", state.Attempts+1, "of", jobInstance.Parent.MaxAttempts())
+	m.metrics.Retried.Add(1)
+	Audit(SchedulerActor, "retry", instanceTarget(jobInstance), map[string]interface{}{"attempts": state.Attempts, "stage": stage}, 0, err.Error())
+	m.Enqueue(jobInstance)
+}
 
-			// Parse PID
-			pid, err := strconv.Atoi(strings.TrimSpace(string(sPID)))
-			if err != nil {
-				Log.Fatalln(err)
-			}
-			Log.Println("PID:", pid)
+// Upload copies the model files, the template processed for the given device
+// and the run script to the server
+func (r *Resource) Upload(ctx context.Context, jobInstance *JobInstance, script string, device int) error {
+	client, err := r.Parent.SSH()
+	if err != nil {
+		return err
+	}
 
-			jobInstance.PID = pid
-			if _, err := DB.Exec("update job_instance set pid = ? where id = ?", jobInstance.PID, jobInstance.ID); err != nil {
-				Log.Fatalln(err)
-			}
+	sftp, err := sftp.NewClient(client)
+	if err != nil {
+		return err
+	}
+	defer sftp.Close()
 
-			if _, err := DB.Exec("update job_instance set resource_id = ? where id = ?", r.UUID, jobInstance.ID); err != nil {
-				Log.Fatalln(err)
-			}
+	// Send Model Data
+	sftp.Mkdir(sftp.Join(r.Parent.WorkingDirectory, "model"))
+	sftp.Mkdir(sftp.Join(r.Parent.WorkingDirectory, "model", strings.ToLower(jobInstance.Parent.Model.Directory())))
+
+	for _, file := range jobInstance.Parent.Model.Files {
+		if err := r.uploadFile(ctx, sftp, fmt.Sprintf("data/%s/%s", jobInstance.Parent.Model.Directory(), file), sftp.Join(r.Parent.WorkingDirectory, "model", strings.ToLower(jobInstance.Parent.Model.Directory()), file)); err != nil {
+			return err
 		}
+	}
 
-		// Wait for completion
-		Log.Println("Waiting for completion")
-		for {
-			session, err := r.Parent.Client.NewSession()
-			if err != nil {
-				Log.Println(err)
-				r.Parent.Connect()
-			}
+	// Send Template Data
+	template, err := jobInstance.Parent.Template.Process(device, r.DeviceID, *jobInstance.Parent)
+	if err != nil {
+		return err
+	}
 
-			command := ""
-			if r.Parent.WorkingDirectory != "" {
-				command += "cd " + r.Parent.WorkingDirectory + "\n"
-			}
-			command += strings.ToLower(fmt.Sprintf("cd job/%s/%d\n", jobInstance.Parent.Name, jobInstance.NumberInSequence()))
-			command += fmt.Sprintf("if [[ ( ! -d /proc/%d ) || ( ! -z `grep zombie /proc/%d/status` ) ]]; then cat exit-status; fi", jobInstance.PID, jobInstance.PID)
+	sftp.Mkdir(sftp.Join(r.Parent.WorkingDirectory, "job"))
+	sftp.Mkdir(sftp.Join(r.Parent.WorkingDirectory, "job", strings.ToLower(jobInstance.Parent.Name)))
+	sftp.Mkdir(sftp.Join(r.Parent.WorkingDirectory, "job", strings.ToLower(jobInstance.Parent.Name), strings.ToLower(fmt.Sprintf("%d", jobInstance.NumberInSequence()))))
 
-			output, err := session.CombinedOutput(command)
-			if err != nil {
-				Log.Fatalln(string(output), err)
-			}
-			session.Close()
+	directory := sftp.Join(r.Parent.WorkingDirectory, "job", strings.ToLower(jobInstance.Parent.Name), strings.ToLower(fmt.Sprintf("%d", jobInstance.NumberInSequence())))
+	if err := writeFile(sftp, sftp.Join(directory, jobInstance.Parent.Template.Configuration()), template); err != nil {
+		return err
+	}
 
-			if string(output) != "" {
-				exitcode, err := strconv.Atoi(strings.TrimSpace(string(output)))
-				if err != nil {
-					Log.Fatalln(err)
-				}
-				Log.Println("Exit Code:", exitcode)
+	// The run script is kept with the results so what ran can be checked
+	return writeFile(sftp, sftp.Join(directory, RunScript), []byte(script))
+}
+
+func writeFile(client *sftp.Client, remote string, data []byte) error {
+	fOut, err := client.Create(remote)
+	if err != nil {
+		return err
+	}
+	defer fOut.Close()
 
-				break
+	_, err = fOut.Write(data)
+	return err
+}
+
+func (r *Resource) uploadFile(ctx context.Context, client *sftp.Client, local, remote string) error {
+	fIn, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer fIn.Close()
+
+	fOut, err := client.Create(remote)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(fOut, &contextReader{ctx, fIn})
+	fOut.Close()
+	if err != nil {
+		client.Remove(remote)
+	}
+	return err
+}
+
+// Start launches the simulation in the background and returns its PID
+func (r *Resource) Start(jobInstance *JobInstance) (int, error) {
+	client, err := r.Parent.SSH()
+	if err != nil {
+		return -1, err
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return -1, err
+	}
+	defer session.Close()
+
+	command := "/bin/bash\n"
+	if r.Parent.WorkingDirectory != "" {
+		command += "cd " + r.Parent.WorkingDirectory + "\n"
+	}
+	command += strings.ToLower(fmt.Sprintf("cd job/%s/%d\n", jobInstance.Parent.Name, jobInstance.NumberInSequence()))
+	// The simulation must be a child of the shell that waits on it, or wait
+	// cannot collect its exit status
+	command += "bash -c 'bash " + RunScript + " &> log.txt & pid=$!; echo $pid > pidfile; wait $pid; echo $? > exit-status' &> /dev/null &\n"
+	command += "sleep 1\n"
+	command += "cat pidfile"
+
+	sPID, err := session.CombinedOutput(command)
+	if err != nil {
+		return -1, fmt.Errorf("%s %s", strings.TrimSpace(string(sPID)), err)
+	}
+
+	// Parse PID
+	pid, err := strconv.Atoi(strings.TrimSpace(string(sPID)))
+	if err != nil {
+		return -1, err
+	}
+	return pid, nil
+}
+
+// Wait polls the server until the instance exits and returns its exit code.
+// If the instance is cancelled while it runs the process is killed, as it is
+// when the server is removed, which returns ErrRemoved.
+func (r *Resource) Wait(m *Manager, jobInstance *JobInstance, pid int) (int, error) {
+	killed := false
+	for {
+		exitcode, done, err := r.Poll(jobInstance, pid)
+		if err != nil {
+			// The connection may have dropped, so try once more with a new one
+			r.Parent.Disconnect()
+			if exitcode, done, err = r.Poll(jobInstance, pid); err != nil {
+				return -1, err
 			}
+		}
 
-			time.Sleep(30 * time.Second)
+		if done {
+			return exitcode, nil
 		}
 
-		// Copy Results to Archives
-		for _, archive := range Archives {
-			if !archive.Enabled {
-				continue
-			}
+		if !killed && m.Instance(jobInstance).Cancelled {
+			// A failed kill is tried again at the next check
+			err := r.Kill(pid)
+			killed = err == nil
 
-			jobFtp, err := sftp.NewClient(r.Parent.Client)
+			outcome := "ok"
 			if err != nil {
-				Log.Fatal(err)
+				outcome = err.Error()
 			}
+			Audit(SchedulerActor, "kill", instanceTarget(jobInstance), map[string]interface{}{"pid": pid, "server": r.Parent.URL}, 0, outcome)
+		}
 
-			archiveFtp, err := sftp.NewClient(archive.Client)
+		select {
+		case <-m.stop:
+			return -1, ErrShutdown
+		case <-r.Parent.stop:
+			err := r.Kill(pid)
+			outcome := "ok"
 			if err != nil {
-				Log.Fatal(err)
+				outcome = err.Error()
 			}
+			Audit(SchedulerActor, "kill", instanceTarget(jobInstance), map[string]interface{}{"pid": pid, "server": r.Parent.URL}, 0, outcome)
+			return -1, ErrRemoved
+		case <-time.After(30 * time.Second):
+		}
+	}
+}
 
-			workingPath := jobFtp.Join(strings.ToLower(jobInstance.Parent.Name), strings.ToLower(fmt.Sprintf("%d", jobInstance.NumberInSequence())))
+// Kill stops the process of an instance
+func (r *Resource) Kill(pid int) error {
+	client, err := r.Parent.SSH()
+	if err != nil {
+		return err
+	}
 
-			// Create Directory
-			archiveFtp.Mkdir(archiveFtp.Join(archive.WorkingDirectory, strings.ToLower(jobInstance.Parent.Name)))
-			archiveFtp.Mkdir(archiveFtp.Join(archive.WorkingDirectory, workingPath))
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
 
-			// Find Files
-			files, err := jobFtp.ReadDir(jobFtp.Join(r.Parent.WorkingDirectory, "job", workingPath))
-			if err != nil {
-				log.Fatal(err)
-			}
+	output, err := session.CombinedOutput(fmt.Sprintf("kill %d", pid))
+	if err != nil {
+		return fmt.Errorf("%s %s", strings.TrimSpace(string(output)), err)
+	}
+	return nil
+}
 
-			// Copy Files
-			for _, file := range files {
-				fIn, err := jobFtp.Open(jobFtp.Join(r.Parent.WorkingDirectory, "job", workingPath, file.Name()))
-				if err != nil {
-					Log.Fatalln(err)
-				}
-				defer fIn.Close()
+// ImageDigest reads the digest of the container image the run script of the
+// instance ran
+func (r *Resource) ImageDigest(jobInstance *JobInstance) (string, error) {
+	client, err := r.Parent.SSH()
+	if err != nil {
+		return "", err
+	}
 
-				fOut, err := archiveFtp.Create(archiveFtp.Join(archive.WorkingDirectory, workingPath, file.Name()))
-				if err != nil {
-					Log.Fatalln(err)
-				}
-				defer fOut.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
 
-				io.Copy(fOut, fIn)
-			}
+	command := ""
+	if r.Parent.WorkingDirectory != "" {
+		command += "cd " + r.Parent.WorkingDirectory + "\n"
+	}
+	command += "cat job/" + jobInstance.Directory() + "/" + ImageDigest
+
+	output, err := session.CombinedOutput(command)
+	if err != nil {
+		return "", fmt.Errorf("%s %s", strings.TrimSpace(string(output)), err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// PostProcess runs the post-processing steps of the job in the directory of
+// the instance after the setup of the server and job, stopping at the first
+// that fails. Their output is appended to post.txt.
+func (r *Resource) PostProcess(jobInstance *JobInstance, setup string, steps []string) error {
+	client, err := r.Parent.SSH()
+	if err != nil {
+		return err
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	command := setup
+	if r.Parent.WorkingDirectory != "" {
+		command += "cd " + r.Parent.WorkingDirectory + "\n"
+	}
+	command += "cd job/" + jobInstance.Directory() + "\n"
+	command += "set -e\n"
+	command += "{\n" + strings.Join(steps, "\n") + "\n} >> post.txt 2>&1\n"
+
+	output, err := session.CombinedOutput(command)
+	if err != nil {
+		return fmt.Errorf("%s %s, see post.txt", strings.TrimSpace(string(output)), err)
+	}
+	return nil
+}
+
+// Poll checks once whether the instance has exited and its exit status
+// has been written
+func (r *Resource) Poll(jobInstance *JobInstance, pid int) (int, bool, error) {
+	client, err := r.Parent.SSH()
+	if err != nil {
+		return -1, false, err
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return -1, false, err
+	}
+	defer session.Close()
+
+	command := ""
+	if r.Parent.WorkingDirectory != "" {
+		command += "cd " + r.Parent.WorkingDirectory + "\n"
+	}
+	command += strings.ToLower(fmt.Sprintf("cd job/%s/%d\n", jobInstance.Parent.Name, jobInstance.NumberInSequence()))
+	// The shell that waited on the simulation writes exit-status just after
+	// it exits, so until the file has the status the instance is finishing
+	command += fmt.Sprintf("if [[ ( ! -d /proc/%d ) || ( ! -z `grep zombie /proc/%d/status` ) ]]; then [ -s exit-status ] && cat exit-status; fi; true", pid, pid)
+
+	output, err := session.CombinedOutput(command)
+	if err != nil {
+		return -1, false, fmt.Errorf("%s %s", strings.TrimSpace(string(output)), err)
+	}
+
+	if strings.TrimSpace(string(output)) == "" {
+		return -1, false, nil
+	}
+
+	exitcode, err := strconv.Atoi(strings.TrimSpace(string(output)))
+	if err != nil {
+		return -1, false, err
+	}
+	return exitcode, true, nil
+}
+
+// Archive copies the results of an instance to every enabled archive,
+// reporting progress after each file
+func (r *Resource) Archive(ctx context.Context, archives []*Archive, jobInstance *JobInstance, progress func(api.ArchiveProgress)) error {
+	client, err := r.Parent.SSH()
+	if err != nil {
+		return err
+	}
+
+	jobFtp, err := sftp.NewClient(client)
+	if err != nil {
+		return err
+	}
+	defer jobFtp.Close()
+
+	for _, archive := range archives {
+		if err := r.archiveTo(ctx, jobFtp, archive, jobInstance, progress); err != nil {
+			return fmt.Errorf("%s: %w", archive.URL, err)
 		}
+	}
+	return nil
+}
+
+func (r *Resource) archiveTo(ctx context.Context, jobFtp *sftp.Client, archive *Archive, jobInstance *JobInstance, progress func(api.ArchiveProgress)) error {
+	client, err := archive.SSH()
+	if err != nil {
+		return err
+	}
+
+	archiveFtp, err := sftp.NewClient(client)
+	if err != nil {
+		return err
+	}
+	defer archiveFtp.Close()
 
-		jobInstance.Completed = true
-		if _, err := DB.Exec("update job_instance set completed = ? where id = ?", jobInstance.Completed, jobInstance.ID); err != nil {
-			Log.Fatalln(err)
+	workingPath := jobFtp.Join(strings.ToLower(jobInstance.Parent.Name), strings.ToLower(fmt.Sprintf("%d", jobInstance.NumberInSequence())))
+
+	// Create Directory
+	archiveFtp.Mkdir(archiveFtp.Join(archive.WorkingDirectory, strings.ToLower(jobInstance.Parent.Name)))
+	archiveFtp.Mkdir(archiveFtp.Join(archive.WorkingDirectory, workingPath))
+
+	// Find Files
+	files, err := jobFtp.ReadDir(jobFtp.Join(r.Parent.WorkingDirectory, "job", workingPath))
+	if err != nil {
+		return err
+	}
+
+	// Copy Files
+	state := api.ArchiveProgress{JobID: jobInstance.Parent.ID, InstanceID: jobInstance.ID, Archive: archive.URL}
+	for _, file := range files {
+		if !file.IsDir() {
+			state.Files += 1
+		}
+	}
+
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		if err := copyRemoteFile(ctx, jobFtp, jobFtp.Join(r.Parent.WorkingDirectory, "job", workingPath, file.Name()), archiveFtp, archiveFtp.Join(archive.WorkingDirectory, workingPath, file.Name())); err != nil {
+			return err
 		}
-		r.InUse = false
+
+		state.File = file.Name()
+		state.Copied += 1
+		progress(state)
+	}
+	return nil
+}
+
+// copyRemoteFile copies a file between two servers. The copy is written to a
+// temporary name and only renamed into place once complete, so an aborted
+// copy never leaves a truncated file behind.
+func copyRemoteFile(ctx context.Context, from *sftp.Client, src string, to *sftp.Client, dst string) error {
+	fIn, err := from.Open(src)
+	if err != nil {
+		return err
+	}
+	defer fIn.Close()
+
+	part := dst + ".part"
+	fOut, err := to.Create(part)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(fOut, &contextReader{ctx, fIn})
+	fOut.Close()
+	if err != nil {
+		to.Remove(part)
+		return fmt.Errorf("%s: %w", dst, err)
+	}
+
+	return to.PosixRename(part, dst)
+}
+
+// contextReader stops a copy once its context is cancelled, with the cause
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if c.ctx.Err() != nil {
+		return 0, context.Cause(c.ctx)
 	}
+	return c.r.Read(p)
 }
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LCLS/GPUManager/api"
+)
+
+// testFarm is a manager with one server holding one GPU and one archive,
+// both served by test SSH servers. Templates are shell scripts, run by a
+// python on the PATH of the server that hands them to bash.
+type testFarm struct {
+	m        *Manager
+	compute  *testServer
+	store    *testServer
+	server   *Server
+	resource *Resource
+	archive  *Archive
+	nextID   int
+}
+
+func newTestFarm(t *testing.T) *testFarm {
+	t.Helper()
+	newTestDB(t)
+
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	for name, data := range map[string]string{
+		"data/lysozyme/input.pdb": "ATOM\n",
+		"data/sim.py":             "{{.Parameters.script}}\n",
+		"bin/python":              "#!/bin/bash\nexec bash \"$@\"\n",
+	} {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(data), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f := &testFarm{m: NewManager(), compute: newTestServer(t), store: newTestServer(t), nextID: 1}
+	f.compute.env = []string{"PATH=" + filepath.Join(dir, "bin") + ":" + os.Getenv("PATH")}
+
+	// Reconnecting dials port 22 of the URL, which nothing listens on, so a
+	// dropped connection stays dropped
+	f.server = &Server{ID: 1, URL: "127.0.0.1", WorkingDirectory: filepath.Join(dir, "server"), Enabled: true, Client: f.compute.dial(t), stop: make(chan struct{})}
+	f.resource = &Resource{UUID: "GPU-test", Name: "Test GPU", Enabled: true, Parent: f.server}
+	f.server.Resources = []*Resource{f.resource}
+	f.archive = &Archive{ID: 1, URL: "127.0.0.2", WorkingDirectory: filepath.Join(dir, "archive"), Enabled: true, Client: f.store.dial(t)}
+
+	for _, directory := range []string{f.server.WorkingDirectory, f.archive.WorkingDirectory} {
+		if err := os.Mkdir(directory, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f.m.servers = []*Server{f.server}
+	f.m.archives = []*Archive{f.archive}
+	return f
+}
+
+// addJob adds a job of count instances that run script to the manager
+func (f *testFarm) addJob(t *testing.T, name, script string, count int) *Job {
+	t.Helper()
+	job := newTestJob(t, f.m, f.nextID, name, script, count)
+	f.nextID++
+	return job
+}
+
+// TestRunStages injects a failure into each stage of running an instance and
+// checks that it is recorded against the instance, which is retried, and
+// that the resource can be used again
+func TestRunStages(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		inject func(t *testing.T, f *testFarm, job *Job)
+		stage  string
+		resume bool
+	}{
+		{name: "success", script: "echo done"},
+		{name: "upload", script: "echo done", stage: StageUpload, inject: func(t *testing.T, f *testFarm, job *Job) {
+			f.compute.setRefuseSFTP(true)
+		}},
+		{name: "start", script: "echo done", stage: StageStart, inject: func(t *testing.T, f *testFarm, job *Job) {
+			f.compute.fail("pidfile")
+		}},
+		{name: "wait", script: "echo done", stage: StageWait, resume: true, inject: func(t *testing.T, f *testFarm, job *Job) {
+			f.compute.fail("/proc/")
+		}},
+		{name: "run", script: "echo failing; exit 3", stage: StageRun},
+		{name: "post", script: "echo done", stage: StagePost, resume: true, inject: func(t *testing.T, f *testFarm, job *Job) {
+			job.Config.Post = []string{"false"}
+		}},
+		{name: "archive", script: "echo done", stage: StageArchive, resume: true, inject: func(t *testing.T, f *testFarm, job *Job) {
+			f.store.setRefuseSFTP(true)
+		}},
+		{name: "update", script: "echo done", stage: StageUpdate, resume: true, inject: func(t *testing.T, f *testFarm, job *Job) {
+			if _, err := DB.Exec("create trigger injected before update of archived on job_instance when new.archived = 1 begin select raise(abort, 'injected failure'); end"); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newTestFarm(t)
+			job := f.addJob(t, test.name, test.script, 1)
+			if test.inject != nil {
+				test.inject(t, f, job)
+			}
+
+			instance := f.m.Next(f.resource)
+			if instance != job.Instances[0] {
+				t.Fatal("instance was not dispatched")
+			}
+
+			Log := log.New(os.Stderr, test.name+" ", log.Lshortfile)
+			err := f.resource.Run(f.m, Log, instance)
+			if err != nil {
+				f.resource.Fail(f.m, Log, instance, err)
+			}
+			f.m.Release(f.resource)
+			state := f.m.Instance(instance)
+
+			if test.stage == "" {
+				if err != nil {
+					t.Fatal("unexpected error:", err)
+				}
+				if !state.Completed || !state.Archived {
+					t.Fatalf("instance not completed and archived: %+v", state)
+				}
+				if _, err := os.Stat(filepath.Join(f.archive.WorkingDirectory, instance.Directory(), "log.txt")); err != nil {
+					t.Error("log not archived:", err)
+				}
+				return
+			}
+
+			var stageErr *StageError
+			if !errors.As(err, &stageErr) || stageErr.Stage != test.stage {
+				t.Fatalf("expected a failure in stage %s, got %v", test.stage, err)
+			}
+			if state.Completed || state.Failed || state.Attempts != 1 {
+				t.Errorf("expected a first failed attempt, got %+v", state)
+			}
+			if !strings.HasPrefix(state.Error, test.stage+":") {
+				t.Errorf("error %q does not name stage %s", state.Error, test.stage)
+			}
+			if resumed := state.PID != -1 && state.Resource == f.resource; resumed != test.resume {
+				t.Errorf("expected resume %t, PID %d resource %v", test.resume, state.PID, state.Resource)
+			}
+
+			// The instance is queued again and the resource is free to take it
+			if f.resource.InUse {
+				t.Error("resource still in use")
+			}
+			if f.m.Next(f.resource) != instance {
+				t.Error("instance was not queued to be retried")
+			}
+		})
+	}
+}
+
+// TestHandleFailures checks that a handler keeps running instances after one
+// has failed every attempt
+func TestHandleFailures(t *testing.T) {
+	f := newTestFarm(t)
+	f.compute.fail("cd job/broken/")
+
+	broken := f.addJob(t, "broken", "echo done", 1)
+	broken.Config.Retry.Attempts = 2
+	good := f.addJob(t, "good", "echo done", 1)
+
+	f.m.StartResource(f.resource)
+
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		b, g := f.m.Instance(broken.Instances[0]), f.m.Instance(good.Instances[0])
+		if b.Failed && g.Completed {
+			if b.Attempts != 2 {
+				t.Errorf("expected 2 attempts, got %d", b.Attempts)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("instances did not finish: broken %+v, good %+v", b, g)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := f.m.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := AuditEntries(api.AuditFilter{Action: "fail"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Target != instanceTarget(broken.Instances[0]) {
+		t.Errorf("expected the failure to be audited, got %+v", entries)
+	}
+}
+
+// TestDeleteServerTransfer checks that forcing the removal of a server rolls
+// back an upload to it or an archive copy from it, rather than waiting for
+// the transfer, and that the instance is queued to start again
+func TestDeleteServerTransfer(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		post   []string
+		setup  func(t *testing.T, f *testFarm)
+		copied string
+	}{
+		{name: "upload", script: "echo done", setup: func(t *testing.T, f *testFarm) {
+			if err := os.WriteFile("data/lysozyme/input.pdb", make([]byte, 8<<20), 0644); err != nil {
+				t.Fatal(err)
+			}
+			f.compute.setSFTPDelay(20 * time.Millisecond)
+		}, copied: "server/model/lysozyme/input.pdb"},
+		{name: "archive", script: "head -c 8M /dev/zero > output.dat", setup: func(t *testing.T, f *testFarm) {
+			f.store.setSFTPDelay(20 * time.Millisecond)
+		}, copied: "archive/archive/0/output.dat.part"},
+		{name: "post", script: "echo done", post: []string{"sleep 60"}, copied: "server/job/post/0/post.txt"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newTestFarm(t)
+			if test.setup != nil {
+				test.setup(t, f)
+			}
+			job := f.addJob(t, test.name, test.script, 1)
+			job.Config.Post = test.post
+			instance := job.Instances[0]
+
+			f.m.StartResource(f.resource)
+
+			deadline := time.Now().Add(30 * time.Second)
+			for {
+				if _, err := os.Stat(test.copied); err == nil {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("%s did not start: %+v", test.name, f.m.Instance(instance))
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+
+			start := time.Now()
+			if err := f.m.DeleteServer(f.server.ID, true); err != nil {
+				t.Fatal(err)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("removal took %s", elapsed)
+			}
+
+			state := f.m.Instance(instance)
+			if state.Failed || state.Attempts != 0 || state.PID != -1 || state.Resource != nil || state.Archived {
+				t.Errorf("expected the instance to start again, got %+v", state)
+			}
+			if len(f.m.queue) != 1 || f.m.queue[0] != instance {
+				t.Error("instance was not queued")
+			}
+		})
+	}
+}
+
+// TestPoll checks that an instance whose process is gone is only finished
+// once the shell that waited on it has written its exit status
+func TestPoll(t *testing.T) {
+	tests := []struct {
+		name     string
+		written  bool
+		status   string
+		exitcode int
+		done     bool
+	}{
+		{name: "no status"},
+		{name: "empty status", written: true},
+		{name: "status", written: true, status: "3\n", exitcode: 3, done: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newTestFarm(t)
+			instance := f.addJob(t, "polled", "echo done", 1).Instances[0]
+
+			directory := filepath.Join(f.server.WorkingDirectory, "job", instance.Directory())
+			if err := os.MkdirAll(directory, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if test.written {
+				if err := os.WriteFile(filepath.Join(directory, "exit-status"), []byte(test.status), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Beyond the largest PID Linux hands out, so never running
+			exitcode, done, err := f.resource.Poll(instance, 1<<23)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if done != test.done || (done && exitcode != test.exitcode) {
+				t.Errorf("expected %d %v, got %d %v", test.exitcode, test.done, exitcode, done)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LCLS/GPUManager/api"
+)
+
+// TestRescanServer rescans a server with GPUs A and B, and C which was
+// retired, against what nvidia-smi now lists. An instance waiting to resume
+// on B must be restarted if B is gone, and the instance that ran on B must
+// keep its GPU.
+func TestRescanServer(t *testing.T) {
+	tests := []struct {
+		name       string
+		gpus       []string
+		added      []string
+		retired    []string
+		renumbered []api.DeviceChange
+		resources  []string
+	}{
+		{name: "unchanged", gpus: []string{"A", "B"}, resources: []string{"GPU-A", "GPU-B"}},
+		{name: "added", gpus: []string{"A", "B", "D"}, added: []string{"GPU-D"}, resources: []string{"GPU-A", "GPU-B", "GPU-D"}},
+		{name: "removed", gpus: []string{"A"}, retired: []string{"GPU-B"}, resources: []string{"GPU-A"}},
+		{name: "returned", gpus: []string{"A", "B", "C"}, added: []string{"GPU-C"}, resources: []string{"GPU-A", "GPU-B", "GPU-C"}},
+		{name: "reordered", gpus: []string{"B", "A"}, renumbered: []api.DeviceChange{
+			{UUID: "GPU-B", Name: "Tesla B", From: 1, To: 0},
+			{UUID: "GPU-A", Name: "Tesla A", From: 0, To: 1},
+		}, resources: []string{"GPU-A", "GPU-B"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newTestFarm(t)
+
+			var output strings.Builder
+			for i, gpu := range test.gpus {
+				output.WriteString("GPU " + string(rune('0'+i)) + ": Tesla " + gpu + " (UUID: GPU-" + gpu + ")\n")
+			}
+			writeNvidiaSMI(t, output.String())
+
+			// The server as it was last scanned
+			if _, err := DB.Exec("insert into server(id, url, wdir, username, password, enabled) values (1, '127.0.0.1', ?, 'user', 'password', 1)", f.server.WorkingDirectory); err != nil {
+				t.Fatal(err)
+			}
+			a := &Resource{UUID: "GPU-A", Name: "Tesla A", DeviceID: 0, Enabled: true, Parent: f.server}
+			b := &Resource{UUID: "GPU-B", Name: "Tesla B", DeviceID: 1, Enabled: true, Parent: f.server}
+			c := &Resource{UUID: "GPU-C", Name: "Tesla C", DeviceID: 2, Enabled: true, Retired: time.Now().UTC().Add(-time.Hour), Parent: f.server}
+			for _, resource := range []*Resource{a, b, c} {
+				if err := insertResource(resource, 1); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := DB.Exec("update server_resource set retired = ? where uuid = 'GPU-C'", c.Retired); err != nil {
+				t.Fatal(err)
+			}
+			f.server.Resources = []*Resource{a, b}
+			f.server.Retired = []*Resource{c}
+
+			// One instance ran on B, and another is waiting to resume on it
+			job := f.addJob(t, "rescanned", "echo done", 2)
+			finished, waiting := job.Instances[0], job.Instances[1]
+			f.m.mu.Lock()
+			f.m.queue = []*JobInstance{waiting}
+			finished.Completed, finished.Archived, finished.Resource = true, true, b
+			waiting.PID, waiting.Resource = 1234, b
+			f.m.mu.Unlock()
+			for _, instance := range job.Instances {
+				if err := instance.Save(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			rescan, err := f.m.RescanServer(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := f.m.Shutdown(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			if names := uuids(rescan.Added); !reflect.DeepEqual(names, test.added) {
+				t.Errorf("expected %v added, got %v", test.added, names)
+			}
+			if names := uuids(rescan.Retired); !reflect.DeepEqual(names, test.retired) {
+				t.Errorf("expected %v retired, got %v", test.retired, names)
+			}
+			renumbered := rescan.Renumbered
+			if len(renumbered) == 0 {
+				renumbered = nil
+			}
+			if !reflect.DeepEqual(renumbered, test.renumbered) {
+				t.Errorf("expected %v renumbered, got %v", test.renumbered, renumbered)
+			}
+			if names := uuids(rescan.Server.Resources); !reflect.DeepEqual(names, test.resources) {
+				t.Errorf("expected the server to have %v, got %v", test.resources, names)
+			}
+
+			// What was saved must load the same
+			servers, _, err := LoadServers(DB)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var loaded []string
+			for _, resource := range servers[0].Resources {
+				loaded = append(loaded, resource.UUID)
+				for i, gpu := range test.gpus {
+					if resource.UUID == "GPU-"+gpu && resource.DeviceID != i {
+						t.Errorf("%s loaded as device %d, expected %d", resource.UUID, resource.DeviceID, i)
+					}
+				}
+			}
+			sort.Strings(loaded)
+			if !reflect.DeepEqual(loaded, test.resources) {
+				t.Errorf("expected %v to load, got %v", test.resources, loaded)
+			}
+
+			// The instance that ran on B keeps it, even once it is retired
+			var ranOn string
+			if err := DB.QueryRow("select resource_id from job_instance where id = ?", finished.ID).Scan(&ranOn); err != nil {
+				t.Fatal(err)
+			}
+			if resource := FindServerResource(ranOn, servers); resource == nil || resource.UUID != "GPU-B" {
+				t.Errorf("instance ran on %q, which did not load", ranOn)
+			}
+			if f.m.Instance(finished).Resource != b {
+				t.Error("finished instance lost its GPU")
+			}
+
+			state := f.m.Instance(waiting)
+			if len(test.retired) == 0 {
+				if state.Resource != b || state.PID != 1234 {
+					t.Errorf("expected the instance to wait on B, got %+v", state)
+				}
+				return
+			}
+			if state.Resource != nil || state.PID != -1 || state.Error != "GPU was removed from the server" {
+				t.Errorf("expected the instance to be restarted, got %+v", state)
+			}
+			if len(f.m.queue) != 1 || f.m.queue[0] != waiting {
+				t.Error("instance was not queued again")
+			}
+		})
+	}
+}
+
+// writeNvidiaSMI puts an nvidia-smi on the PATH of the test farm that prints
+// output
+func writeNvidiaSMI(t *testing.T, output string) {
+	t.Helper()
+
+	listing, err := filepath.Abs("nvidia-smi.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(listing, []byte(output), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("bin/nvidia-smi", []byte("#!/bin/bash\ncat "+listing+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func uuids(resources []api.Resource) []string {
+	var names []string
+	for _, resource := range resources {
+		names = append(names, resource.UUID)
+	}
+	return names
+}
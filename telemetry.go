@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LCLS/GPUManager/api"
+)
+
+// How often GPU telemetry is collected, and how long it is kept
+var TelemetryInterval = 1 * time.Minute
+var TelemetryRetention = 30 * 24 * time.Hour
+
+// telemetryCommand reports one line per GPU with the fields ParseTelemetry
+// expects, in order
+const telemetryCommand = "nvidia-smi --query-gpu=uuid,utilization.gpu,memory.used,memory.total,temperature.gpu,power.draw,ecc.errors.uncorrected.volatile.total --format=csv,noheader,nounits"
+
+// ParseTelemetry reads the output of telemetryCommand. Fields the GPU does
+// not support, which nvidia-smi prints as [N/A] or [Not Supported], are -1.
+func ParseTelemetry(output []byte, now time.Time) ([]api.Telemetry, error) {
+	reader := csv.NewReader(bytes.NewReader(output))
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = 7
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var samples []api.Telemetry
+	for _, record := range records {
+		samples = append(samples, api.Telemetry{
+			UUID:        strings.TrimSpace(record[0]),
+			Time:        now,
+			Utilization: telemetryInt(record[1]),
+			MemoryUsed:  telemetryInt(record[2]),
+			MemoryTotal: telemetryInt(record[3]),
+			Temperature: telemetryInt(record[4]),
+			Power:       telemetryFloat(record[5]),
+			ECCErrors:   telemetryInt(record[6]),
+		})
+	}
+	return samples, nil
+}
+
+func telemetryInt(field string) int {
+	value, err := strconv.Atoi(strings.TrimSpace(field))
+	if err != nil {
+		return -1
+	}
+	return value
+}
+
+func telemetryFloat(field string) float64 {
+	value, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+	if err != nil {
+		return -1
+	}
+	return value
+}
+
+// Telemetry samples every GPU of the server
+func (s *Server) Telemetry() ([]api.Telemetry, error) {
+	client, err := s.SSH()
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	output, err := session.CombinedOutput(telemetryCommand)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s", strings.TrimSpace(string(output)), err)
+	}
+	return ParseTelemetry(output, time.Now().UTC())
+}
+
+// collectTelemetry samples the GPUs of every server each TelemetryInterval
+// until shutdown, and drops samples older than TelemetryRetention
+func (m *Manager) collectTelemetry() {
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-time.After(TelemetryInterval):
+		}
+
+		var wg sync.WaitGroup
+		for _, server := range m.Servers() {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				// Servers that cannot be reached are reported by the
+				// health check
+				samples, err := server.Telemetry()
+				if err != nil {
+					return
+				}
+
+				// Without the process list, idle GPUs are still judged by
+				// the memory in use
+				apps, err := server.ComputeApps()
+				if err != nil {
+					log.Println("[Telemetry] Unable to list processes on", server.URL, ":", err)
+				}
+				m.recordTelemetry(server, samples, apps)
+			}()
+		}
+		wg.Wait()
+
+		if _, err := DB.Exec("DELETE FROM gpu_telemetry WHERE time < ?", time.Now().UTC().Add(-TelemetryRetention)); err != nil {
+			log.Println("[Telemetry] Unable to drop old samples:", err)
+		}
+	}
+}
+
+// recordTelemetry keeps the samples of the GPUs of a server as their latest
+// and adds them to the time series, and works out which of the GPUs we are
+// not using are occupied by someone else. GPUs the server does not have are
+// ignored.
+func (m *Manager) recordTelemetry(server *Server, samples []api.Telemetry, apps []ComputeApp) {
+	var known []api.Telemetry
+
+	m.mu.Lock()
+	for _, sample := range samples {
+		for _, resource := range server.Resources {
+			if resource.UUID == sample.UUID {
+				latest := sample
+				resource.telemetry = &latest
+				if !resource.InUse {
+					resource.external = externalUse(resource.UUID, apps, &latest)
+				}
+				m.publishResource(resource)
+				known = append(known, sample)
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	for _, sample := range known {
+		if _, err := DB.Exec("insert into gpu_telemetry(resource, time, utilization, memory_used, memory_total, temperature, power, ecc_errors) values (?,?,?,?,?,?,?,?)", sample.UUID, sample.Time, sample.Utilization, sample.MemoryUsed, sample.MemoryTotal, sample.Temperature, sample.Power, sample.ECCErrors); err != nil {
+			log.Println("[Telemetry] Unable to record", sample.UUID, ":", err)
+			return
+		}
+	}
+}
+
+// TelemetrySeries returns the samples of a GPU taken in [since, until),
+// oldest first
+func TelemetrySeries(uuid string, since, until time.Time) ([]api.Telemetry, error) {
+	rows, err := DB.Query("SELECT time, utilization, memory_used, memory_total, temperature, power, ecc_errors FROM gpu_telemetry WHERE resource = ? AND time >= ? AND time < ? ORDER BY time", uuid, since.UTC(), until.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	samples := []api.Telemetry{}
+	for rows.Next() {
+		sample := api.Telemetry{UUID: uuid}
+		if err := rows.Scan(&sample.Time, &sample.Utilization, &sample.MemoryUsed, &sample.MemoryTotal, &sample.Temperature, &sample.Power, &sample.ECCErrors); err != nil {
+			return nil, err
+		}
+		samples = append(samples, sample)
+	}
+	return samples, rows.Err()
+}
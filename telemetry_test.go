@@ -0,0 +1,65 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/LCLS/GPUManager/api"
+)
+
+func TestParseTelemetry(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		output   string
+		expected []api.Telemetry
+		invalid  bool
+	}{
+		{
+			name: "tesla",
+			output: "GPU-5bd4b1c2-0d83-3b6f-9c3a-8a2f6f0e1d11, 97, 10240, 16384, 71, 245.31, 0\n" +
+				"GPU-0e7a9c45-2a11-7f0b-1c9e-3d4e5f6a7b8c, 0, 0, 16384, 34, 38.07, 2\n",
+			expected: []api.Telemetry{
+				{UUID: "GPU-5bd4b1c2-0d83-3b6f-9c3a-8a2f6f0e1d11", Time: now, Utilization: 97, MemoryUsed: 10240, MemoryTotal: 16384, Temperature: 71, Power: 245.31, ECCErrors: 0},
+				{UUID: "GPU-0e7a9c45-2a11-7f0b-1c9e-3d4e5f6a7b8c", Time: now, Utilization: 0, MemoryUsed: 0, MemoryTotal: 16384, Temperature: 34, Power: 38.07, ECCErrors: 2},
+			},
+		},
+		{
+			name:   "no power reading or ECC",
+			output: "GPU-9f1c2d3e-4b5a-6978-8a9b-0c1d2e3f4a5b, 12, 1024, 11264, 45, [N/A], [N/A]\n",
+			expected: []api.Telemetry{
+				{UUID: "GPU-9f1c2d3e-4b5a-6978-8a9b-0c1d2e3f4a5b", Time: now, Utilization: 12, MemoryUsed: 1024, MemoryTotal: 11264, Temperature: 45, Power: -1, ECCErrors: -1},
+			},
+		},
+		{
+			name:   "consumer card",
+			output: "GPU-1a2b3c4d-5e6f-7081-92a3-b4c5d6e7f809, [Not Supported], 512, 4096, 52, [Not Supported], [Not Supported]\n",
+			expected: []api.Telemetry{
+				{UUID: "GPU-1a2b3c4d-5e6f-7081-92a3-b4c5d6e7f809", Time: now, Utilization: -1, MemoryUsed: 512, MemoryTotal: 4096, Temperature: 52, Power: -1, ECCErrors: -1},
+			},
+		},
+		{name: "no GPUs", output: ""},
+		{name: "missing fields", output: "GPU-5bd4b1c2-0d83-3b6f-9c3a-8a2f6f0e1d11, 97, 10240\n", invalid: true},
+		{name: "error message", output: "NVIDIA-SMI has failed because it couldn't communicate with the NVIDIA driver.\n", invalid: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			samples, err := ParseTelemetry([]byte(test.output), now)
+			if test.invalid {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", samples)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(samples, test.expected) {
+				t.Errorf("expected %+v, got %+v", test.expected, samples)
+			}
+		})
+	}
+}
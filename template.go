@@ -3,40 +3,52 @@ package main
 import (
 	"bytes"
 	"database/sql"
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"strings"
 	"text/template"
+
+	"github.com/LCLS/GPUManager/api"
 )
 
 type Template struct {
-	ID   int
-	Name string
-	File string
+	ID       int
+	Name     string
+	Revision int
+	Owner    string
+	Project  string
+	File     string
+
+	// Container is the image the template is run in, if any
+	Container string
 }
 
-func (t *Template) Process(device int, job Job) ([]byte, error) {
+// Process renders the template for an instance. DeviceID is the index CUDA
+// knows the GPU by and ServerDeviceID its index on the server, as used by
+// nvidia-smi.
+func (t *Template) Process(device, serverDevice int, job Job) ([]byte, error) {
 	type TemplateData struct {
-		Input, Output  string
-		Seed, DeviceID int
+		Input, Output                  string
+		Seed, DeviceID, ServerDeviceID int
+		Parameters                     map[string]interface{}
 	}
 
-	data := TemplateData{Seed: int(rand.Int31())}
-	data.DeviceID = device
+	data := TemplateData{Seed: int(rand.Int31()), Parameters: job.Config.Parameters}
+	data.DeviceID, data.ServerDeviceID = device, serverDevice
 	data.Output = fmt.Sprintf("sim.%d.dcd", data.Seed)
 	for _, file := range job.Model.Files {
 		parts := strings.Split(strings.ToLower(file), ".")
 		if parts[len(parts)-1] == "tpr" {
-			data.Input = strings.ToLower(fmt.Sprintf("gromacstprfile ../../../model/%s/%s", job.Model.Name, file))
+			data.Input = strings.ToLower(fmt.Sprintf("gromacstprfile ../../../model/%s/%s", job.Model.Directory(), file))
 			break
 		}
 
 		if parts[len(parts)-1] == "pdb" {
-			data.Input = strings.ToLower(fmt.Sprintf("../../../model/%s/%s", job.Model.Name, file))
+			data.Input = strings.ToLower(fmt.Sprintf("../../../model/%s/%s", job.Model.Directory(), file))
 			break
 		}
 	}
@@ -59,7 +71,21 @@ func (t *Template) IsProtoMol() bool {
 	return parts[len(parts)-1] == "conf"
 }
 
-var Templates []Template
+// Executable returns the program used to run the processed template
+func (t *Template) Executable() string {
+	if t.IsProtoMol() {
+		return "ProtoMol"
+	}
+	return "python"
+}
+
+// Configuration returns the file name the processed template is written to
+func (t *Template) Configuration() string {
+	if t.IsProtoMol() {
+		return "sim.conf"
+	}
+	return "sim.py"
+}
 
 func FindTemplate(id int, templates []Template) *Template {
 	for i := 0; i < len(templates); i++ {
@@ -71,120 +97,117 @@ func FindTemplate(id int, templates []Template) *Template {
 }
 
 func LoadTemplates(db *sql.DB) ([]Template, error) {
-	rows, err := DB.Query("SELECT * FROM template")
+	rows, err := db.Query("SELECT id, name, revision, owner, project, file, container FROM template")
 	if err != nil {
 		return nil, err
 	}
 
 	var templates []Template
 	for rows.Next() {
-		var id int
-		var name, file string
-		if err := rows.Scan(&id, &name, &file); err != nil {
+		var id, revision int
+		var name, owner, project, file, container string
+		if err := rows.Scan(&id, &name, &revision, &owner, &project, &file, &container); err != nil {
 			return nil, err
 		}
-		templates = append(templates, Template{ID: id, Name: name, File: file})
+		templates = append(templates, Template{ID: id, Name: name, Revision: revision, Owner: owner, Project: project, File: file, Container: container})
 	}
+	rows.Close()
 
 	return templates, nil
 }
 
-func templateHandler(w http.ResponseWriter, r *http.Request) {
-	type JSONResponse struct {
-		Success bool   `json:"success"`
-		Message string `json:"message"`
-	}
+// API returns the representation of the template used by the JSON API
+func (t *Template) API() api.Template {
+	return api.Template{ID: t.ID, Name: t.Name, Revision: t.Revision, Owner: t.Owner, Project: t.Project, File: t.File, Executable: t.Executable(), Container: t.Container}
+}
 
-	t, err := template.New("template.html").ParseFiles("template.html")
-	if err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
-		return
-	}
+func (m *Manager) templateHandler(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, "template.html")
+}
 
-	if err := t.Execute(w, Templates); err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
-		return
+// CreateTemplate stores an uploaded template under data/. The extension of
+// the uploaded file decides how it is run, and container names the image it
+// is run in, if any. Uploading a template with the name of an existing one
+// adds a new revision of it.
+func (m *Manager) CreateTemplate(name, project, container string, user User, files map[string][]*multipart.FileHeader) (Template, error) {
+	if name == "" {
+		return Template{}, &RequestError{http.StatusBadRequest, "Missing Name"}
 	}
-}
 
-func templateAddHandler(w http.ResponseWriter, r *http.Request) {
-	type JSONResponse struct {
-		Success  bool      `json:"success"`
-		Message  string    `json:"message"`
-		Template *Template `json:"template"`
+	if strings.ContainsAny(name, "/\\@") {
+		return Template{}, &RequestError{http.StatusBadRequest, "Invalid Name"}
 	}
 
-	if err := r.ParseMultipartForm(1 * 1024 * 1024); err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: "Unable to parse form", Template: nil})
-		return
+	project, err := m.ResolveProject(user, project)
+	if err != nil {
+		return Template{}, err
 	}
 
-	name := r.FormValue("name")
-	if name == "" {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: "Missing Name", Template: nil})
-		return
+	template := Template{Name: name, Revision: 1, Owner: user.Name, Project: project, Container: strings.TrimSpace(container)}
+	if latest, ok := m.FindTemplateRevision(name, 0); ok {
+		template.Revision = latest.Revision + 1
 	}
 
-	template := Template{Name: name, File: fmt.Sprintf("data/%s.template", name)}
+	base := name
+	if template.Revision > 1 {
+		base = fmt.Sprintf("%s@%d", name, template.Revision)
+	}
+	template.File = fmt.Sprintf("data/%s.template", base)
 
-	for _, fileHeaders := range r.MultipartForm.File {
+	for _, fileHeaders := range files {
 		for _, fileHeader := range fileHeaders {
-			file, _ := fileHeader.Open()
-			buf, _ := ioutil.ReadAll(file)
+			file, err := fileHeader.Open()
+			if err != nil {
+				return Template{}, err
+			}
+			buf, err := ioutil.ReadAll(file)
+			file.Close()
+			if err != nil {
+				return Template{}, err
+			}
 
 			parts := strings.Split(strings.ToLower(fileHeader.Filename), ".")
 			extension := parts[len(parts)-1]
-			ioutil.WriteFile(fmt.Sprintf("data/%s.template.%s", name, extension), buf, os.ModePerm)
-			template.File = fmt.Sprintf("data/%s.template.%s", name, extension)
+			if err := ioutil.WriteFile(fmt.Sprintf("data/%s.template.%s", base, extension), buf, os.ModePerm); err != nil {
+				return Template{}, err
+			}
+			template.File = fmt.Sprintf("data/%s.template.%s", base, extension)
 		}
 	}
 
-	res, err := DB.Exec("insert into template(name, file) values (?,?)", template.Name, template.File)
+	res, err := DB.Exec("insert into template(name, revision, owner, project, file, container) values (?,?,?,?,?,?)", template.Name, template.Revision, template.Owner, template.Project, template.File, template.Container)
 	if err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
-		return
+		return Template{}, err
 	}
 
 	id, err := res.LastInsertId()
 	if err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
-		return
+		return Template{}, err
 	}
 	template.ID = int(id)
 
-	Templates = append(Templates, template)
-	json.NewEncoder(w).Encode(JSONResponse{Success: true, Message: "", Template: &template})
+	m.AddTemplate(template)
+	return template, nil
 }
 
-func templateRemoveHandler(w http.ResponseWriter, r *http.Request) {
-	type JSONResponse struct {
-		Success bool   `json:"success"`
-		Message string `json:"message"`
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-
-	id := r.FormValue("id")
-	if id == "" {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: "Missing Data"})
-		return
-	}
-
+// DeleteTemplate removes a template and its file
+func (m *Manager) DeleteTemplate(id int) error {
 	var file string
 	if err := DB.QueryRow("SELECT file FROM template WHERE id = ?", id).Scan(&file); err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
-		return
+		if err == sql.ErrNoRows {
+			return ErrNotFound
+		}
+		return err
 	}
 
-	if err := os.Remove(file); err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
-		return
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return err
 	}
 
 	if _, err := DB.Exec("DELETE FROM template WHERE id = ?", id); err != nil {
-		json.NewEncoder(w).Encode(JSONResponse{Success: false, Message: err.Error()})
-		return
+		return err
 	}
 
-	json.NewEncoder(w).Encode(JSONResponse{Success: true})
+	m.RemoveTemplate(id)
+	return nil
 }